@@ -2,12 +2,31 @@
 package api
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"fhir-validation-proxy/internal/audit"
+	"fhir-validation-proxy/internal/auth"
+	"fhir-validation-proxy/internal/forward"
+	"fhir-validation-proxy/internal/jobs"
+	"fhir-validation-proxy/internal/logging"
+	"fhir-validation-proxy/internal/metrics"
+	"fhir-validation-proxy/internal/queue"
+	"fhir-validation-proxy/internal/trace"
 	"fhir-validation-proxy/internal/validator"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestValidateHandler_Valid(t *testing.T) {
@@ -83,3 +102,1006 @@ func TestValidateHandler_InvalidJSON(t *testing.T) {
 		t.Errorf("Expected OperationOutcome for error")
 	}
 }
+
+func TestProxy_ForwardsValidResource(t *testing.T) {
+	var forwarded *http.Request
+	var forwardedBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		forwarded, forwardedBody = r, string(b)
+		w.Header().Set("Content-Type", "application/fhir+json")
+		w.Header().Set("Location", "http://upstream/fhir/Observation/obs1/_history/2")
+		w.Header().Set("ETag", `W/"2"`)
+		w.Header().Set("Connection", "X-Upstream-Hop")
+		w.Header().Set("X-Upstream-Hop", "1")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(b)
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL + "/base")
+	proxy := &Proxy{Forwarder: forward.New(time.Second, target), Prefix: "/fhir"}
+
+	body := `{"resourceType": "Observation", "id": "obs1"}`
+	req := httptest.NewRequest(http.MethodPut, "/fhir/Observation/obs1?_format=json", strings.NewReader(body))
+	req.Header.Set("If-Match", `W/"1"`)
+	req.Header.Set("Prefer", "return=representation")
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "Basic secret")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK, got %d", rw.Code)
+	}
+	if forwardedBody != body {
+		t.Errorf("Expected upstream to receive %q, got %q", body, forwardedBody)
+	}
+	if forwarded.Method != http.MethodPut || forwarded.URL.Path != "/base/Observation/obs1" || forwarded.URL.RawQuery != "_format=json" {
+		t.Errorf("Unexpected upstream request %s %s", forwarded.Method, forwarded.URL)
+	}
+	for name, want := range map[string]string{
+		"If-Match":            `W/"1"`,
+		"Prefer":              "return=representation",
+		"Authorization":       "Bearer token",
+		"X-Client-Hop":        "",
+		"Proxy-Authorization": "",
+		"X-Forwarded-Host":    "example.com",
+	} {
+		if got := forwarded.Header.Get(name); got != want {
+			t.Errorf("Upstream %s = %q, want %q", name, got, want)
+		}
+	}
+	for name, want := range map[string]string{
+		"Location":       "http://upstream/fhir/Observation/obs1/_history/2",
+		"ETag":           `W/"2"`,
+		"X-Upstream-Hop": "",
+	} {
+		if got := rw.Header().Get(name); got != want {
+			t.Errorf("Response %s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestProxy_PassThrough(t *testing.T) {
+	var forwarded []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.Method+" "+r.URL.String())
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	proxy := &Proxy{Forwarder: forward.New(time.Second, target), Prefix: "/fhir"}
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/fhir/Patient/1", nil))
+	if rw.Code != http.StatusMethodNotAllowed || len(forwarded) != 0 {
+		t.Fatalf("Expected 405 without PassThrough, got %d", rw.Code)
+	}
+
+	proxy.PassThrough = true
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodDelete} {
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest(method, "/fhir/Patient/1?_pretty=true", nil))
+		if rw.Code != http.StatusOK {
+			t.Errorf("Expected 200 for %s, got %d", method, rw.Code)
+		}
+	}
+	want := []string{"GET /Patient/1?_pretty=true", "HEAD /Patient/1?_pretty=true", "DELETE /Patient/1?_pretty=true"}
+	if strings.Join(forwarded, ",") != strings.Join(want, ",") {
+		t.Errorf("Forwarded %q, want %q", forwarded, want)
+	}
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodOptions, "/fhir/Patient/1", nil))
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for OPTIONS, got %d", rw.Code)
+	}
+}
+
+func TestProxy_Patch(t *testing.T) {
+	var patched *http.Request
+	var patch string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("ETag", `W/"3"`)
+			_, _ = w.Write([]byte(`{"resourceType":"Observation","id":"obs1","status":"preliminary"}`))
+		case http.MethodPatch:
+			b, _ := io.ReadAll(r.Body)
+			patched, patch = r, string(b)
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	proxy := &Proxy{Forwarder: forward.New(time.Second, target), Prefix: "/fhir", PassThrough: true}
+	send := func(contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/fhir/Observation/obs1", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	body := `[{"op":"replace","path":"/status","value":"final"}]`
+	if rw := send("application/json-patch+json", body); rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for a valid patch, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if patch != body || patched.Header.Get("If-Match") != `W/"3"` {
+		t.Errorf("Upstream got patch %q with If-Match %q", patch, patched.Header.Get("If-Match"))
+	}
+
+	patched = nil
+	if rw := send("application/json-patch+json", `[{"op":"remove","path":"/resourceType"}]`); rw.Code != http.StatusBadRequest || patched != nil {
+		t.Errorf("Expected 400 and nothing forwarded for an invalid result, got %d", rw.Code)
+	}
+	if rw := send("application/json-patch+json", `[{"op":"remove","path":"/code"}]`); rw.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a patch that does not apply, got %d", rw.Code)
+	}
+	if rw := send("application/fhir+json", `{"resourceType":"Parameters"}`); rw.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for a FHIRPath Patch, got %d", rw.Code)
+	}
+}
+
+func TestProxy_UpstreamTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	proxy := &Proxy{Forwarder: forward.New(20*time.Millisecond, target)}
+
+	req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(`{"resourceType": "Observation"}`))
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusBadGateway {
+		t.Fatalf("Expected 502 Bad Gateway, got %d", rw.Code)
+	}
+}
+
+func TestProxy_CircuitOpen(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	target, _ := url.Parse(down.URL)
+	down.Close()
+
+	forwarder := forward.New(time.Second, target)
+	forwarder.Threshold = 1
+	proxy := &Proxy{Forwarder: forwarder}
+
+	codes := []int{}
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(`{"resourceType": "Observation"}`))
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		codes = append(codes, rw.Code)
+		if i == 1 && rw.Header().Get("Retry-After") == "" {
+			t.Errorf("Expected Retry-After while the circuit is open")
+		}
+	}
+	if codes[0] != http.StatusBadGateway || codes[1] != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 502 then 503, got %v", codes)
+	}
+
+	rw := httptest.NewRecorder()
+	UpstreamStatusHandler(forwarder).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/_upstream", nil))
+	if !strings.Contains(rw.Body.String(), `"state":"open"`) {
+		t.Errorf("Expected open upstream in status, got %s", rw.Body.String())
+	}
+}
+
+func TestProxy_QueuesWhenUpstreamDown(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	target, _ := url.Parse(down.URL)
+	down.Close()
+
+	q, err := queue.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{Forwarder: forward.New(time.Second, target), Queue: q}
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(`{"resourceType": "Observation"}`))
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Cookie", "session=secret")
+		req.Header.Set("Prefer", "return=minimal")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		if rw.Code != http.StatusAccepted {
+			t.Fatalf("Expected 202 Accepted, got %d", rw.Code)
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	QueueHandler(q).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, QueuePath, nil))
+	var status struct {
+		Depth int `json:"depth"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &status); err != nil || status.Depth != 2 {
+		t.Fatalf("Expected queue depth 2, got %s", rw.Body.String())
+	}
+	if strings.Contains(rw.Body.String(), "header") {
+		t.Errorf("Expected no headers in the queue status, got %s", rw.Body.String())
+	}
+
+	// The upstream authenticates the proxy with a service credential
+	var received []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer service" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		received = append(received, string(b))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+	target, _ = url.Parse(upstream.URL)
+	proxy.Forwarder = forward.New(time.Second, target)
+
+	entry, _ := q.Oldest()
+	if entry.Header.Get("Authorization") != "" || entry.Header.Get("Cookie") != "" || entry.Header.Get("Prefer") == "" {
+		t.Errorf("Expected credentials removed from the queued headers, got %v", entry.Header)
+	}
+	reader := func() (io.Reader, error) { return strings.NewReader(`{"resourceType": "Observation"}`), nil }
+	if code, err := proxy.Deliver(context.Background(), entry, reader); err != nil || code != http.StatusUnauthorized {
+		t.Fatalf("Deliver() without a service credential = %d, %v, want 401", code, err)
+	}
+	proxy.Forwarder.Authorization = "Bearer service"
+	if code, err := proxy.Deliver(context.Background(), entry, reader); err != nil || code != http.StatusCreated {
+		t.Fatalf("Deliver() = %d, %v", code, err)
+	}
+	if len(received) != 1 {
+		t.Errorf("Expected upstream to receive the queued request")
+	}
+}
+
+func TestProxy_DryRun(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Dry run must not be forwarded")
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	proxy := &Proxy{Forwarder: forward.New(time.Second, target), Prefix: "/fhir"}
+
+	req := httptest.NewRequest(http.MethodPut, "/fhir/Observation/obs1", strings.NewReader(`{"resourceType": "Observation"}`))
+	req.Header.Set(DryRunHeader, "true")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK, got %d", rw.Code)
+	}
+	want := "Dry run: the request would be forwarded to PUT " + upstream.URL + "/Observation/obs1"
+	if !strings.Contains(rw.Body.String(), want) {
+		t.Errorf("Expected %q in %s", want, rw.Body.String())
+	}
+}
+
+func TestProxy_EnforcesScopes(t *testing.T) {
+	proxy := RequireAuth(&auth.Verifier{}, &Proxy{Prefix: "/fhir"})
+	send := func(scopes []string, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if scopes != nil {
+			id := &auth.Identity{ClientID: "partner-a", Scopes: scopes}
+			req = req.WithContext(auth.NewContext(req.Context(), id))
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := send(nil, http.MethodPost, "/fhir/Observation", `{"resourceType": "Observation"}`)
+	if rw.Code != http.StatusUnauthorized || rw.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected 401 with WWW-Authenticate without a token, got %d", rw.Code)
+	}
+	if rw := send([]string{"system/Patient.write"}, http.MethodPost, "/fhir/Observation", `{"resourceType": "Observation"}`); rw.Code != http.StatusForbidden ||
+		!strings.Contains(rw.Body.String(), `"code":"forbidden"`) {
+		t.Errorf("Expected 403 forbidden, got %d %s", rw.Code, rw.Body.String())
+	}
+	if rw := send([]string{"system/Observation.c"}, http.MethodPost, "/fhir/Observation", `{"resourceType": "Observation"}`); rw.Code != http.StatusOK {
+		t.Errorf("Expected 200 with system/Observation.c, got %d %s", rw.Code, rw.Body.String())
+	}
+
+	bundle := `{"resourceType": "Bundle", "type": "transaction", "entry": [
+		{"fullUrl": "urn:uuid:1", "resource": {"resourceType": "Patient"}, "request": {"method": "POST", "url": "Patient"}},
+		{"request": {"method": "DELETE", "url": "Observation/2"}}
+	]}`
+	rw = send([]string{"system/Patient.write", "system/Observation.c"}, http.MethodPost, "/fhir", bundle)
+	if rw.Code != http.StatusForbidden || !strings.Contains(rw.Body.String(), "may not delete Observation (Bundle.entry[1])") {
+		t.Errorf("Expected 403 for the DELETE entry, got %d %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestAuthenticator_ClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "rules.yaml"), []byte("Observation:\n  performer:\n    min: 1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tenant, err := validator.LoadRuleSet(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { delete(TenantRules, "wales") }()
+	TenantRules["wales"] = tenant
+
+	a := &Authenticator{Clients: auth.NewClients(map[string]*auth.Client{
+		"partner-a": {
+			Subjects:  []string{"CN=partner-a"},
+			Scopes:    []string{"system/Observation.write"},
+			Tenant:    "wales",
+			RateLimit: 0.001,
+			Burst:     1,
+		},
+	})}
+	handler := a.Wrap(&Proxy{})
+	send := func(cn string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(`{"resourceType": "Observation"}`))
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	if rw := send("stranger"); rw.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for an unregistered certificate, got %d", rw.Code)
+	}
+	// The tenant's rules apply: performer is required
+	if rw := send("partner-a"); rw.Code != http.StatusBadRequest || !strings.Contains(rw.Body.String(), "performer") {
+		t.Errorf("Expected the tenant's rules to reject the resource, got %d %s", rw.Code, rw.Body.String())
+	}
+	if rw := send("partner-a"); rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After over the rate limit, got %d", rw.Code)
+	}
+}
+
+func TestAuthenticator_Admin(t *testing.T) {
+	handler := (&Authenticator{Verifier: &auth.Verifier{}}).Admin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for _, tc := range []struct {
+		scopes []string
+		want   int
+	}{
+		{[]string{"system/*.*"}, http.StatusForbidden},
+		{[]string{auth.AdminScope}, http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, QueuePath, nil)
+		req = req.WithContext(auth.NewContext(req.Context(), &auth.Identity{ClientID: "partner-a", Scopes: tc.scopes}))
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		if rw.Code != tc.want {
+			t.Errorf("Scopes %v: expected %d, got %d", tc.scopes, tc.want, rw.Code)
+		}
+	}
+}
+
+// recordSink keeps the audit records written to it.
+type recordSink struct{ records []*audit.Record }
+
+func (s *recordSink) Write(rec *audit.Record) error {
+	s.records = append(s.records, rec)
+	return nil
+}
+
+func (s *recordSink) Close() error { return nil }
+
+func TestAudit_RecordsSubmissions(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	sink := &recordSink{}
+	l := audit.NewLogger(sink)
+	handler := Audit(l, RequireAuth(&auth.Verifier{}, &Proxy{Forwarder: forward.New(time.Second, target), Prefix: "/fhir"}))
+	send := func(id *auth.Identity, body string) {
+		req := httptest.NewRequest(http.MethodPost, "/fhir/Observation", strings.NewReader(body))
+		if id != nil {
+			req = req.WithContext(auth.NewContext(req.Context(), id))
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	partner := &auth.Identity{ClientID: "partner-a", Scopes: []string{"system/*.write"}, Method: auth.MethodToken}
+	send(partner, `{"resourceType": "Observation", "status": "final"}`)
+	send(partner, `{"id": "no-type"}`)
+	send(nil, `{"resourceType": "Observation"}`)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.records) != 3 {
+		t.Fatalf("Expected 3 audit records, got %d", len(sink.records))
+	}
+	forwarded, rejected, refused := sink.records[0], sink.records[1], sink.records[2]
+	if forwarded.ClientID != "partner-a" || forwarded.ResourceType != "Observation" || forwarded.Interaction != "create" ||
+		forwarded.Verdict != audit.VerdictValid || forwarded.Status != http.StatusCreated || forwarded.UpstreamStatus != http.StatusCreated {
+		t.Errorf("Unexpected record of a forwarded resource %+v", forwarded)
+	}
+	if forwarded.PayloadSHA256 == "" || forwarded.Payload != nil {
+		t.Errorf("Expected the payload hashed, not stored: %+v", forwarded)
+	}
+	if rejected.Verdict != audit.VerdictInvalid || rejected.Status != http.StatusBadRequest || rejected.UpstreamStatus != 0 {
+		t.Errorf("Unexpected record of an invalid resource %+v", rejected)
+	}
+	if refused.ClientID != "" || refused.Verdict != "" || refused.Status != http.StatusUnauthorized {
+		t.Errorf("Unexpected record of an unauthenticated request %+v", refused)
+	}
+}
+
+func TestProxy_ShadowLogsDifferences(t *testing.T) {
+	dir := t.TempDir()
+	rules := "Observation:\n  status:\n    min: 1\n"
+	if err := os.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	shadow, err := validator.LoadRuleSet(dir)
+	if err != nil {
+		t.Fatalf("LoadRuleSet() error = %v", err)
+	}
+
+	logs := &lockedBuilder{}
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logging.New(logs, slog.LevelInfo))
+
+	body := `{"resourceType": "Observation", "id": "obs1"}`
+	req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(body))
+	rw := httptest.NewRecorder()
+	proxy := &Proxy{Shadow: NewShadow(shadow, 1)}
+	proxy.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK || rw.Body.String() != body {
+		t.Fatalf("Shadow rules must not affect the response, got %d %s", rw.Code, rw.Body.String())
+	}
+	// Shadow validation finishes after the response
+	if err := proxy.Shadow.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+	const want = `"activeValid":true,"candidateValid":false,"added":"error Observation.status:min"`
+	if !strings.Contains(logs.String(), want) {
+		t.Fatalf("Expected shadow difference to be logged, got %q", logs.String())
+	}
+
+	// With every worker busy, comparisons are dropped and counted
+	dropped := metrics.ShadowDropped.Value()
+	proxy.Shadow.slots <- struct{}{}
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(body)))
+	<-proxy.Shadow.slots
+	if rw.Code != http.StatusOK || metrics.ShadowDropped.Value()-dropped != 1 {
+		t.Errorf("Expected the comparison to be dropped, got %d and %v dropped", rw.Code, metrics.ShadowDropped.Value()-dropped)
+	}
+}
+
+// lockedBuilder is a strings.Builder that may be written from several
+// goroutines.
+type lockedBuilder struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (l *lockedBuilder) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuilder) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+func TestRequestLog(t *testing.T) {
+	var forwardedID string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedID = r.Header.Get(logging.RequestIDHeader)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	var logs strings.Builder
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logging.New(&logs, slog.LevelInfo))
+	handler := RequestLog(&Proxy{Forwarder: forward.New(time.Second, target), Prefix: "/fhir"})
+
+	send := func(requestID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/fhir/Observation?subject=Patient/nhs-9434765919", strings.NewReader(`{"resourceType": "Observation"}`))
+		if requestID != "" {
+			req.Header.Set(logging.RequestIDHeader, requestID)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := send("")
+	generated := rw.Header().Get(logging.RequestIDHeader)
+	if generated == "" || forwardedID != generated {
+		t.Errorf("Expected a generated request ID returned and passed upstream, got %q and %q", generated, forwardedID)
+	}
+	if rw := send("abc-123"); rw.Header().Get(logging.RequestIDHeader) != "abc-123" || forwardedID != "abc-123" {
+		t.Errorf("Expected the client's request ID to be kept, got %q", forwardedID)
+	}
+	if rw := send("bad id\n"); rw.Header().Get(logging.RequestIDHeader) == "bad id\n" {
+		t.Errorf("Expected an unusable request ID to be replaced")
+	}
+
+	var summary map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.SplitN(logs.String(), "\n", 2)[0]), &summary); err != nil {
+		t.Fatalf("Expected a JSON summary line, got %q", logs.String())
+	}
+	if summary["msg"] != "Request handled" || summary["requestId"] != generated || summary["status"] != float64(201) ||
+		summary["resourceType"] != "Observation" || summary["verdict"] != "valid" || summary["latencyMs"] == nil {
+		t.Errorf("Unexpected summary line %v", summary)
+	}
+	if strings.Contains(logs.String(), "9434765919") || summary["query"] != logging.Redacted {
+		t.Errorf("Expected the query to be redacted, got %q", logs.String())
+	}
+}
+
+func TestRequestLog_CountsMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	mux := http.NewServeMux()
+	mux.Handle("/fhir/", &Proxy{Forwarder: forward.New(time.Second, target), Prefix: "/fhir"})
+	handler := RequestLog(mux)
+	send := func(path, body string) {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	}
+
+	requests := metrics.Requests.Value("/fhir/", http.MethodPost, "400")
+	unmatched := metrics.Requests.Value("none", http.MethodPost, "404")
+	builtin := metrics.Rejections.Value("", metrics.BuiltinRule)
+	invalid := metrics.ValidationDuration.Count(audit.VerdictInvalid)
+	upstreamErrors := metrics.UpstreamErrors.Value(target.Host, "503")
+
+	send("/fhir/Observation", `{"resourceType": "Observation"}`)
+	send("/fhir/Observation", `{"id": "no-type"}`)
+	send("/nowhere", `{}`)
+
+	if got := metrics.Requests.Value("/fhir/", http.MethodPost, "400") - requests; got != 1 {
+		t.Errorf("Expected 1 rejected request counted for /fhir/, got %v", got)
+	}
+	if got := metrics.Requests.Value("none", http.MethodPost, "404") - unmatched; got != 1 {
+		t.Errorf("Expected 1 unmatched request, got %v", got)
+	}
+	if got := metrics.Rejections.Value("", metrics.BuiltinRule) - builtin; got < 1 {
+		t.Errorf("Expected the rejection counted, got %v", got)
+	}
+	if got := metrics.ValidationDuration.Count(audit.VerdictInvalid) - invalid; got != 1 {
+		t.Errorf("Expected 1 invalid validation timed, got %v", got)
+	}
+	if got := metrics.UpstreamErrors.Value(target.Host, "503") - upstreamErrors; got < 1 {
+		t.Errorf("Expected the unavailable upstream counted, got %v", got)
+	}
+}
+
+func TestTrace_PropagatesToUpstream(t *testing.T) {
+	var upstreamParent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamParent = r.Header.Get(trace.TraceparentHeader)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	path := filepath.Join(t.TempDir(), "spans.json")
+	exporter, err := trace.OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := trace.NewTracer(exporter)
+	trace.SetTracer(tracer)
+	defer trace.SetTracer(nil)
+
+	mux := http.NewServeMux()
+	mux.Handle("/fhir/", &Proxy{Forwarder: forward.New(time.Second, target), Prefix: "/fhir"})
+	req := httptest.NewRequest(http.MethodPost, "/fhir/Observation", strings.NewReader(`{"resourceType": "Observation"}`))
+	req.Header.Set(trace.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rw := httptest.NewRecorder()
+	Trace(mux).ServeHTTP(rw, req)
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 Created, got %d", rw.Code)
+	}
+	sc, ok := trace.ParseTraceparent(upstreamParent)
+	if !ok || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() == "00f067aa0ba902b7" {
+		t.Errorf("Expected the upstream to continue the trace from the proxy's span, got %q", upstreamParent)
+	}
+	exported, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"POST /fhir/", "validator.validate", "validator.parse", "validator.rules", "forward", `"name":"POST"`, sc.SpanID.String()} {
+		if !strings.Contains(string(exported), name) {
+			t.Errorf("Expected %s in the exported spans, got %s", name, exported)
+		}
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	if err := validator.LoadConfigDir("../configs"); err != nil {
+		t.Fatalf("LoadConfigDir() error = %v", err)
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	downTarget, _ := url.Parse(down.URL)
+	down.Close()
+
+	check := func(h http.Handler) (int, string) {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rw.Code, rw.Body.String()
+	}
+	if code, _ := check(http.HandlerFunc(HealthHandler)); code != http.StatusOK {
+		t.Errorf("Expected /healthz to be 200, got %d", code)
+	}
+	if code, body := check(&Readiness{}); code != http.StatusOK {
+		t.Errorf("Expected ready without an upstream, got %d %s", code, body)
+	}
+	// Probes only read the circuit breakers; they never reach the upstream
+	forwarder := forward.New(time.Second, downTarget)
+	forwarder.Threshold = 1
+	if code, body := check(&Readiness{Forwarder: forwarder}); code != http.StatusOK || !strings.Contains(body, `"upstream":"ok"`) {
+		t.Errorf("Expected ready with the circuit closed, got %d %s", code, body)
+	}
+
+	(&Proxy{Forwarder: forwarder}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(`{"resourceType": "Observation"}`)))
+	if code, body := check(&Readiness{Forwarder: forwarder}); code != http.StatusServiceUnavailable ||
+		!strings.Contains(body, `"upstream":"circuit open"`) || strings.Contains(body, downTarget.Host) {
+		t.Errorf("Expected not ready with the circuit open, got %d %s", code, body)
+	}
+	// With a queue, the proxy takes writes while the upstream is down
+	if code, body := check(&Readiness{Forwarder: forwarder, Queued: true}); code != http.StatusOK || strings.Contains(body, "upstream") {
+		t.Errorf("Expected ready with a queue and the circuit open, got %d %s", code, body)
+	}
+
+	readiness := &Readiness{}
+	readiness.Drain()
+	if code, body := check(readiness); code != http.StatusServiceUnavailable || !strings.Contains(body, "shutting down") {
+		t.Errorf("Expected not ready while shutting down, got %d %s", code, body)
+	}
+
+	rw := httptest.NewRecorder()
+	StatusHandler(forwarder).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var status map[string]json.RawMessage
+	if err := json.NewDecoder(rw.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	var config validator.ConfigStatus
+	if err := json.Unmarshal(status["config"], &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Loaded == nil || len(config.Files) == 0 || config.Files[0].SHA256 == "" || status["upstreams"] != nil ||
+		string(status["upstream"]) != `"circuit open"` {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
+
+func TestProxy_ForwardsNormalisedResource(t *testing.T) {
+	rules := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(rules, []byte("Device:\n  manufacturer:\n    normalize: {trim: true, uppercase: true}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := validator.LoadRules(rules); err != nil {
+		t.Fatalf("LoadRules() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(`{"id": "dev1", "resourceType": "Device", "manufacturer": " acme "}`))
+	rw := httptest.NewRecorder()
+	(&Proxy{}).ServeHTTP(rw, req)
+
+	want := `{"resourceType":"Device","id":"dev1","manufacturer":"ACME"}`
+	if rw.Code != http.StatusOK || rw.Body.String() != want {
+		t.Fatalf("Expected corrected resource %s, got %d %s", want, rw.Code, rw.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(`{"resourceType": "Device", "manufacturer": "acme"}`))
+	req.Header.Set(DryRunHeader, "true")
+	rw = httptest.NewRecorder()
+	(&Proxy{}).ServeHTTP(rw, req)
+	if !strings.Contains(rw.Body.String(), `Normalised manufacturer`) {
+		t.Errorf("Expected normalisation in dry-run outcome, got %s", rw.Body.String())
+	}
+}
+
+func TestMetadata_MergesAndCachesUpstream(t *testing.T) {
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Method != http.MethodGet || r.URL.Path != "/metadata" {
+			t.Errorf("Unexpected upstream request %s %s", r.Method, r.URL)
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("Expected the client's credentials not to be sent for the shared statement")
+		}
+		w.Header().Set("Content-Type", "application/fhir+json")
+		_, _ = io.WriteString(w, `{"resourceType": "CapabilityStatement", "rest": [{"mode": "server", "resource": [{"type": "Observation"}]}]}`)
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	metadata := &Metadata{Forwarder: forward.New(time.Second, target)}
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/metadata", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		metadata.ServeHTTP(rw, req)
+		if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `"type":"Observation"`) ||
+			!strings.Contains(rw.Body.String(), `"name":"validate"`) {
+			t.Fatalf("Unexpected CapabilityStatement %d %s", rw.Code, rw.Body.String())
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected the upstream statement to be cached, got %d calls", calls)
+	}
+}
+
+func TestMetadata_CachesUpstreamFailure(t *testing.T) {
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	metadata := &Metadata{Forwarder: forward.New(time.Second, target)}
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		metadata.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/metadata", nil))
+		if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `"name":"validate"`) {
+			t.Fatalf("Expected the proxy's own statement, got %d %s", rw.Code, rw.Body.String())
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected the failure to be cached, got %d calls", calls)
+	}
+}
+
+func TestConformanceHandler_ReadAndSearch(t *testing.T) {
+	if err := validator.LoadProfiles("../configs/profiles"); err != nil {
+		t.Fatalf("Failed to load profiles: %v", err)
+	}
+	raw, err := os.ReadFile("../configs/profiles/patient.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := ConformanceHandler("/fhir", nil)
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/fhir/StructureDefinition/DataStandardsWales-Patient", nil))
+	if rw.Code != http.StatusOK || rw.Body.String() != string(raw) {
+		t.Fatalf("Expected the profile as loaded, got %d %.80s", rw.Code, rw.Body.String())
+	}
+
+	search := func(query string) (int, int) {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/fhir/StructureDefinition?"+query, nil))
+		var bundle struct {
+			Total int `json:"total"`
+		}
+		_ = json.Unmarshal(rw.Body.Bytes(), &bundle)
+		return rw.Code, bundle.Total
+	}
+	for query, want := range map[string]int{
+		"type=Patient":            1,
+		"type=Observation":        0,
+		"name=datastandardswales": 1,
+		"url=https://fhir.nhs.wales/StructureDefinition/DataStandardsWales-Patient": 1,
+		"url=https://fhir.nhs.wales/StructureDefinition/DataStandardsWales":         0,
+	} {
+		if code, total := search(query); code != http.StatusOK || total != want {
+			t.Errorf("Search %s: expected %d matches, got %d (status %d)", query, want, total, code)
+		}
+	}
+	if code, _ := search("publisher=NHS"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unsupported parameter, got %d", code)
+	}
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/fhir/StructureDefinition/missing", nil))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown profile, got %d", rw.Code)
+	}
+}
+
+func TestConformanceHandler_ForwardsWrites(t *testing.T) {
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Method + " " + r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	proxy := &Proxy{Forwarder: forward.New(time.Second, target), Prefix: "/fhir"}
+	mux := http.NewServeMux()
+	mux.Handle("/fhir/", proxy)
+	mux.Handle("/fhir/ValueSet/", ConformanceHandler("/fhir", proxy))
+
+	req := httptest.NewRequest(http.MethodPut, "/fhir/ValueSet/vs1", strings.NewReader(`{"resourceType": "ValueSet", "id": "vs1", "status": "active"}`))
+	rw := httptest.NewRecorder()
+	mux.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK || forwarded != "PUT /ValueSet/vs1" {
+		t.Errorf("Expected the ValueSet to be forwarded, got %d and %q", rw.Code, forwarded)
+	}
+}
+
+func TestProxy_BodyTooLarge(t *testing.T) {
+	defer func(n int64) { MaxBodyBytes = n }(MaxBodyBytes)
+	MaxBodyBytes = 16
+
+	req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(`{"resourceType": "Observation"}`))
+	rw := httptest.NewRecorder()
+	(&Proxy{}).ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected 413, got %d", rw.Code)
+	}
+}
+
+func TestProxy_EchoesWithoutUpstream(t *testing.T) {
+	body := `{"resourceType": "Observation", "id": "obs1"}`
+	req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(body))
+	rw := httptest.NewRecorder()
+	(&Proxy{}).ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK, got %d", rw.Code)
+	}
+	if rw.Body.String() != body {
+		t.Errorf("Expected echoed body %q, got %q", body, rw.Body.String())
+	}
+}
+
+func TestSpool_SpillsToDisk(t *testing.T) {
+	s := &spool{}
+	data := strings.Repeat("x", spoolMemoryLimit+10)
+	if _, err := io.Copy(s, strings.NewReader(data)); err != nil {
+		t.Fatalf("Failed to write spool: %v", err)
+	}
+	if s.file == nil {
+		t.Fatalf("Expected spool to spill to a temporary file")
+	}
+	r, err := s.Reader()
+	if err != nil {
+		t.Fatalf("Failed to read spool: %v", err)
+	}
+	got, _ := io.ReadAll(r)
+	if string(got) != data || s.Size() != int64(len(data)) {
+		t.Errorf("Spool returned %d bytes, want %d", len(got), len(data))
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Failed to close spool: %v", err)
+	}
+}
+
+func TestProxy_RespondAsync(t *testing.T) {
+	manager := jobs.NewManager(jobs.NewMemoryStore())
+	proxy := &Proxy{Jobs: manager}
+
+	body := `{"resourceType": "Observation", "id": "obs1"}`
+	req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(body))
+	req.Header.Set("Prefer", "respond-async")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202 Accepted, got %d", rw.Code)
+	}
+	location := rw.Header().Get("Content-Location")
+	if !strings.HasPrefix(location, "http://example.com"+AsyncStatusPath) {
+		t.Fatalf("Unexpected Content-Location %q", location)
+	}
+
+	manager.Wait()
+	status := AsyncStatusHandler(manager)
+	poll := httptest.NewRequest(http.MethodGet, strings.TrimPrefix(location, "http://example.com"), nil)
+	rw = httptest.NewRecorder()
+	status.ServeHTTP(rw, poll)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK from completed job, got %d", rw.Code)
+	}
+	if rw.Body.String() != body {
+		t.Errorf("Expected job response %q, got %q", body, rw.Body.String())
+	}
+
+	// Jobs are not found by other clients
+	other := poll.WithContext(auth.NewContext(poll.Context(), &auth.Identity{ClientID: "partner-b"}))
+	rw = httptest.NewRecorder()
+	status.ServeHTTP(rw, other)
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another client's job, got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	status.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, AsyncStatusPath+"unknown", nil))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown job, got %d", rw.Code)
+	}
+
+	// Jobs interrupted by a restart fail rather than stay in progress
+	store := jobs.NewMemoryStore()
+	_ = store.Put(&jobs.Job{ID: "interrupted", Status: jobs.StatusFailed, Created: time.Now()})
+	rw = httptest.NewRecorder()
+	AsyncStatusHandler(jobs.NewManager(store)).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, AsyncStatusPath+"interrupted", nil))
+	if rw.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 for a failed job, got %d", rw.Code)
+	}
+}
+
+func TestBulkImport_ForwardsValidLines(t *testing.T) {
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		forwarded = string(b)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	handler := &BulkImport{Forwarder: forward.New(0, target)}
+
+	body := "{\"resourceType\": \"Observation\", \"id\": \"obs1\"}\n{\"id\": \"bad\"}\n"
+	req := httptest.NewRequest(http.MethodPost, "/$import-preflight", strings.NewReader(body))
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK, got %d", rw.Code)
+	}
+	if forwarded != "{\"resourceType\": \"Observation\", \"id\": \"obs1\"}\n" {
+		t.Errorf("Unexpected forwarded NDJSON %q", forwarded)
+	}
+
+	lines := strings.Split(strings.TrimSpace(rw.Body.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 2 outcomes and a summary, got %d lines", len(lines))
+	}
+	var summary map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[2]), &summary); err != nil {
+		t.Fatalf("Failed to decode summary: %v", err)
+	}
+	if summary["resourceType"] != "Parameters" || !strings.Contains(lines[2], `"importStatus","valueInteger":202`) {
+		t.Errorf("Unexpected summary %s", lines[2])
+	}
+}
+
+func TestBulkImport_TimesOut(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	target, _ := url.Parse(upstream.URL)
+	handler := &BulkImport{Forwarder: forward.New(20*time.Millisecond, target)}
+	req := httptest.NewRequest(http.MethodPost, "/$import-preflight", strings.NewReader("{\"resourceType\": \"Observation\"}\n"))
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	if !strings.Contains(rw.Body.String(), `"importError","valueString":"Failed to forward to FHIR server"`) {
+		t.Errorf("Expected an import error once the upstream timed out, got %s", rw.Body.String())
+	}
+}
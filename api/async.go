@@ -0,0 +1,236 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"fhir-validation-proxy/internal/audit"
+	"fhir-validation-proxy/internal/auth"
+	"fhir-validation-proxy/internal/jobs"
+	"fhir-validation-proxy/internal/logging"
+	"fhir-validation-proxy/internal/metrics"
+	"fhir-validation-proxy/internal/trace"
+)
+
+// AsyncStatusPath is where the status of async jobs is served; the job id
+// follows it.
+const AsyncStatusPath = "/_async/"
+
+// prefersAsync reports whether the client asked for FHIR asynchronous
+// request handling.
+func prefersAsync(r *http.Request) bool {
+	for _, v := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(v, ",") {
+			if strings.TrimSpace(pref) == "respond-async" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removePreference deletes one preference from the Prefer headers in h.
+func removePreference(h http.Header, name string) {
+	var kept []string
+	for _, v := range h.Values("Prefer") {
+		for _, pref := range strings.Split(v, ",") {
+			if pref = strings.TrimSpace(pref); pref != "" && pref != name {
+				kept = append(kept, pref)
+			}
+		}
+	}
+	h.Del("Prefer")
+	if len(kept) > 0 {
+		h.Set("Prefer", strings.Join(kept, ", "))
+	}
+}
+
+// serveAsync reads the request body, then validates and forwards it in the
+// background. The client is given a status URL to poll for the result.
+func (p *Proxy) serveAsync(w http.ResponseWriter, r *http.Request) {
+	body := &spool{}
+	rec := audit.FromContext(r.Context())
+	if _, err := io.Copy(io.MultiWriter(body, rec.PayloadWriter()), http.MaxBytesReader(w, r.Body, MaxBodyBytes)); err != nil {
+		closeSpool(body)
+		noteVerdict(r.Context(), "", audit.VerdictMalformed, 0, 0)
+		writeBodyError(w, err)
+		return
+	}
+
+	// The job outlives r, so it forwards a copy. The proxy answers
+	// asynchronously itself; the upstream is asked for a normal response.
+	// The job's outcome is audited in a record of its own.
+	jobRec := rec.Fork()
+	ctx := logging.WithRequestID(context.Background(), logging.RequestID(r.Context()))
+	ctx = auth.NewContext(ctx, auth.FromContext(r.Context()))
+	ctx = trace.NewContext(ctx, trace.FromContext(r.Context()))
+	out := r.Clone(audit.NewContext(ctx, jobRec))
+	removePreference(out.Header, "respond-async")
+
+	job, err := p.Jobs.Start(auth.ClientID(r.Context()), func(ctx context.Context) *jobs.Response {
+		ctx = trace.NewContext(ctx, trace.FromContext(out.Context()))
+		defer closeSpool(body)
+		buf := newResponseBuffer()
+		defer func() {
+			status := buf.response().StatusCode
+			slog.InfoContext(out.Context(), "Async job finished", "job", jobs.ID(ctx), "status", status)
+			if jobRec != nil {
+				jobRec.JobID = jobs.ID(ctx)
+				jobRec.Status = status
+				jobRec.Log()
+			}
+		}()
+
+		reader, err := body.Reader()
+		if err != nil {
+			writeOperationOutcome(buf, http.StatusInternalServerError, "Failed to read request body")
+			return buf.response()
+		}
+		start := time.Now()
+		result, err := rulesFor(out.Context()).ValidateStreamContext(out.Context(), reader)
+		if err != nil {
+			metrics.ValidationDuration.Observe(metrics.Since(start), audit.VerdictMalformed)
+			noteVerdict(out.Context(), "", audit.VerdictMalformed, 0, 0)
+			writeBodyError(buf, err)
+			return buf.response()
+		}
+		metrics.ValidationDuration.Observe(metrics.Since(start), verdictOf(result))
+		noteResult(out.Context(), result)
+		if p.Shadow != nil {
+			p.Shadow.compare(out.Context(), out.Method, out.URL.Path, body, result)
+		}
+		p.respond(ctx, buf, out, result, body)
+		return buf.response()
+	})
+	if err != nil {
+		closeSpool(body)
+		slog.ErrorContext(r.Context(), "Failed to start async job", "error", err)
+		writeOperationOutcome(w, http.StatusInternalServerError, "Failed to start async job")
+		return
+	}
+
+	if rec != nil {
+		rec.JobID = job.ID
+	}
+	w.Header().Set("Content-Location", requestBaseURL(r)+AsyncStatusPath+job.ID)
+	writeJSON(w, http.StatusAccepted, informationOutcome("Request accepted for asynchronous processing"))
+}
+
+// AsyncStatusHandler serves async job status at AsyncStatusPath{id}. GET
+// returns 202 while the job runs and then its final response, or a 500
+// OperationOutcome if the job failed; DELETE cancels the job. When clients
+// are identified, a job is only found by the client that started it and by
+// admins.
+func AsyncStatusHandler(m *jobs.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		job, err := m.Get(strings.TrimPrefix(r.URL.Path, AsyncStatusPath))
+		if err == nil {
+			if client := auth.FromContext(r.Context()); client != nil && client.ClientID != job.Client && !client.IsAdmin() {
+				err = jobs.ErrNotFound
+			}
+		}
+		if err != nil {
+			writeJobError(w, err)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			if job.Status == jobs.StatusFailed {
+				writeOperationOutcome(w, http.StatusInternalServerError, "Async job failed: the proxy restarted before it completed")
+				return
+			}
+			if job.Status != jobs.StatusComplete || job.Response == nil {
+				w.Header().Set("X-Progress", string(job.Status))
+				w.Header().Set("Retry-After", "5")
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
+			for k, v := range job.Response.Header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(job.Response.StatusCode)
+			if _, err := w.Write(job.Response.Body); err != nil {
+				slog.WarnContext(r.Context(), "Failed to write job response", "error", err)
+			}
+		case http.MethodDelete:
+			if err := m.Cancel(job.ID); err != nil {
+				writeJobError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			writeOperationOutcome(w, http.StatusMethodNotAllowed, "Only GET and DELETE allowed")
+		}
+	})
+}
+
+func writeJobError(w http.ResponseWriter, err error) {
+	if errors.Is(err, jobs.ErrNotFound) {
+		writeOperationOutcome(w, http.StatusNotFound, "Unknown async job")
+		return
+	}
+	slog.Error("Failed to read async job", "error", err)
+	writeOperationOutcome(w, http.StatusInternalServerError, "Failed to read async job")
+}
+
+// requestBaseURL returns the scheme and host the client used to reach us.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func informationOutcome(message string) map[string]interface{} {
+	return map[string]interface{}{
+		"resourceType": "OperationOutcome",
+		"issue": []map[string]interface{}{{
+			"severity":    "information",
+			"code":        "informational",
+			"diagnostics": message,
+		}},
+	}
+}
+
+// responseBuffer is an http.ResponseWriter that captures a response so it
+// can be stored with an async job.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: http.Header{}}
+}
+
+func (b *responseBuffer) Header() http.Header { return b.header }
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *responseBuffer) response() *jobs.Response {
+	status := b.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return &jobs.Response{StatusCode: status, Header: b.header, Body: b.body.Bytes()}
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net/http"
+
+	"fhir-validation-proxy/internal/audit"
+	"fhir-validation-proxy/internal/logging"
+)
+
+// Audit logs an audit record of every request to next with l. It wraps the
+// authentication handler, so refused requests are recorded too. With a nil
+// Logger, next is returned unchanged.
+func Audit(l *audit.Logger, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := l.NewRecord()
+		rec.Method, rec.Path, rec.RemoteAddr = r.Method, r.URL.Path, r.RemoteAddr
+		rec.RequestID = logging.RequestID(r.Context())
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(audit.NewContext(r.Context(), rec)))
+		rec.Status = sw.status
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		rec.Log()
+	})
+}
+
+// statusWriter records the status of the response it writes.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush lets relayed upstream responses stream through.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
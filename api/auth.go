@@ -0,0 +1,226 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fhir-validation-proxy/internal/auth"
+	"fhir-validation-proxy/internal/validator"
+)
+
+// Authenticator identifies the client of each request, by its verified TLS
+// client certificate or its bearer token, and applies the client's rate
+// limit. The identity is put in the request context for authorisation,
+// rules and audit.
+type Authenticator struct {
+	// Verifier checks bearer tokens; nil if tokens are not accepted.
+	Verifier *auth.Verifier
+	// Clients maps certificates to clients and holds per-client tenants
+	// and rate limits.
+	Clients *auth.Clients
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// RequireAuth lets through requests with a bearer token v verifies, with the
+// token's identity in the request context, and answers the rest with 401.
+func RequireAuth(v *auth.Verifier, next http.Handler) http.Handler {
+	return (&Authenticator{Verifier: v}).Wrap(next)
+}
+
+// Wrap lets through requests from identified clients within their rate
+// limit. Requests already carrying an identity are only rate limited.
+//
+// A verified client certificate identifies the client if it belongs to a
+// known client, and is refused with 403 otherwise. Without one, the bearer
+// token must verify, or the request gets 401.
+func (a *Authenticator) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := auth.FromContext(r.Context())
+		if id == nil {
+			var refusal *authRefusal
+			if id, refusal = a.identify(r); refusal != nil {
+				if refusal.challenge != "" {
+					w.Header().Set("WWW-Authenticate", refusal.challenge)
+				}
+				writeIssue(w, refusal.status, refusal.code, refusal.message)
+				return
+			}
+			r = r.WithContext(auth.NewContext(r.Context(), id))
+		}
+		noteIdentity(r.Context(), id)
+		if wait := a.throttle(id.ClientID); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeIssue(w, http.StatusTooManyRequests, "throttled", "Rate limit exceeded for client "+id.ClientID)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Admin is Wrap for the proxy's admin endpoints: clients without
+// auth.AdminScope are also refused, with 403.
+func (a *Authenticator) Admin(next http.Handler) http.Handler {
+	return a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := auth.FromContext(r.Context()); !id.IsAdmin() {
+			writeIssue(w, http.StatusForbidden, "forbidden", "Client "+id.ClientID+" is not an admin")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// authRefusal describes why a request's client could not be identified.
+type authRefusal struct {
+	status  int
+	code    string
+	message string
+	// challenge is the WWW-Authenticate header for a 401.
+	challenge string
+}
+
+const bearerChallenge = `Bearer realm="fhir-validation-proxy"`
+
+// identify returns the identity of r's client, or why it is refused.
+func (a *Authenticator) identify(r *http.Request) (*auth.Identity, *authRefusal) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		if id := a.Clients.ForCertificate(cert); id != nil {
+			return id, nil
+		}
+		slog.WarnContext(r.Context(), "Rejected unknown client certificate", "subject", cert.Subject.String(), "remoteAddr", r.RemoteAddr)
+		return nil, &authRefusal{status: http.StatusForbidden, code: "forbidden", message: "Client certificate is not registered"}
+	}
+
+	if a.Verifier == nil {
+		return nil, &authRefusal{status: http.StatusUnauthorized, code: "login", message: "Client certificate required"}
+	}
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return nil, &authRefusal{status: http.StatusUnauthorized, code: "login", message: "Bearer token required", challenge: bearerChallenge}
+	}
+	id, err := a.Verifier.Verify(strings.TrimSpace(token))
+	if err != nil {
+		slog.WarnContext(r.Context(), "Rejected bearer token", "remoteAddr", r.RemoteAddr, "error", err)
+		return nil, &authRefusal{
+			status:    http.StatusUnauthorized,
+			code:      "login",
+			message:   "Invalid bearer token",
+			challenge: bearerChallenge + `, error="invalid_token"`,
+		}
+	}
+	a.Clients.Apply(id)
+	return id, nil
+}
+
+// bucket is a token bucket rate limiting one client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// throttle takes a token from the client's bucket and returns zero, or how
+// long until one is available if the bucket is empty.
+func (a *Authenticator) throttle(clientID string) time.Duration {
+	client := a.Clients.Get(clientID)
+	if client == nil || client.RateLimit <= 0 {
+		return 0
+	}
+	burst := float64(client.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(client.RateLimit))
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if a.buckets == nil {
+		a.buckets = map[string]*bucket{}
+	}
+	b, ok := a.buckets[clientID]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		a.buckets[clientID] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*client.RateLimit)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / client.RateLimit * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// TenantRules holds the rule set of each tenant. Clients of a tenant with
+// no rule set here are validated against the active rules.
+var TenantRules = map[string]*validator.RuleSet{}
+
+// rulesFor returns the rule set that applies to requests from the client
+// identified in ctx: its tenant's, or the active one, for that client.
+func rulesFor(ctx context.Context) *validator.RuleSet {
+	id := auth.FromContext(ctx)
+	if id == nil {
+		return validator.ForClient("")
+	}
+	if rs, ok := TenantRules[id.Tenant]; ok && id.Tenant != "" {
+		return rs.ForClient(id.ClientID)
+	}
+	return validator.ForClient(id.ClientID)
+}
+
+// forbidden returns why the client identified in r's context may not do
+// what r asks of the upstream server with the validated resource, or "" if
+// it may. Without an identity, authorisation is not enforced.
+//
+// The resource type comes from the request path, or else from the resource;
+// each entry of a transaction or batch bundle posted to the base is checked
+// on its own.
+func forbidden(r *http.Request, path string, result validator.ValidationResult) string {
+	id := auth.FromContext(r.Context())
+	if id == nil {
+		return ""
+	}
+	path = strings.Trim(path, "/")
+
+	if path == "" && result.ResourceType == "Bundle" && len(result.Entries) > 0 {
+		for i, e := range result.Entries {
+			rt := auth.ResourceType(e.URL)
+			if rt == "" {
+				rt = e.ResourceType
+			}
+			interaction := auth.Interaction(e.Method, e.URL)
+			if rt == "" || interaction == "" {
+				return fmt.Sprintf("Bundle.entry[%d] has no request the proxy can authorise", i)
+			}
+			if !id.Allows(rt, interaction) {
+				return fmt.Sprintf("Client %s may not %s %s (Bundle.entry[%d])", id.ClientID, interaction, rt, i)
+			}
+		}
+		return ""
+	}
+
+	rt := auth.ResourceType(path)
+	if rt == "" {
+		rt = result.ResourceType
+	}
+	interaction := auth.Interaction(r.Method, path)
+	if rt == "" || interaction == "" || !id.Allows(rt, interaction) {
+		return fmt.Sprintf("Client %s may not %s %s", id.ClientID, interaction, rt)
+	}
+	return ""
+}
+
+// writeIssue writes an OperationOutcome with one error issue of type code.
+func writeIssue(w http.ResponseWriter, status int, code, message string) {
+	outcome := errorOutcome(message)
+	outcome["issue"].([]map[string]interface{})[0]["code"] = code
+	writeJSON(w, status, outcome)
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"fhir-validation-proxy/internal/audit"
+	"fhir-validation-proxy/internal/auth"
+	"fhir-validation-proxy/internal/bulk"
+	"fhir-validation-proxy/internal/forward"
+	"fhir-validation-proxy/internal/logging"
+)
+
+// BulkImport validates FHIR Bulk Data NDJSON as a pre-flight for $import.
+// The response is NDJSON: an OperationOutcome per line, with id "line-N",
+// followed by a Parameters resource with id "summary". Valid lines are
+// forwarded when Forwarder is set.
+type BulkImport struct {
+	// Forwarder sends the valid lines to the import URL as an
+	// application/fhir+ndjson POST.
+	Forwarder *forward.Forwarder
+}
+
+// ServeHTTP validates the NDJSON request body. The optional _type query
+// parameter restricts every line to one resourceType.
+func (b *BulkImport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOperationOutcome(w, http.StatusMethodNotAllowed, "Only POST allowed")
+		return
+	}
+
+	// Forwarding creates resources of the _type given, or of any type
+	if id := auth.FromContext(r.Context()); id != nil && b.Forwarder != nil {
+		rt := r.URL.Query().Get("_type")
+		if rt == "" {
+			rt = "*"
+		}
+		if !id.Allows(rt, auth.InteractionCreate) {
+			writeIssue(w, http.StatusForbidden, "forbidden", "Client "+id.ClientID+" may not import "+rt)
+			return
+		}
+	}
+
+	valid := &spool{}
+	defer closeSpool(valid)
+
+	w.Header().Set("Content-Type", "application/fhir+ndjson")
+	enc := json.NewEncoder(w)
+	rec := audit.FromContext(r.Context())
+	body := io.TeeReader(http.MaxBytesReader(w, r.Body, MaxBodyBytes), rec.PayloadWriter())
+
+	summary, err := bulk.Validate(body, w, bulk.Options{
+		ResourceType: r.URL.Query().Get("_type"),
+		Valid:        valid,
+	})
+	verdict := audit.VerdictValid
+	switch {
+	case err != nil:
+		verdict = audit.VerdictMalformed
+	case summary.Invalid > 0:
+		verdict = audit.VerdictInvalid
+	}
+	noteVerdict(r.Context(), r.URL.Query().Get("_type"), verdict, summary.Issues, summary.Errors)
+	params := summary.Parameters()
+	if err != nil {
+		// Outcomes may already have been sent, so the error is reported
+		// in-band and nothing is forwarded.
+		slog.WarnContext(r.Context(), "Failed to validate NDJSON", "error", err)
+		message := "Failed to read request body"
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			message = "Request body too large"
+		}
+		writeNDJSON(enc, errorOutcome(message))
+		writeNDJSON(enc, params)
+		return
+	}
+
+	if b.Forwarder != nil && summary.Valid > 0 {
+		addParameters(params, b.forward(r, valid)...)
+	}
+	writeNDJSON(enc, params)
+}
+
+// forward posts the valid lines to the import URL and describes the result
+// as summary parameters. Only the content type and request ID of the
+// client's request are sent.
+func (b *BulkImport) forward(r *http.Request, valid *spool) []map[string]interface{} {
+	in, err := http.NewRequestWithContext(r.Context(), http.MethodPost, "/", nil)
+	if err != nil {
+		return []map[string]interface{}{{"name": "importError", "valueString": err.Error()}}
+	}
+	in.Header.Set("Content-Type", "application/fhir+ndjson")
+	if id := logging.RequestID(r.Context()); id != "" {
+		in.Header.Set(logging.RequestIDHeader, id)
+	}
+	in.RemoteAddr, in.Host = r.RemoteAddr, r.Host
+
+	resp, err := b.Forwarder.Do(r.Context(), in, "", valid.Reader, valid.Size())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to forward NDJSON import", "error", err)
+		return []map[string]interface{}{{"name": "importError", "valueString": "Failed to forward to FHIR server"}}
+	}
+	defer func() {
+		if cerr := resp.Body.Close(); cerr != nil {
+			slog.WarnContext(r.Context(), "Failed to close import response body", "error", cerr)
+		}
+	}()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		slog.WarnContext(r.Context(), "Failed to read import response body", "error", err)
+	}
+
+	if rec := audit.FromContext(r.Context()); rec != nil {
+		rec.UpstreamStatus = resp.StatusCode
+	}
+	params := []map[string]interface{}{{"name": "importStatus", "valueInteger": resp.StatusCode}}
+	if loc := resp.Header.Get("Content-Location"); loc != "" {
+		params = append(params, map[string]interface{}{"name": "importLocation", "valueUri": loc})
+	}
+	return params
+}
+
+func addParameters(resource map[string]interface{}, params ...map[string]interface{}) {
+	resource["parameter"] = append(resource["parameter"].([]map[string]interface{}), params...)
+}
+
+func errorOutcome(message string) map[string]interface{} {
+	return map[string]interface{}{
+		"resourceType": "OperationOutcome",
+		"issue": []map[string]interface{}{{
+			"severity":    "error",
+			"code":        "invalid",
+			"diagnostics": message,
+		}},
+	}
+}
+
+func writeNDJSON(enc *json.Encoder, v interface{}) {
+	if err := enc.Encode(v); err != nil {
+		slog.Warn("Failed to write NDJSON response", "error", err)
+	}
+}
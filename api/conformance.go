@@ -0,0 +1,137 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"fhir-validation-proxy/internal/validator"
+)
+
+// ConformanceTypes are the conformance resource types served by
+// ConformanceHandler.
+var ConformanceTypes = []string{"StructureDefinition", "ValueSet", "CodeSystem"}
+
+// ConformanceHandler serves the profiles, ValueSets and CodeSystems the
+// proxy enforces, as they were loaded, at GET {prefix}/{type}/{id} and
+// searched at GET {prefix}/{type} by url (optionally url|version), version,
+// name, _id and, for StructureDefinitions, type. Other methods are passed to
+// next, such as the proxy that serves the rest of prefix, or refused if it
+// is nil.
+func ConformanceHandler(prefix string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			if next != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			writeOperationOutcome(w, http.StatusMethodNotAllowed, "Only GET allowed")
+			return
+		}
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		resourceType, id, _ := strings.Cut(path, "/")
+		resources, ok := validator.ConformanceResources(resourceType)
+		if !ok || strings.Contains(id, "/") {
+			writeOperationOutcome(w, http.StatusNotFound, "Unknown conformance resource path")
+			return
+		}
+
+		if id != "" {
+			for _, c := range resources {
+				if c.ID == id {
+					writeRawResource(w, c.Raw)
+					return
+				}
+			}
+			writeOperationOutcome(w, http.StatusNotFound, "Unknown "+resourceType+"/"+id)
+			return
+		}
+
+		query := r.URL.Query()
+		for name := range query {
+			if !conformanceSearchParam(resourceType, name) {
+				writeOperationOutcome(w, http.StatusBadRequest, "Unsupported search parameter "+name)
+				return
+			}
+		}
+		base := requestBaseURL(r) + prefix + "/" + resourceType + "/"
+		entries := []interface{}{}
+		for _, c := range resources {
+			if !matchesConformance(c, query) {
+				continue
+			}
+			fullURL := c.URL
+			if c.ID != "" {
+				fullURL = base + c.ID
+			}
+			entries = append(entries, map[string]interface{}{
+				"fullUrl":  fullURL,
+				"resource": c.Raw,
+				"search":   map[string]interface{}{"mode": "match"},
+			})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"resourceType": "Bundle",
+			"type":         "searchset",
+			"total":        len(entries),
+			"entry":        entries,
+		})
+	})
+}
+
+func conformanceSearchParam(resourceType, name string) bool {
+	switch name {
+	case "url", "version", "name", "_id":
+		return true
+	case "type":
+		return resourceType == "StructureDefinition"
+	}
+	return false
+}
+
+// matchesConformance reports whether c matches every search parameter in
+// query. url, version, _id and type match exactly, and url|version matches
+// both; name matches case-insensitively from the start, as FHIR string
+// parameters do. Comma-separated values match any of them.
+func matchesConformance(c validator.Conformance, query map[string][]string) bool {
+	for name, values := range query {
+		var field string
+		exact := true
+		switch name {
+		case "url":
+			field = c.URL
+		case "version":
+			field = c.Version
+		case "_id":
+			field = c.ID
+		case "type":
+			field = c.Type
+		case "name":
+			field, exact = strings.ToLower(c.Name), false
+		}
+		for _, value := range values {
+			matched := false
+			for _, v := range strings.Split(value, ",") {
+				got := field
+				if name == "url" && strings.Contains(v, "|") {
+					got = validator.Canonical(c.URL, c.Version)
+				}
+				if exact && got == v || !exact && strings.HasPrefix(got, strings.ToLower(v)) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// writeRawResource writes a resource exactly as it was loaded.
+func writeRawResource(w http.ResponseWriter, raw json.RawMessage) {
+	w.Header().Set("Content-Type", "application/fhir+json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(raw)
+}
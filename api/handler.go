@@ -2,11 +2,18 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fhir-validation-proxy/internal/audit"
+	"fhir-validation-proxy/internal/metrics"
 	"fhir-validation-proxy/internal/validator"
 	"io"
 	"net/http"
+	"time"
 )
 
+// MaxBodyBytes limits the size of request bodies accepted for validation.
+var MaxBodyBytes int64 = 256 << 20
+
 // ValidateHandler handles FHIR resource validation requests.
 func ValidateHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -14,21 +21,11 @@ func ValidateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		writeOperationOutcome(w, http.StatusBadRequest, "Failed to read request body")
+	result, ok := validateBody(w, r, nil)
+	if !ok {
 		return
 	}
 
-	var resource map[string]interface{}
-	err = json.Unmarshal(body, &resource)
-	if err != nil {
-		writeOperationOutcome(w, http.StatusBadRequest, "Invalid JSON")
-		return
-	}
-
-	result := validator.Validate(resource)
-
 	w.Header().Set("Content-Type", "application/fhir+json")
 	if result.Valid {
 		w.WriteHeader(http.StatusOK)
@@ -63,17 +60,42 @@ func ValidateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func writeOperationOutcome(w http.ResponseWriter, status int, message string) {
-	w.Header().Set("Content-Type", "application/fhir+json")
-	w.WriteHeader(status)
-	if err := json.NewEncoder(w).Encode(map[string]interface{}{
-		"resourceType": "OperationOutcome",
-		"issue": []map[string]interface{}{{
-			"severity":    "error",
-			"code":        "invalid",
-			"diagnostics": message,
-		}},
-	}); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+// validateBody streams the request body through the validator, copying it to
+// dst when dst is non-nil. If the body is too large or is not valid JSON it
+// writes an OperationOutcome and returns false.
+func validateBody(w http.ResponseWriter, r *http.Request, dst io.Writer) (validator.ValidationResult, bool) {
+	var body io.Reader = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+	if dst != nil {
+		body = io.TeeReader(body, dst)
+	}
+	if rec := audit.FromContext(r.Context()); rec != nil {
+		body = io.TeeReader(body, rec.PayloadWriter())
 	}
+
+	start := time.Now()
+	result, err := rulesFor(r.Context()).ValidateStreamContext(r.Context(), body)
+	if err != nil {
+		metrics.ValidationDuration.Observe(metrics.Since(start), audit.VerdictMalformed)
+		noteVerdict(r.Context(), "", audit.VerdictMalformed, 0, 0)
+		writeBodyError(w, err)
+		return result, false
+	}
+	metrics.ValidationDuration.Observe(metrics.Since(start), verdictOf(result))
+	noteResult(r.Context(), result)
+	return result, true
+}
+
+// writeBodyError writes the OperationOutcome for a body that could not be
+// read or decoded.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeOperationOutcome(w, http.StatusRequestEntityTooLarge, "Request body too large")
+	} else {
+		writeOperationOutcome(w, http.StatusBadRequest, "Invalid JSON")
+	}
+}
+
+func writeOperationOutcome(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorOutcome(message))
 }
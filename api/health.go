@@ -0,0 +1,101 @@
+package api
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"fhir-validation-proxy/internal/forward"
+	"fhir-validation-proxy/internal/validator"
+)
+
+// HealthHandler reports that the process is alive, for liveness probes.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeOperationOutcome(w, http.StatusMethodNotAllowed, "Only GET allowed")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readiness reports whether the proxy can take requests, for readiness
+// probes: it is not shutting down, the configuration loaded and, if there
+// is an upstream, some upstream's circuit breaker allows requests. It
+// answers 200 when ready and 503 when not, with the state of each check.
+// Checks only read local state, so probes are cheap and never reach the
+// upstream. Probes are not authenticated, so states never name upstreams.
+type Readiness struct {
+	Forwarder *forward.Forwarder
+	// Queued is set when requests the upstream cannot take are queued.
+	// The proxy then stays ready while every circuit breaker is open, as
+	// that is when the queue takes writes, and the upstream state is only
+	// reported by StatusHandler.
+	Queued bool
+
+	draining atomic.Bool
+}
+
+// Drain marks the proxy as shutting down, so it is never ready again.
+func (h *Readiness) Drain() {
+	h.draining.Store(true)
+}
+
+// ServeHTTP runs the checks and reports each one's result.
+func (h *Readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeOperationOutcome(w, http.StatusMethodNotAllowed, "Only GET allowed")
+		return
+	}
+	checks := map[string]string{"config": "ok"}
+	ready := true
+	fail := func(check, state string) {
+		checks[check] = state
+		ready = false
+	}
+	if h.draining.Load() {
+		fail("shutdown", "shutting down")
+	}
+	if validator.ConfigReady() != nil {
+		fail("config", "not loaded")
+	}
+	if h.Forwarder != nil && !h.Queued {
+		checks["upstream"] = upstreamState(h.Forwarder)
+		if checks["upstream"] != "ok" {
+			ready = false
+		}
+	}
+
+	if !ready {
+		writeAdminJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "not ready", "checks": checks})
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"status": "ready", "checks": checks})
+}
+
+// upstreamState returns "circuit open" if every upstream's circuit breaker
+// is open, and otherwise "ok".
+func upstreamState(f *forward.Forwarder) string {
+	if f.RetryAfter() > 0 {
+		return "circuit open"
+	}
+	return "ok"
+}
+
+// StatusHandler serves the active configuration as JSON: the loaded
+// profiles, the number of rules for each resource type, the recipes, and
+// the hash and load time of each configuration file; see validator.Status.
+// With an upstream, it also serves its state as Readiness reports it.
+// Upstreams are not listed, as the status is not authenticated; see
+// UpstreamStatusHandler.
+func StatusHandler(f *forward.Forwarder) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeOperationOutcome(w, http.StatusMethodNotAllowed, "Only GET allowed")
+			return
+		}
+		status := map[string]interface{}{"config": validator.Status()}
+		if f != nil {
+			status["upstream"] = upstreamState(f)
+		}
+		writeAdminJSON(w, http.StatusOK, status)
+	})
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"fhir-validation-proxy/internal/audit"
+	"fhir-validation-proxy/internal/auth"
+	"fhir-validation-proxy/internal/logging"
+	"fhir-validation-proxy/internal/metrics"
+	"fhir-validation-proxy/internal/validator"
+)
+
+// RequestLog gives every request an ID, logs one summary line for it once
+// it is handled and counts it in the request metrics. The client's
+// X-Request-ID is kept if it is usable; otherwise one is generated. The ID
+// is returned to the client, passed upstream, and logged with everything
+// logged for the request.
+func RequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(logging.RequestIDHeader)
+		if !logging.ValidRequestID(id) {
+			id = logging.NewRequestID()
+			r.Header.Set(logging.RequestIDHeader, id)
+		}
+		w.Header().Set(logging.RequestIDHeader, id)
+
+		summary := &requestSummary{}
+		ctx := logging.WithRequestID(context.WithValue(r.Context(), summaryKey{}, summary), id)
+		sw := &statusWriter{ResponseWriter: w}
+		req := r.WithContext(ctx)
+		next.ServeHTTP(sw, req)
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		metrics.Requests.Inc(route(req), r.Method, strconv.Itoa(status))
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelWarn
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("latencyMs", float64(time.Since(start).Microseconds())/1000),
+		}
+		if r.URL.RawQuery != "" {
+			attrs = append(attrs, logging.PHI("query", r.URL.RawQuery))
+		}
+		if summary.client != "" {
+			attrs = append(attrs, slog.String("client", summary.client))
+		}
+		if summary.verdict != "" {
+			attrs = append(attrs,
+				slog.String("resourceType", summary.resourceType),
+				slog.String("verdict", summary.verdict),
+				slog.Int("issues", summary.issues))
+		}
+		slog.LogAttrs(ctx, level, "Request handled", attrs...)
+	})
+}
+
+// route returns the metrics label for the route that handled r: the
+// ServeMux pattern it matched, or "none".
+func route(r *http.Request) string {
+	if r.Pattern == "" {
+		return "none"
+	}
+	return r.Pattern
+}
+
+// requestSummary is what the summary line of a request reports beyond the
+// request and response, filled in as the request is handled.
+type requestSummary struct {
+	client       string
+	resourceType string
+	verdict      string
+	issues       int
+}
+
+type summaryKey struct{}
+
+func summaryFrom(ctx context.Context) *requestSummary {
+	s, _ := ctx.Value(summaryKey{}).(*requestSummary)
+	return s
+}
+
+// noteIdentity records the client identified for the request in ctx, for
+// its summary line and audit record.
+func noteIdentity(ctx context.Context, id *auth.Identity) {
+	if id == nil {
+		return
+	}
+	if s := summaryFrom(ctx); s != nil {
+		s.client = id.ClientID
+	}
+	if rec := audit.FromContext(ctx); rec != nil {
+		rec.ClientID, rec.Subject, rec.Tenant, rec.AuthMethod = id.ClientID, id.Subject, id.Tenant, id.Method
+	}
+}
+
+// noteResult records the validation verdict for the request in ctx, and
+// counts its errors and bundle size in the metrics.
+func noteResult(ctx context.Context, result validator.ValidationResult) {
+	for _, issue := range result.Issues {
+		if issue.Severity == validator.SeverityError || issue.Severity == validator.SeverityFatal {
+			rule := issue.RuleID
+			if rule == "" {
+				rule = metrics.BuiltinRule
+			}
+			metrics.Rejections.Inc(result.ResourceType, rule)
+		}
+	}
+	if len(result.Entries) > 0 {
+		metrics.BundleEntries.Observe(float64(len(result.Entries)))
+	}
+	noteVerdict(ctx, result.ResourceType, verdictOf(result), len(result.Issues), len(result.Errors))
+}
+
+// verdictOf returns the verdict of a validation result.
+func verdictOf(result validator.ValidationResult) string {
+	if !result.Valid {
+		return audit.VerdictInvalid
+	}
+	return audit.VerdictValid
+}
+
+// noteVerdict records a validation verdict, with the number of issues and
+// of errors among them, for the request in ctx, for its summary line and
+// audit record.
+func noteVerdict(ctx context.Context, resourceType, verdict string, issues, errors int) {
+	if s := summaryFrom(ctx); s != nil {
+		s.resourceType, s.verdict, s.issues = resourceType, verdict, issues
+	}
+	if rec := audit.FromContext(ctx); rec != nil {
+		rec.ResourceType, rec.Verdict, rec.Errors = resourceType, verdict, errors
+	}
+}
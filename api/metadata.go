@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"fhir-validation-proxy/internal/capability"
+	"fhir-validation-proxy/internal/forward"
+	"fhir-validation-proxy/internal/validator"
+)
+
+// metadataCacheTTL is how long the upstream CapabilityStatement is reused.
+const metadataCacheTTL = 5 * time.Minute
+
+// metadataRetryInterval is how long after a failed fetch of the upstream
+// CapabilityStatement the next one is tried.
+const metadataRetryInterval = 30 * time.Second
+
+// Metadata serves the proxy's CapabilityStatement at GET /metadata, merged
+// with the upstream server's when there is one.
+type Metadata struct {
+	// Forwarder reaches the upstream server; nil for a proxy-only statement.
+	Forwarder *forward.Forwarder
+
+	mu       sync.Mutex
+	cached   []byte
+	fetched  time.Time
+	failed   time.Time
+	fetching bool
+}
+
+// ServeHTTP writes the CapabilityStatement. If the upstream statement cannot
+// be fetched, the proxy's own is served.
+func (m *Metadata) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeOperationOutcome(w, http.StatusMethodNotAllowed, "Only GET allowed")
+		return
+	}
+
+	var upstream map[string]interface{}
+	if raw := m.upstream(r.Context()); raw != nil {
+		if err := json.Unmarshal(raw, &upstream); err != nil {
+			slog.WarnContext(r.Context(), "Failed to parse upstream CapabilityStatement", "error", err)
+			upstream = nil
+		}
+	}
+	writeJSON(w, http.StatusOK, capability.Statement(upstream, time.Now()))
+}
+
+// upstream returns the upstream CapabilityStatement, or nil if there is no
+// upstream or it has never been fetched. A stale statement is refreshed by
+// one caller at a time; the others, and that caller if the refresh fails,
+// get the stale one. After a failure nothing is fetched for
+// metadataRetryInterval.
+func (m *Metadata) upstream(ctx context.Context) []byte {
+	if m.Forwarder == nil {
+		return nil
+	}
+	m.mu.Lock()
+	cached := m.cached
+	if m.fetching || cached != nil && time.Since(m.fetched) < metadataCacheTTL || time.Since(m.failed) < metadataRetryInterval {
+		m.mu.Unlock()
+		return cached
+	}
+	m.fetching = true
+	m.mu.Unlock()
+
+	raw := m.fetch(context.WithoutCancel(ctx))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fetching = false
+	if raw == nil {
+		m.failed = time.Now()
+		return m.cached
+	}
+	m.cached, m.fetched = raw, time.Now()
+	return raw
+}
+
+// fetch gets the upstream CapabilityStatement, or returns nil. The request
+// carries nothing of the client's, as the result is shared.
+func (m *Metadata) fetch(ctx context.Context) []byte {
+	in, err := http.NewRequestWithContext(ctx, http.MethodGet, "/metadata", nil)
+	if err != nil {
+		return nil
+	}
+	in.Header.Set("Accept", "application/fhir+json")
+	noBody := func() (io.Reader, error) { return http.NoBody, nil }
+	resp, err := m.Forwarder.Do(ctx, in, "/metadata", noBody, 0)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to fetch upstream CapabilityStatement", "error", err)
+		return nil
+	}
+	defer closeResponse(resp)
+	if resp.StatusCode != http.StatusOK {
+		slog.WarnContext(ctx, "Failed to fetch upstream CapabilityStatement", "status", resp.StatusCode)
+		return nil
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, MaxBodyBytes))
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to read upstream CapabilityStatement", "error", err)
+		return nil
+	}
+	return raw
+}
+
+// RulesHandler serves the active rules, recipes and rule IDs as JSON, for
+// client developers to see what the proxy enforces.
+func RulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeOperationOutcome(w, http.StatusMethodNotAllowed, "Only GET allowed")
+		return
+	}
+	rules, recipes := validator.ActiveRules()
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+		"rules":   rules,
+		"recipes": recipes,
+		"ruleIds": validator.RuleIDs(),
+	})
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"fhir-validation-proxy/internal/audit"
+	"fhir-validation-proxy/internal/forward"
+	"fhir-validation-proxy/internal/jsonpatch"
+	"fhir-validation-proxy/internal/metrics"
+	"fhir-validation-proxy/internal/validator"
+)
+
+// servePatch validates a JSON Patch by applying it to the current version
+// of the resource, fetched from upstream, and forwards the patch if the
+// result is valid. The PATCH carries the version that was validated in
+// If-Match, unless the client sent its own, so the upstream rejects it if
+// the resource has changed since.
+func (p *Proxy) servePatch(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, p.Prefix)
+	if reason := forbidden(r, path, validator.ValidationResult{}); reason != "" {
+		writeIssue(w, http.StatusForbidden, "forbidden", reason)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != jsonpatch.MediaType {
+		writeOperationOutcome(w, http.StatusUnsupportedMediaType, "Only JSON Patch ("+jsonpatch.MediaType+") can be validated")
+		return
+	}
+	if strings.Count(strings.Trim(path, "/"), "/") != 1 || r.URL.RawQuery != "" {
+		writeOperationOutcome(w, http.StatusNotImplemented, "Only a PATCH of a single resource by id can be validated")
+		return
+	}
+	if p.Forwarder == nil {
+		writeOperationOutcome(w, http.StatusNotImplemented, "No FHIR server configured")
+		return
+	}
+
+	body := &spool{}
+	defer closeSpool(body)
+	var reader io.Reader = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+	if rec := audit.FromContext(r.Context()); rec != nil {
+		reader = io.TeeReader(reader, rec.PayloadWriter())
+	}
+	if _, err := io.Copy(body, reader); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	patch, err := body.Reader()
+	if err != nil {
+		writeOperationOutcome(w, http.StatusInternalServerError, "Failed to read request body")
+		return
+	}
+	ops, err := jsonpatch.Decode(patch)
+	if err != nil {
+		writeOperationOutcome(w, http.StatusBadRequest, "Invalid JSON Patch")
+		return
+	}
+
+	current, etag, ok := p.current(w, r, path)
+	if !ok {
+		return
+	}
+	patched, err := jsonpatch.Apply(current, ops)
+	if err != nil {
+		writeIssue(w, http.StatusUnprocessableEntity, "processing", "Failed to apply patch: "+err.Error())
+		return
+	}
+	resource, ok := patched.(map[string]interface{})
+	if !ok {
+		writeIssue(w, http.StatusUnprocessableEntity, "processing", "The patched resource is not a JSON object")
+		return
+	}
+
+	start := time.Now()
+	result := rulesFor(r.Context()).ValidateContext(r.Context(), resource)
+	metrics.ValidationDuration.Observe(metrics.Since(start), verdictOf(result))
+	noteResult(r.Context(), result)
+	// The patch is forwarded as sent, so normalisation cannot correct it
+	result.Resource = nil
+
+	if etag != "" && r.Header.Get("If-Match") == "" {
+		r.Header.Set("If-Match", etag)
+	}
+	p.respond(r.Context(), w, r, result, body)
+}
+
+// current fetches the resource at path from upstream with the client's
+// credentials and returns it with its ETag. If the upstream does not
+// return it, its response, or an OperationOutcome, is written to w and
+// current returns false.
+func (p *Proxy) current(w http.ResponseWriter, r *http.Request, path string) (interface{}, string, bool) {
+	in := r.Clone(r.Context())
+	in.Method = http.MethodGet
+	in.Body = http.NoBody
+	in.ContentLength = 0
+	in.Header.Del("Content-Type")
+	in.Header.Del("If-Match")
+	in.Header.Set("Accept", "application/fhir+json")
+	noBody := func() (io.Reader, error) { return http.NoBody, nil }
+
+	resp, err := p.Forwarder.Do(r.Context(), in, path, noBody, 0)
+	if errors.Is(err, forward.ErrCircuitOpen) {
+		retryAfter := int(math.Ceil(p.Forwarder.RetryAfter().Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeOperationOutcome(w, http.StatusServiceUnavailable, "FHIR server unavailable: circuit breaker open")
+		return nil, "", false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to fetch the resource to patch", "error", err)
+		writeOperationOutcome(w, http.StatusBadGateway, "Failed to fetch the resource to patch from the FHIR server")
+		return nil, "", false
+	}
+	defer closeResponse(resp)
+	if resp.StatusCode != http.StatusOK {
+		if err := forward.CopyResponse(w, resp); err != nil {
+			slog.WarnContext(r.Context(), "Failed to copy proxy response body", "error", err)
+		}
+		return nil, "", false
+	}
+
+	var resource interface{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MaxBodyBytes)).Decode(&resource); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to decode the resource to patch", "error", err)
+		writeOperationOutcome(w, http.StatusBadGateway, "The FHIR server returned an invalid resource")
+		return nil, "", false
+	}
+	return resource, resp.Header.Get("ETag"), true
+}
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"fhir-validation-proxy/internal/audit"
+	"fhir-validation-proxy/internal/auth"
+	"fhir-validation-proxy/internal/forward"
+	"fhir-validation-proxy/internal/jobs"
+	"fhir-validation-proxy/internal/queue"
+	"fhir-validation-proxy/internal/validator"
+)
+
+// Proxy validates FHIR resources and forwards valid ones to an upstream FHIR
+// server. With no upstream configured, valid resources are echoed back.
+type Proxy struct {
+	// Forwarder sends valid resources upstream, keeping the request method,
+	// headers and query.
+	Forwarder *forward.Forwarder
+	// Prefix is the path the proxy is mounted at. The rest of the request
+	// path is appended to the upstream URL.
+	Prefix string
+	// Queue, if set, keeps valid requests the upstream did not accept
+	// because it was unreachable, to be delivered later by Deliver. While
+	// it holds entries, new requests are queued behind them.
+	Queue *queue.Queue
+	// Shadow, if set, also validates every request against a candidate
+	// rule set. Differences from the active verdict are logged; the
+	// candidate never affects the response.
+	Shadow *Shadow
+	// Jobs runs requests sent with "Prefer: respond-async". When nil, such
+	// requests are handled synchronously.
+	Jobs *jobs.Manager
+	// PassThrough also forwards GET, HEAD and DELETE requests, which carry
+	// no resource, without validation, and PATCH requests whose JSON Patch
+	// yields a valid resource. Otherwise only POST and PUT are accepted.
+	PassThrough bool
+}
+
+// ServeHTTP validates the request body and forwards it if it is valid.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost || r.Method == http.MethodPut:
+	case !p.PassThrough:
+		writeOperationOutcome(w, http.StatusMethodNotAllowed, "Only POST and PUT allowed")
+		return
+	case r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodDelete:
+		p.passThrough(w, r)
+		return
+	case r.Method == http.MethodPatch:
+		p.servePatch(w, r)
+		return
+	default:
+		writeOperationOutcome(w, http.StatusMethodNotAllowed, "Only GET, HEAD, POST, PUT, PATCH and DELETE allowed")
+		return
+	}
+
+	if p.Jobs != nil && prefersAsync(r) {
+		p.serveAsync(w, r)
+		return
+	}
+
+	body := &spool{}
+	defer closeSpool(body)
+
+	result, ok := validateBody(w, r, body)
+	if !ok {
+		return
+	}
+	if p.Shadow != nil {
+		// Runs beside forwarding and may outlive the request, so it holds
+		// its own share of the spool
+		p.Shadow.start(r.Context(), r.Method, r.URL.Path, body.share(), result)
+	}
+	p.respond(r.Context(), w, r, result, body)
+}
+
+// respond returns the validation outcome for an invalid resource, or
+// forwards a valid one upstream as described by r and relays the upstream
+// response. Dry runs only report what would happen.
+func (p *Proxy) respond(ctx context.Context, w http.ResponseWriter, r *http.Request, result validator.ValidationResult, body *spool) {
+	path := strings.TrimPrefix(r.URL.Path, p.Prefix)
+	rec := audit.FromContext(r.Context())
+	if rec != nil {
+		rec.Interaction = auth.Interaction(r.Method, strings.Trim(path, "/"))
+	}
+	if reason := forbidden(r, path, result); reason != "" {
+		writeIssue(w, http.StatusForbidden, "forbidden", reason)
+		return
+	}
+	if isDryRun(r) {
+		p.writeDryRun(w, r, result, path)
+		return
+	}
+	if !result.Valid {
+		writeJSON(w, http.StatusBadRequest, result.Outcome)
+		return
+	}
+
+	// Normalisation rules corrected the resource; forward the corrected one
+	if result.Resource != nil {
+		corrected := &spool{}
+		defer closeSpool(corrected)
+		if err := encodeResource(corrected, result.Resource); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to encode normalised resource", "error", err)
+			writeOperationOutcome(w, http.StatusInternalServerError, "Failed to encode normalised resource")
+			return
+		}
+		body = corrected
+	}
+
+	// If no FHIR server configured, echo back the valid resource
+	if p.Forwarder == nil {
+		reader, err := body.Reader()
+		if err != nil {
+			writeOperationOutcome(w, http.StatusInternalServerError, "Failed to read request body")
+			return
+		}
+		w.Header().Set("Content-Type", "application/fhir+json")
+		w.WriteHeader(http.StatusOK)
+		if _, err := io.Copy(w, reader); err != nil {
+			slog.WarnContext(r.Context(), "Failed to echo request body", "error", err)
+		}
+		return
+	}
+
+	p.forward(ctx, w, r, path, body, true)
+}
+
+// passThrough forwards a request that carries no resource, such as a read
+// or a delete, without validating it. Deletes are queued like writes.
+func (p *Proxy) passThrough(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, p.Prefix)
+	if rec := audit.FromContext(r.Context()); rec != nil {
+		rec.Interaction = auth.Interaction(r.Method, strings.Trim(path, "/"))
+	}
+	if reason := forbidden(r, path, validator.ValidationResult{}); reason != "" {
+		writeIssue(w, http.StatusForbidden, "forbidden", reason)
+		return
+	}
+	if p.Forwarder == nil {
+		writeOperationOutcome(w, http.StatusNotImplemented, "No FHIR server configured")
+		return
+	}
+	if isDryRun(r) {
+		p.writeDryRun(w, r, validator.NewResult(nil), path)
+		return
+	}
+	body := &spool{}
+	defer closeSpool(body)
+	p.forward(r.Context(), w, r, path, body, r.Method == http.MethodDelete)
+}
+
+// forward sends r, with body, upstream and relays the response. If
+// queueable is set and the proxy has a Queue, a request the upstream could
+// not accept is queued, as is every request while the queue holds entries.
+func (p *Proxy) forward(ctx context.Context, w http.ResponseWriter, r *http.Request, path string, body *spool, queueable bool) {
+	rec := audit.FromContext(r.Context())
+	useQueue := queueable && p.Queue != nil
+	if useQueue && p.Queue.Depth() > 0 {
+		if rec != nil {
+			rec.Queued = true
+		}
+		p.enqueue(w, r, path, body)
+		return
+	}
+	proxyResp, err := p.Forwarder.Do(ctx, r, path, body.Reader, body.Size())
+	if useQueue && forward.Undelivered(proxyResp, err) {
+		if proxyResp != nil {
+			closeResponse(proxyResp)
+		}
+		if rec != nil {
+			rec.Queued = true
+		}
+		p.enqueue(w, r, path, body)
+		return
+	}
+	if errors.Is(err, forward.ErrCircuitOpen) {
+		retryAfter := int(math.Ceil(p.Forwarder.RetryAfter().Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeOperationOutcome(w, http.StatusServiceUnavailable, "FHIR server unavailable: circuit breaker open")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to forward to FHIR server", "error", err)
+		writeOperationOutcome(w, http.StatusBadGateway, "Failed to forward to FHIR server")
+		return
+	}
+	if rec != nil {
+		rec.UpstreamStatus = proxyResp.StatusCode
+	}
+	defer func() {
+		if cerr := proxyResp.Body.Close(); cerr != nil {
+			slog.WarnContext(r.Context(), "Failed to close proxy response body", "error", cerr)
+		}
+	}()
+	if err := forward.CopyResponse(w, proxyResp); err != nil {
+		slog.WarnContext(r.Context(), "Failed to copy proxy response body", "error", err)
+	}
+}
+
+// encodeResource writes a resource as JSON with resourceType first, as FHIR
+// JSON recommends.
+func encodeResource(w io.Writer, resource map[string]interface{}) error {
+	rest := make(map[string]interface{}, len(resource))
+	for k, v := range resource {
+		if k != "resourceType" {
+			rest[k] = v
+		}
+	}
+	resourceType, err := json.Marshal(resource["resourceType"])
+	if err != nil {
+		return err
+	}
+	fields, err := json.Marshal(rest)
+	if err != nil {
+		return err
+	}
+
+	out := append([]byte(`{"resourceType":`), resourceType...)
+	if len(fields) > 2 {
+		out = append(out, ',')
+		out = append(out, fields[1:]...)
+	} else {
+		out = append(out, '}')
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+func closeSpool(body *spool) {
+	if err := body.Close(); err != nil {
+		slog.Warn("Failed to release request body", "error", err)
+	}
+}
+
+// writeJSON writes v as an application/fhir+json response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/fhir+json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Failed to encode response", "error", err)
+	}
+}
+
+// UpstreamStatusHandler serves the circuit breaker state of each upstream
+// as JSON, in failover order.
+func UpstreamStatusHandler(f *forward.Forwarder) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeOperationOutcome(w, http.StatusMethodNotAllowed, "Only GET allowed")
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"upstreams": f.Status()})
+	})
+}
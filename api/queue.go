@@ -0,0 +1,204 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"fhir-validation-proxy/internal/queue"
+)
+
+// QueuePath is where the store-and-forward queue is administered.
+const QueuePath = "/_queue"
+
+// credentialHeaders are never written to the queue. Credentials are often
+// short-lived, so a replayed request cannot rely on them anyway; it is sent
+// with the Forwarder's own Authorization, if any.
+var credentialHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// enqueue stores a valid request for later delivery and tells the client
+// it has been accepted.
+func (p *Proxy) enqueue(w http.ResponseWriter, r *http.Request, path string, body *spool) {
+	header := r.Header.Clone()
+	for _, name := range credentialHeaders {
+		header.Del(name)
+	}
+	reader, err := body.Reader()
+	if err == nil {
+		entry := &queue.Entry{
+			Method:     r.Method,
+			Path:       path,
+			Query:      r.URL.RawQuery,
+			Header:     header,
+			RemoteAddr: r.RemoteAddr,
+			Host:       r.Host,
+		}
+		if err = p.Queue.Enqueue(entry, reader); err == nil {
+			writeJSON(w, http.StatusAccepted, informationOutcome(fmt.Sprintf(
+				"FHIR server unavailable; request queued for delivery as entry %d", entry.Seq)))
+			return
+		}
+	}
+	slog.ErrorContext(r.Context(), "Failed to queue request", "error", err)
+	writeOperationOutcome(w, http.StatusServiceUnavailable, "FHIR server unavailable and the request could not be queued")
+}
+
+// Deliver sends a queued request upstream. It is the queue.Sender used to
+// replay the Queue.
+func (p *Proxy) Deliver(ctx context.Context, e *queue.Entry, body func() (io.Reader, error)) (int, error) {
+	if p.Forwarder == nil {
+		return 0, errors.New("no FHIR server configured")
+	}
+	in, err := http.NewRequestWithContext(ctx, e.Method, e.Path, nil)
+	if err != nil {
+		return 0, err
+	}
+	in.URL.RawQuery = e.Query
+	in.Header = e.Header.Clone()
+	if in.Header == nil {
+		in.Header = http.Header{}
+	}
+	in.RemoteAddr = e.RemoteAddr
+	in.Host = e.Host
+
+	resp, err := p.Forwarder.Do(ctx, in, e.Path, body, e.Size)
+	if err != nil {
+		return 0, err
+	}
+	closeResponse(resp)
+	return resp.StatusCode, nil
+}
+
+func closeResponse(resp *http.Response) {
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		slog.Warn("Failed to read upstream response body", "error", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		slog.Warn("Failed to close upstream response body", "error", err)
+	}
+}
+
+// QueueHandler serves the queue admin API below QueuePath:
+//
+//	GET    /_queue            depth, oldest entry and dead-letter count
+//	GET    /_queue/dead       dead-letter entries
+//	GET    /_queue/dead/{seq} a dead-letter entry and its resource
+//	POST   /_queue/dead/{seq} requeue a dead-letter entry at the tail
+//	DELETE /_queue/dead/{seq} discard a dead-letter entry
+func QueueHandler(q *queue.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, QueuePath), "/")
+		switch {
+		case rest == "" && r.Method == http.MethodGet:
+			serveQueueStatus(w, q)
+		case rest == "dead" && r.Method == http.MethodGet:
+			entries, err := q.DeadLetters()
+			if err != nil {
+				writeQueueError(w, err)
+				return
+			}
+			for i, e := range entries {
+				entries[i] = adminEntry(e)
+			}
+			writeAdminJSON(w, http.StatusOK, map[string]interface{}{"entries": entries})
+		case strings.HasPrefix(rest, "dead/"):
+			seq, err := strconv.ParseUint(strings.TrimPrefix(rest, "dead/"), 10, 64)
+			if err != nil {
+				writeOperationOutcome(w, http.StatusNotFound, "Unknown queue entry")
+				return
+			}
+			serveDeadLetter(w, r, q, seq)
+		default:
+			writeOperationOutcome(w, http.StatusNotFound, "Unknown queue resource")
+		}
+	})
+}
+
+func serveQueueStatus(w http.ResponseWriter, q *queue.Queue) {
+	oldest, err := q.Oldest()
+	if err != nil && !errors.Is(err, queue.ErrNotFound) {
+		writeQueueError(w, err)
+		return
+	}
+	dead, err := q.DeadLetters()
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	status := map[string]interface{}{"depth": q.Depth(), "deadLetters": len(dead)}
+	if oldest != nil {
+		status["oldest"] = adminEntry(oldest)
+	}
+	writeAdminJSON(w, http.StatusOK, status)
+}
+
+func serveDeadLetter(w http.ResponseWriter, r *http.Request, q *queue.Queue, seq uint64) {
+	switch r.Method {
+	case http.MethodGet:
+		entry, body, err := q.DeadLetter(seq)
+		if err != nil {
+			writeQueueError(w, err)
+			return
+		}
+		defer func() {
+			if cerr := body.Close(); cerr != nil {
+				slog.WarnContext(r.Context(), "Failed to close dead-letter body", "error", cerr)
+			}
+		}()
+		resource, err := io.ReadAll(body)
+		if err != nil {
+			writeQueueError(w, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+			"entry":    adminEntry(entry),
+			"resource": json.RawMessage(resource),
+		})
+	case http.MethodPost:
+		if err := q.Requeue(seq); err != nil {
+			writeQueueError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodDelete:
+		if err := q.Discard(seq); err != nil {
+			writeQueueError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeOperationOutcome(w, http.StatusMethodNotAllowed, "Only GET, POST and DELETE allowed")
+	}
+}
+
+// adminEntry returns a copy of e without its request headers, which are
+// not shown by the admin API.
+func adminEntry(e *queue.Entry) *queue.Entry {
+	c := *e
+	c.Header = nil
+	return &c
+}
+
+func writeQueueError(w http.ResponseWriter, err error) {
+	if errors.Is(err, queue.ErrNotFound) {
+		writeOperationOutcome(w, http.StatusNotFound, "Unknown queue entry")
+		return
+	}
+	slog.Error("Failed to read queue", "error", err)
+	writeOperationOutcome(w, http.StatusInternalServerError, "Failed to read queue")
+}
+
+// writeAdminJSON writes v as a plain JSON response for admin endpoints.
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Failed to encode response", "error", err)
+	}
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"fhir-validation-proxy/internal/auth"
+	"fhir-validation-proxy/internal/logging"
+	"fhir-validation-proxy/internal/metrics"
+	"fhir-validation-proxy/internal/validator"
+)
+
+// DryRunHeader asks the proxy to validate a request and report what it
+// would do with it, without forwarding or queueing it.
+const DryRunHeader = "X-Dry-Run"
+
+// isDryRun reports whether r asks for a dry run.
+func isDryRun(r *http.Request) bool {
+	dry, err := strconv.ParseBool(r.Header.Get(DryRunHeader))
+	return err == nil && dry
+}
+
+// writeDryRun reports the validation outcome of r and the action the proxy
+// would have taken. Invalid requests get the 400 they would normally get.
+func (p *Proxy) writeDryRun(w http.ResponseWriter, r *http.Request, result validator.ValidationResult, path string) {
+	status := http.StatusOK
+	action := ""
+	switch {
+	case !result.Valid:
+		status = http.StatusBadRequest
+		action = "rejected"
+	case p.Forwarder == nil:
+		action = "echoed back; no FHIR server is configured"
+	case p.Queue != nil && p.Queue.Depth() > 0:
+		action = fmt.Sprintf("queued behind %d undelivered requests", p.Queue.Depth())
+	default:
+		action = "forwarded to " + r.Method + " " + p.Forwarder.Target(r, path)
+	}
+
+	outcome := map[string]interface{}{"resourceType": "OperationOutcome"}
+	for k, v := range result.Outcome {
+		outcome[k] = v
+	}
+	outcome["issue"] = append(result.Outcome["issue"].([]map[string]interface{}), map[string]interface{}{
+		"severity":    "information",
+		"code":        "informational",
+		"diagnostics": "Dry run: the request would be " + action,
+	})
+	w.Header().Set(DryRunHeader, "true")
+	writeJSON(w, status, outcome)
+}
+
+// DefaultShadowWorkers is how many shadow comparisons NewShadow runs at
+// once.
+const DefaultShadowWorkers = 4
+
+// Shadow validates requests against a candidate rule set in the background
+// and logs how its verdicts differ from the active ones. It never affects
+// the response. At most a fixed number of comparisons run at once; requests
+// that arrive while every worker is busy are not compared, and are counted
+// in fhir_proxy_shadow_dropped_total.
+type Shadow struct {
+	rules *validator.RuleSet
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	// ctx is cancelled when a Drain runs out of time.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewShadow returns a Shadow for the candidate rules that runs up to
+// workers comparisons at once, or DefaultShadowWorkers if workers is not
+// positive.
+func NewShadow(rules *validator.RuleSet, workers int) *Shadow {
+	if workers <= 0 {
+		workers = DefaultShadowWorkers
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Shadow{rules: rules, slots: make(chan struct{}, workers), ctx: ctx, cancel: cancel}
+}
+
+// start compares body against the candidate rules on a free worker, and
+// closes body when done. ctx carries the request's values; its cancellation
+// is ignored, as the comparison outlives the request. If every worker is
+// busy the comparison is dropped.
+func (s *Shadow) start(ctx context.Context, method, path string, body *spool, active validator.ValidationResult) {
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		closeSpool(body)
+		metrics.ShadowDropped.Inc()
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() { <-s.slots }()
+		defer closeSpool(body)
+
+		ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		defer cancel()
+		defer context.AfterFunc(s.ctx, cancel)()
+		s.compare(ctx, method, path, body, active)
+	}()
+}
+
+// Drain waits for the comparisons in flight to finish, until ctx is done.
+// Comparisons still running then are cancelled, and Drain returns the
+// context's error.
+func (s *Shadow) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	s.cancel()
+	<-done
+	return ctx.Err()
+}
+
+// compare validates body against the candidate rules and logs how the
+// verdict differs from the active one.
+func (s *Shadow) compare(ctx context.Context, method, path string, body *spool, active validator.ValidationResult) {
+	reader, err := body.Reader()
+	if err != nil {
+		slog.WarnContext(ctx, "Shadow validation skipped", "error", err)
+		return
+	}
+	candidate, err := s.rules.ForClient(auth.ClientID(ctx)).ValidateStreamContext(ctx, reader)
+	if err != nil {
+		slog.WarnContext(ctx, "Shadow validation skipped", "error", err)
+		return
+	}
+	diff := validator.DiffResults(active, candidate)
+	if !diff.Changed() {
+		return
+	}
+	slog.InfoContext(ctx, "Shadow rules differ",
+		"method", method, "path", path,
+		"activeValid", diff.ActiveValid, "candidateValid", diff.CandidateValid,
+		"added", describeIssues(diff.Added), "removed", describeIssues(diff.Removed))
+}
+
+func describeIssues(issues []validator.Issue) string {
+	parts := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		// Diagnostics of built-in checks may quote the resource
+		id := issue.RuleID
+		if id == "" {
+			id = logging.RedactPHI(issue.Diagnostics)
+		}
+		parts = append(parts, issue.Severity+" "+id)
+	}
+	return strings.Join(parts, "; ")
+}
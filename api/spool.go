@@ -0,0 +1,80 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// spoolMemoryLimit is how much of a request body is buffered in memory
+// before the rest is spilled to a temporary file.
+const spoolMemoryLimit = 1 << 20
+
+// spool keeps a copy of a request body while it is streamed through the
+// validator, so that a valid body can be forwarded afterwards without being
+// held entirely in memory.
+type spool struct {
+	buf  bytes.Buffer
+	file *os.File
+	size int64
+	// shares counts the holders given the spool by share, besides its owner.
+	shares atomic.Int32
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	s.size += int64(len(p))
+	if s.file == nil && s.buf.Len()+len(p) <= spoolMemoryLimit {
+		return s.buf.Write(p)
+	}
+	if s.file == nil {
+		f, err := os.CreateTemp("", "fhir-proxy-body-*")
+		if err != nil {
+			return 0, err
+		}
+		s.file = f
+		if _, err := s.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+	return s.file.Write(p)
+}
+
+// Size returns the number of bytes written to the spool.
+func (s *spool) Size() int64 {
+	return s.size
+}
+
+// Reader returns a new reader over everything written to the spool. Readers
+// are independent, so a retried upstream request can read the body while an
+// earlier attempt is still being torn down.
+func (s *spool) Reader() (io.Reader, error) {
+	if s.file == nil {
+		return bytes.NewReader(s.buf.Bytes()), nil
+	}
+	return io.NewSectionReader(s.file, 0, s.size), nil
+}
+
+// share returns the spool for another goroutine to read once nothing more
+// is written to it. Each holder calls Close, and the temporary file is
+// released by the last of them.
+func (s *spool) share() *spool {
+	s.shares.Add(1)
+	return s
+}
+
+// Close releases the spool's temporary file, if any, once every holder has
+// closed it.
+func (s *spool) Close() error {
+	if s.shares.Add(-1) >= 0 {
+		return nil
+	}
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+
+	"fhir-validation-proxy/internal/trace"
+)
+
+// Trace traces each request in a server span, continuing the trace of an
+// incoming traceparent header. Validation stages and upstream calls made
+// for the request are traced as its children, and the upstream receives a
+// traceparent for the span of its call.
+func Trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := trace.Start(trace.Extract(r.Context(), r.Header), r.Method, trace.KindServer)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w}
+		req := r.WithContext(ctx)
+		next.ServeHTTP(sw, req)
+		// The ServeMux sets the route on the request it was given; handlers
+		// outside this one look for it on theirs.
+		r.Pattern = req.Pattern
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if req.Pattern != "" {
+			span.Name = r.Method + " " + req.Pattern
+			span.SetAttributes(trace.String("http.route", req.Pattern))
+		}
+		span.SetAttributes(
+			trace.String("http.request.method", r.Method),
+			trace.String("url.path", r.URL.Path),
+			trace.Int("http.response.status_code", status),
+		)
+		if status >= 500 {
+			span.SetErrorMessage(http.StatusText(status))
+		}
+	})
+}
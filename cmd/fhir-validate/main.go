@@ -0,0 +1,190 @@
+// Command fhir-validate validates FHIR resources offline with the same
+// engine and configuration as the proxy.
+//
+// Usage:
+//
+//	fhir-validate [flags] [file|directory|glob|-]...
+//	fhir-validate test-rules [-config dir] [-tests dir] [-allow-uncovered]
+//
+// JSON files are validated as single resources and .ndjson files line by
+// line; directories are searched for both. With no arguments, or "-", the
+// resource is read from stdin. The exit code reflects the worst severity
+// found: 0 for none or information, 1 for warning, 2 for error and 3 for
+// fatal (input that could not be read or parsed).
+//
+// test-rules runs the rule fixtures in <config>/tests (see package ruletest)
+// and fails if a case fails or a configured rule has no fixture.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"fhir-validation-proxy/internal/bulk"
+	"fhir-validation-proxy/internal/validator"
+)
+
+// exitUsage is the exit code for bad flags, configuration or output errors.
+const exitUsage = 4
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "test-rules" {
+		log.SetFlags(0)
+		os.Exit(testRules(os.Args[2:], os.Stdout))
+	}
+
+	configDir := flag.String("config", "configs", "configuration directory with profiles/, rules.yaml and recipes.yaml")
+	format := flag.String("format", "text", "output format: text, json or junit")
+	ndjson := flag.Bool("ndjson", false, "treat stdin and files without a .ndjson extension as NDJSON")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [file|directory|glob|-]...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(0)
+
+	write, ok := writers[*format]
+	if !ok {
+		log.Printf("Unknown format %q", *format)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if err := validator.LoadConfigDir(*configDir); err != nil {
+		log.Printf("Failed to load configuration: %v", err)
+		os.Exit(exitUsage)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"-"}
+	}
+
+	var results []result
+	for _, input := range expandInputs(args, &results) {
+		results = append(results, validateInput(input, *ndjson)...)
+	}
+
+	if err := write(os.Stdout, results); err != nil {
+		log.Printf("Failed to write report: %v", err)
+		os.Exit(exitUsage)
+	}
+	os.Exit(exitCode(results))
+}
+
+// expandInputs resolves globs and directories into the files to validate.
+// Arguments that match nothing are recorded in results as fatal.
+func expandInputs(args []string, results *[]result) []string {
+	var inputs []string
+	for _, arg := range args {
+		if arg == "-" {
+			inputs = append(inputs, arg)
+			continue
+		}
+
+		matches := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			var err error
+			matches, err = filepath.Glob(arg)
+			if err != nil || len(matches) == 0 {
+				*results = append(*results, fatal(arg, "No files match pattern"))
+				continue
+			}
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				*results = append(*results, fatal(match, err.Error()))
+				continue
+			}
+			if !info.IsDir() {
+				inputs = append(inputs, match)
+				continue
+			}
+			found, err := findResources(match)
+			if err != nil {
+				*results = append(*results, fatal(match, err.Error()))
+			}
+			inputs = append(inputs, found...)
+		}
+	}
+	return inputs
+}
+
+// findResources returns the .json and .ndjson files below dir in name order.
+func findResources(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && (isNDJSON(path) || strings.HasSuffix(path, ".json")) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+func isNDJSON(path string) bool {
+	return strings.HasSuffix(path, ".ndjson")
+}
+
+// validateInput validates one file, or stdin for "-".
+func validateInput(input string, ndjson bool) []result {
+	var r io.Reader = os.Stdin
+	if input != "-" {
+		// #nosec G304 -- input is given by the user on the command line
+		f, err := os.Open(input)
+		if err != nil {
+			return []result{fatal(input, err.Error())}
+		}
+		defer func() {
+			if cerr := f.Close(); cerr != nil {
+				log.Printf("Failed to close %s: %v", input, cerr)
+			}
+		}()
+		r = f
+	}
+
+	if ndjson || isNDJSON(input) {
+		var results []result
+		_, err := bulk.Scan(r, bulk.Options{}, func(line bulk.Line) error {
+			results = append(results, newResult(input, line.Number, line.Result.Outcome))
+			return nil
+		})
+		if err != nil {
+			results = append(results, fatal(input, err.Error()))
+		}
+		return results
+	}
+
+	res, err := validator.ValidateStream(r)
+	if err != nil {
+		return []result{fatal(input, "Invalid JSON: "+err.Error())}
+	}
+	return []result{newResult(input, 0, res.Outcome)}
+}
+
+func exitCode(results []result) int {
+	worst := 0
+	for _, r := range results {
+		if rank := severityRank[r.Severity]; rank > worst {
+			worst = rank
+		}
+	}
+	// information and below exit 0; warning, error and fatal exit 1, 2 and 3.
+	if worst <= severityRank["information"] {
+		return 0
+	}
+	return worst - severityRank["information"]
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fhir-validation-proxy/internal/validator"
+)
+
+func TestValidateInputs(t *testing.T) {
+	if err := validator.LoadConfigDir("../../configs"); err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"ok.json":         `{"resourceType": "Observation", "id": "obs1"}`,
+		"broken.json":     `{"resourceType": `,
+		"nested/x.ndjson": "{\"resourceType\": \"Observation\"}\n{\"resourceType\": \"Patient\"}\n",
+		"notes.txt":       "ignored",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var results []result
+	for _, input := range expandInputs([]string{dir, filepath.Join(dir, "*.missing")}, &results) {
+		results = append(results, validateInput(input, false)...)
+	}
+
+	var got []string
+	for _, r := range results {
+		got = append(got, strings.TrimPrefix(r.source(), dir+string(filepath.Separator))+"="+r.Severity)
+	}
+	want := []string{
+		"*.missing=fatal",
+		"broken.json=fatal",
+		"nested/x.ndjson:1=information",
+		"nested/x.ndjson:2=error",
+		"ok.json=information",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("results = %v, want %v", got, want)
+	}
+	if code := exitCode(results); code != 3 {
+		t.Errorf("exitCode() = %d, want 3", code)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		severities []string
+		want       int
+	}{
+		{nil, 0},
+		{[]string{"information"}, 0},
+		{[]string{"information", "warning"}, 1},
+		{[]string{"error", "warning"}, 2},
+		{[]string{"fatal", "error"}, 3},
+	}
+	for _, tt := range tests {
+		var results []result
+		for _, s := range tt.severities {
+			results = append(results, result{Severity: s})
+		}
+		if got := exitCode(results); got != tt.want {
+			t.Errorf("exitCode(%v) = %d, want %d", tt.severities, got, tt.want)
+		}
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	results := []result{
+		newResult("a.ndjson", 1, map[string]interface{}{"issue": []map[string]interface{}{{"severity": "information"}}}),
+		newResult("a.ndjson", 2, map[string]interface{}{"issue": []map[string]interface{}{{"severity": "error", "diagnostics": "bad"}}}),
+		fatal("b.json", "unreadable"),
+	}
+	var buf bytes.Buffer
+	if err := writeJUnit(&buf, results); err != nil {
+		t.Fatalf("writeJUnit() error = %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		`<testsuite name="a.ndjson" tests="2" failures="1" errors="0">`,
+		`<failure message="bad" type="error">`,
+		`<testsuite name="b.json" tests="1" failures="0" errors="1">`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("JUnit output missing %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+// severityRank orders OperationOutcome issue severities.
+var severityRank = map[string]int{
+	"information": 1,
+	"warning":     2,
+	"error":       3,
+	"fatal":       4,
+}
+
+// result is the outcome of validating one resource.
+type result struct {
+	// File is the input the resource came from, "-" for stdin.
+	File string `json:"file"`
+	// Line is the NDJSON line number, or 0 for a JSON file.
+	Line int `json:"line,omitempty"`
+	// Severity is the worst severity among the issues.
+	Severity string                 `json:"severity"`
+	Outcome  map[string]interface{} `json:"outcome"`
+	Issues   []issue                `json:"-"`
+}
+
+type issue struct {
+	Severity    string
+	Code        string
+	Diagnostics string
+}
+
+func newResult(file string, line int, outcome map[string]interface{}) result {
+	r := result{File: file, Line: line, Outcome: outcome}
+	issues, _ := outcome["issue"].([]map[string]interface{})
+	for _, i := range issues {
+		is := issue{}
+		is.Severity, _ = i["severity"].(string)
+		is.Code, _ = i["code"].(string)
+		is.Diagnostics, _ = i["diagnostics"].(string)
+		r.Issues = append(r.Issues, is)
+		if severityRank[is.Severity] > severityRank[r.Severity] {
+			r.Severity = is.Severity
+		}
+	}
+	return r
+}
+
+func fatal(file, message string) result {
+	return newResult(file, 0, map[string]interface{}{
+		"resourceType": "OperationOutcome",
+		"issue": []map[string]interface{}{{
+			"severity":    "fatal",
+			"code":        "structure",
+			"diagnostics": message,
+		}},
+	})
+}
+
+// source names the resource in reports.
+func (r result) source() string {
+	if r.Line > 0 {
+		return fmt.Sprintf("%s:%d", r.File, r.Line)
+	}
+	return r.File
+}
+
+// failed reports whether a result has issues worse than information.
+func (r result) failed() bool {
+	return severityRank[r.Severity] > severityRank["information"]
+}
+
+var writers = map[string]func(io.Writer, []result) error{
+	"text":  writeText,
+	"json":  writeJSON,
+	"junit": writeJUnit,
+}
+
+// counts returns the number of results with each worst severity.
+func counts(results []result) map[string]int {
+	c := map[string]int{}
+	for _, r := range results {
+		c[r.Severity]++
+	}
+	return c
+}
+
+func writeText(w io.Writer, results []result) error {
+	for _, r := range results {
+		if !r.failed() {
+			if _, err := fmt.Fprintf(w, "%s: OK\n", r.source()); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, i := range r.Issues {
+			if _, err := fmt.Fprintf(w, "%s: %s: %s\n", r.source(), i.Severity, i.Diagnostics); err != nil {
+				return err
+			}
+		}
+	}
+	c := counts(results)
+	_, err := fmt.Fprintf(w, "\n%d resources checked: %d fatal, %d error, %d warning\n",
+		len(results), c["fatal"], c["error"], c["warning"])
+	return err
+}
+
+func writeJSON(w io.Writer, results []result) error {
+	if results == nil {
+		results = []result{}
+	}
+	c := counts(results)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]interface{}{
+		"results": results,
+		"summary": map[string]int{
+			"resources":   len(results),
+			"fatal":       c["fatal"],
+			"error":       c["error"],
+			"warning":     c["warning"],
+			"information": c["information"],
+		},
+	})
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes a test suite per input file and a test case per
+// resource. Fatal results are reported as errors, warnings and errors as
+// failures.
+func writeJUnit(w io.Writer, results []result) error {
+	var suites junitSuites
+	index := map[string]int{}
+	for _, r := range results {
+		file := r.File
+		si, ok := index[file]
+		if !ok {
+			si = len(suites.Suites)
+			index[file] = si
+			suites.Suites = append(suites.Suites, junitSuite{Name: file})
+		}
+		suite := &suites.Suites[si]
+		suite.Tests++
+
+		tc := junitCase{Name: r.source(), ClassName: file}
+		if r.failed() {
+			f := &junitFailure{Type: r.Severity}
+			for _, i := range r.Issues {
+				if f.Message == "" {
+					f.Message = i.Diagnostics
+				}
+				f.Text += fmt.Sprintf("%s: %s\n", i.Severity, i.Diagnostics)
+			}
+			if r.Severity == "fatal" {
+				tc.Error = f
+				suite.Errors++
+			} else {
+				tc.Failure = f
+				suite.Failures++
+			}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
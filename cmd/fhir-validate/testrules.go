@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+
+	"fhir-validation-proxy/internal/ruletest"
+	"fhir-validation-proxy/internal/validator"
+)
+
+// testRules runs the rule fixtures and returns the exit code: 0 if every
+// case passes and every rule is covered, 1 otherwise.
+func testRules(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("test-rules", flag.ContinueOnError)
+	configDir := fs.String("config", "configs", "configuration directory with profiles/, rules.yaml and recipes.yaml")
+	testsDir := fs.String("tests", "", "fixture directory (default <config>/tests)")
+	allowUncovered := fs.Bool("allow-uncovered", false, "report rules no fixture covers without failing")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *testsDir == "" {
+		*testsDir = filepath.Join(*configDir, "tests")
+	}
+
+	if err := validator.LoadConfigDir(*configDir); err != nil {
+		log.Printf("Failed to load configuration: %v", err)
+		return exitUsage
+	}
+	suites, err := ruletest.LoadSuites(*testsDir)
+	if err != nil {
+		log.Printf("Failed to load fixtures: %v", err)
+		return exitUsage
+	}
+
+	report := ruletest.Run(suites)
+	if err := writeRuleReport(out, report); err != nil {
+		log.Printf("Failed to write report: %v", err)
+		return exitUsage
+	}
+
+	if report.Failed() > 0 || (len(report.Uncovered) > 0 && !*allowUncovered) {
+		return 1
+	}
+	return 0
+}
+
+func writeRuleReport(w io.Writer, report ruletest.Report) error {
+	for _, res := range report.Results {
+		status := "PASS"
+		if !res.Passed() {
+			status = "FAIL"
+		}
+		if _, err := fmt.Fprintf(w, "%s %s: %s\n", status, filepath.Base(res.Suite), res.Case); err != nil {
+			return err
+		}
+		for _, f := range res.Failures {
+			if _, err := fmt.Fprintf(w, "    %s\n", f); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(report.Uncovered) > 0 {
+		if _, err := fmt.Fprintln(w, "\nRules without a fixture:"); err != nil {
+			return err
+		}
+		for _, id := range report.Uncovered {
+			if _, err := fmt.Fprintf(w, "    %s\n", id); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "\n%d passed, %d failed, %d rules uncovered\n",
+		len(report.Results)-report.Failed(), report.Failed(), len(report.Uncovered))
+	return err
+}
@@ -2,113 +2,573 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"io"
-	"log"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"fhir-validation-proxy/api"
+	"fhir-validation-proxy/internal/audit"
+	"fhir-validation-proxy/internal/auth"
+	"fhir-validation-proxy/internal/forward"
+	"fhir-validation-proxy/internal/jobs"
+	"fhir-validation-proxy/internal/logging"
+	"fhir-validation-proxy/internal/metrics"
+	"fhir-validation-proxy/internal/queue"
+	"fhir-validation-proxy/internal/trace"
 	"fhir-validation-proxy/internal/validator"
 )
 
 func main() {
-	// FHIR Profiles
-	if err := validator.LoadProfiles("configs/profiles"); err != nil {
-		log.Fatalf("Failed to load profiles: %v", err)
+	ndjsonPath := flag.String("ndjson", "", "validate an NDJSON file (- for stdin) and exit instead of serving")
+	ndjsonType := flag.String("type", "", "with -ndjson, the only resourceType accepted on each line")
+	flag.Parse()
+
+	// Structured JSON logs; patient data is redacted unless LOG_PHI is set
+	level, err := logging.ParseLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		fatalf("Invalid LOG_LEVEL: %v", err)
 	}
-	// FHIR Rules
-	if err := validator.LoadRules("configs/rules.yaml"); err != nil {
-		log.Fatalf("Failed to load rules: %v", err)
+	logging.ShowPHI = boolEnv("LOG_PHI")
+	slog.SetDefault(logging.New(os.Stderr, level))
+
+	// FHIR Profiles, Packages, Rules and Bundle Recipes
+	if dir, ok := os.LookupEnv("FHIR_PACKAGE_CACHE"); ok {
+		validator.PackageCacheDir = dir
 	}
-	// Bundle Recipes
-	if err := validator.LoadRecipes("configs/recipes.yaml"); err != nil {
-		log.Fatalf("Failed to load recipes: %v", err)
+	err = validator.LoadConfigDir(configDir)
+	metrics.ConfigLoaded(err)
+	if err != nil {
+		fatalf("Failed to load configuration: %v", err)
 	}
 
-	http.HandleFunc("/validate", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
-			return
-		}
+	if *ndjsonPath != "" {
+		os.Exit(validateNDJSON(*ndjsonPath, *ndjsonType))
+	}
+
+	if n, ok := positiveIntEnv("MAX_BODY_BYTES"); ok {
+		api.MaxBodyBytes = n
+	}
+	if n, ok := positiveIntEnv("ENTRY_WORKERS"); ok {
+		validator.EntryWorkers = int(n)
+	}
+	validator.EntryRules = boolEnv("ENTRY_RULES")
+	validator.InjectProvenance = boolEnv("INJECT_PROVENANCE")
 
-		body, err := io.ReadAll(r.Body)
+	// Client identity: TLS client certificates and/or bearer tokens, with
+	// SMART scopes, per-client tenants and rate limits
+	authenticator := &api.Authenticator{}
+	if path := os.Getenv("CLIENTS_FILE"); path != "" {
+		clients, err := auth.LoadClients(path)
 		if err != nil {
-			http.Error(w, "Failed to read request body", http.StatusBadRequest)
-			return
+			fatalf("Failed to load CLIENTS_FILE: %v", err)
 		}
-
-		var resource map[string]interface{}
-		err = json.Unmarshal(body, &resource)
+		authenticator.Clients = clients
+	}
+	if jwks := os.Getenv("AUTH_JWKS_FILE"); jwks != "" {
+		verifier, err := auth.LoadJWKS(jwks)
 		if err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
+			fatalf("Failed to load AUTH_JWKS_FILE: %v", err)
 		}
+		verifier.Issuer = os.Getenv("AUTH_ISSUER")
+		verifier.Audience = os.Getenv("AUTH_AUDIENCE")
+		authenticator.Verifier = verifier
+	}
+	tlsConfig := serverTLSConfig(authenticator)
+	protect := func(h http.Handler) http.Handler { return h }
+	admin := protect
+	if authenticator.Verifier != nil || tlsConfig.ClientCAs != nil {
+		protect = authenticator.Wrap
+		admin = authenticator.Admin
+	}
+	if dir := os.Getenv("TENANTS_DIR"); dir != "" {
+		loadTenants(dir)
+	}
+
+	// Queued requests are replayed until shutdown
+	var replayer *queue.Replayer
 
-		result := validator.Validate(resource)
+	// If valid, forward to actual FHIR server (if configured)
+	proxy := &api.Proxy{Prefix: "/validate"}
+	if fhirURL := os.Getenv("FHIR_SERVER_URL"); fhirURL != "" {
+		upstreams := []*url.URL{parseURL("FHIR_SERVER_URL", fhirURL)}
+		// Failover upstreams, tried in order when the ones before are down
+		for _, u := range strings.Split(os.Getenv("FHIR_FAILOVER_URLS"), ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				upstreams = append(upstreams, parseURL("FHIR_FAILOVER_URLS", u))
+			}
+		}
+		proxy.Forwarder = newForwarder(upstreams...)
+		proxy.Forwarder.StripAuthorization = authenticator.Verifier != nil
+		http.Handle("/_upstream", admin(api.UpstreamStatusHandler(proxy.Forwarder)))
 
-		if !result.Valid {
-			operationOutcome := map[string]interface{}{
-				"resourceType": "OperationOutcome",
-				"issue":        []map[string]interface{}{},
+		// Store-and-forward queue for requests the upstream could not accept
+		if dir := os.Getenv("QUEUE_DIR"); dir != "" {
+			q, err := queue.Open(dir)
+			if err != nil {
+				fatalf("Failed to open queue: %v", err)
 			}
-			for _, errMsg := range result.Errors {
-				operationOutcome["issue"] = append(operationOutcome["issue"].([]map[string]interface{}), map[string]interface{}{
-					"severity":    "error",
-					"code":        "invalid",
-					"diagnostics": errMsg,
-				})
+			if d, ok := durationEnv("QUEUE_RETRY_INTERVAL"); ok {
+				q.RetryInterval = d
 			}
-			w.WriteHeader(http.StatusBadRequest)
-			w.Header().Set("Content-Type", "application/fhir+json")
-			if err := json.NewEncoder(w).Encode(operationOutcome); err != nil {
-				http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			if n, ok := positiveIntEnv("QUEUE_MAX_ATTEMPTS"); ok {
+				q.MaxAttempts = int(n)
 			}
+			proxy.Queue = q
+			replayer = q.StartReplay(proxy.Deliver)
+			http.Handle(api.QueuePath, admin(api.QueueHandler(q)))
+			http.Handle(api.QueuePath+"/", admin(api.QueueHandler(q)))
+		}
+	}
+
+	// Candidate rules run in shadow mode: differences are logged, never enforced
+	if dir := os.Getenv("SHADOW_CONFIG_DIR"); dir != "" {
+		shadow, err := validator.LoadRuleSet(dir)
+		if err != nil {
+			fatalf("Failed to load shadow rules: %v", err)
+		}
+		workers, _ := positiveIntEnv("SHADOW_WORKERS")
+		proxy.Shadow = api.NewShadow(shadow, int(workers))
+	}
+
+	// Async jobs (Prefer: respond-async)
+	var store jobs.Store = jobs.NewMemoryStore()
+	if dir := os.Getenv("ASYNC_JOB_DIR"); dir != "" {
+		fileStore, err := jobs.NewFileStore(dir)
+		if err != nil {
+			fatalf("Failed to open async job store: %v", err)
+		}
+		if n, err := fileStore.FailInProgress(); err != nil {
+			fatalf("Failed to recover async job store: %v", err)
+		} else if n > 0 {
+			slog.Warn("Marked async jobs interrupted by a restart as failed", "jobs", n)
+		}
+		store = fileStore
+	}
+	proxy.Jobs = jobs.NewManager(store)
+
+	// Bulk NDJSON pre-flight; valid lines are forwarded when an import URL is set
+	bulkImport := &api.BulkImport{}
+	if importURL := os.Getenv("BULK_IMPORT_URL"); importURL != "" {
+		bulkImport.Forwarder = newForwarder(parseURL("BULK_IMPORT_URL", importURL))
+		bulkImport.Forwarder.StripAuthorization = authenticator.Verifier != nil
+	}
+
+	// Audit trail of every submission
+	auditLog := auditLogger()
+
+	// Spans of validation stages and upstream calls, exported over OTLP
+	tracer := newTracer()
+	trace.SetTracer(tracer)
+	submit := func(h http.Handler) http.Handler { return api.Audit(auditLog, protect(h)) }
+
+	// /fhir/{path} forwards to FHIR_SERVER_URL/{path} with the same method:
+	// POST, PUT and JSON Patch PATCH once validated, GET, HEAD and DELETE as
+	// they are
+	fhirProxy := *proxy
+	fhirProxy.Prefix = "/fhir"
+	fhirProxy.PassThrough = true
+
+	http.Handle("/validate", submit(proxy))
+	fhirHandler := submit(&fhirProxy)
+	http.Handle("/fhir/", fhirHandler)
+	http.Handle("/$validate", submit(http.HandlerFunc(api.ValidateHandler)))
+
+	// Discovery: CapabilityStatement and the rules behind it
+	metadata := &api.Metadata{Forwarder: proxy.Forwarder}
+	http.Handle("/metadata", metadata)
+	http.Handle("/fhir/metadata", metadata)
+	http.HandleFunc("/_rules", api.RulesHandler)
+	// The profiles, ValueSets and CodeSystems the proxy enforces; under
+	// /fhir, writes to them are still validated and forwarded
+	for prefix, next := range map[string]http.Handler{"": nil, "/fhir": fhirHandler} {
+		conformance := api.ConformanceHandler(prefix, next)
+		for _, rt := range api.ConformanceTypes {
+			http.Handle(prefix+"/"+rt, conformance)
+			http.Handle(prefix+"/"+rt+"/", conformance)
+		}
+	}
+	http.Handle("/$import-preflight", submit(bulkImport))
+	// Prometheus metrics, scraped without authentication like /metadata
+	http.Handle("/metrics", metrics.Default)
+	// Probes and configuration status, open like /metadata
+	http.HandleFunc("/healthz", api.HealthHandler)
+	readiness := &api.Readiness{Forwarder: proxy.Forwarder, Queued: proxy.Queue != nil}
+	http.Handle("/readyz", readiness)
+	http.Handle("/status", api.StatusHandler(proxy.Forwarder))
+	http.Handle(api.AsyncStatusPath, protect(api.AsyncStatusHandler(proxy.Jobs)))
+
+	readTimeout, writeTimeout := serverTimeouts(proxy.Forwarder)
+	srv := &http.Server{
+		Addr:              ":8080",
+		Handler:           api.RequestLog(api.Trace(http.DefaultServeMux)),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       60 * time.Second,
+		TLSConfig:         tlsConfig,
+	}
+	grace := defaultGracePeriod
+	if d, ok := durationEnv("SHUTDOWN_GRACE_PERIOD"); ok {
+		grace = d
+	}
+	delay, _ := durationEnv("SHUTDOWN_DELAY")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	reloadOnHangup(ctx)
+	stopped := make(chan error, 1)
+	go func() {
+		if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+			slog.Info("Validator running at https://localhost:8080")
+			stopped <- srv.ListenAndServeTLS(certFile, os.Getenv("TLS_KEY_FILE"))
 			return
 		}
+		slog.Info("Validator running at http://localhost:8080")
+		stopped <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-stopped:
+		fatalf("Server stopped: %v", err)
+	case <-ctx.Done():
+	}
+	// A second signal stops the process at once
+	stop()
 
-		// If valid, forward to actual FHIR server (if configured)
-		fhirURL := os.Getenv("FHIR_SERVER_URL")
-		if fhirURL != "" {
-			parsedURL, err := url.ParseRequestURI(fhirURL)
-			if err != nil {
-				http.Error(w, "Invalid FHIR_SERVER_URL", http.StatusInternalServerError)
+	// Fail readiness first, so load balancers stop sending requests during
+	// SHUTDOWN_DELAY, then stop accepting connections and drain the requests,
+	// async jobs, shadow comparisons and queue replay in flight within the
+	// grace period.
+	slog.Info("Shutting down", "gracePeriod", grace.String(), "delay", delay.String())
+	readiness.Drain()
+	time.Sleep(delay)
+	drainCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		slog.Warn("Requests still in flight after the grace period", "error", err)
+	}
+	if err := proxy.Jobs.Drain(drainCtx); err != nil {
+		slog.Warn("Async jobs cancelled after the grace period", "error", err)
+	}
+	if proxy.Shadow != nil {
+		if err := proxy.Shadow.Drain(drainCtx); err != nil {
+			slog.Warn("Shadow comparisons cancelled after the grace period", "error", err)
+		}
+	}
+	if replayer != nil {
+		if err := replayer.Drain(drainCtx); err != nil {
+			slog.Warn("Queue replay cancelled after the grace period", "error", err)
+		}
+	}
+
+	// Flush the audit trail and spans
+	if auditLog != nil {
+		if err := auditLog.Close(); err != nil {
+			slog.Error("Failed to close audit sinks", "error", err)
+		}
+	}
+	if tracer != nil {
+		trace.SetTracer(nil)
+		if err := tracer.Close(); err != nil {
+			slog.Error("Failed to close span exporter", "error", err)
+		}
+	}
+	slog.Info("Shutdown complete")
+}
+
+// configDir is the configuration directory, relative to the working
+// directory.
+const configDir = "configs"
+
+// reloadOnHangup reloads the rules and recipes in configDir each time the
+// process gets SIGHUP, until ctx is done. A failed reload is logged and
+// the active rules are kept.
+func reloadOnHangup(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hangup)
+		for {
+			select {
+			case <-ctx.Done():
 				return
+			case <-hangup:
 			}
-			proxyResp, err := http.Post(parsedURL.String(), "application/fhir+json", bytes.NewReader(body))
+			err := validator.ReloadConfigDir(configDir)
+			metrics.ConfigLoaded(err)
 			if err != nil {
-				http.Error(w, "Failed to forward to FHIR server", http.StatusBadGateway)
-				return
+				slog.Error("Failed to reload configuration, keeping the active rules", "error", err)
+				continue
 			}
-			defer func() {
-				if cerr := proxyResp.Body.Close(); cerr != nil {
-					log.Printf("Failed to close proxy response body: %v", cerr)
-				}
-			}()
-			w.Header().Set("Content-Type", proxyResp.Header.Get("Content-Type"))
-			w.WriteHeader(proxyResp.StatusCode)
-			if _, err := io.Copy(w, proxyResp.Body); err != nil {
-				log.Printf("Failed to copy proxy response body: %v", err)
+			slog.Info("Reloaded rules and recipes")
+		}
+	}()
+}
+
+// newForwarder returns a Forwarder for upstreams with the timeout, retry,
+// circuit breaker and credential settings from the environment.
+func newForwarder(upstreams ...*url.URL) *forward.Forwarder {
+	timeout, _ := durationEnv("UPSTREAM_TIMEOUT")
+	f := forward.New(timeout, upstreams...)
+	f.Authorization = os.Getenv("UPSTREAM_AUTHORIZATION")
+	if n, ok := intEnv("UPSTREAM_RETRIES", 0); ok {
+		f.Retries = int(n)
+	}
+	if d, ok := durationEnv("UPSTREAM_RETRY_BACKOFF"); ok {
+		f.Backoff = d
+	}
+	if n, ok := positiveIntEnv("BREAKER_THRESHOLD"); ok {
+		f.Threshold = int(n)
+	}
+	if d, ok := durationEnv("BREAKER_COOLDOWN"); ok {
+		f.Cooldown = d
+	}
+	return f
+}
+
+// defaultGracePeriod is how long shutdown waits for requests and async jobs
+// in flight, unless SHUTDOWN_GRACE_PERIOD is set.
+const defaultGracePeriod = 30 * time.Second
+
+const (
+	// readHeaderTimeout is how long a client has to send request headers,
+	// and how long the server allows for writing a response.
+	readHeaderTimeout = 10 * time.Second
+	// minBodyRate is the slowest a request body may arrive, in bytes a
+	// second, for the default read timeout.
+	minBodyRate = 1 << 20
+)
+
+// serverTimeouts returns the server's read and write timeouts. The read
+// timeout allows a body of MAX_BODY_BYTES to arrive at minBodyRate, unless
+// READ_TIMEOUT is set. The write timeout also allows for the longest f can
+// take to forward a request, so a slow upstream exchange is not cut off.
+func serverTimeouts(f *forward.Forwarder) (read, write time.Duration) {
+	read = readHeaderTimeout + time.Duration(api.MaxBodyBytes/minBodyRate)*time.Second
+	if d, ok := durationEnv("READ_TIMEOUT"); ok {
+		read = d
+	}
+	write = read + readHeaderTimeout
+	if f != nil {
+		write += f.MaxDuration()
+	}
+	return read, write
+}
+
+// serverTLSConfig returns the TLS configuration for TLS_CERT_FILE and
+// TLS_KEY_FILE. With TLS_CLIENT_CA_FILE, client certificates are verified
+// against that CA bundle: they are required unless bearer tokens are also
+// accepted.
+func serverTLSConfig(a *api.Authenticator) *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	caFile := os.Getenv("TLS_CLIENT_CA_FILE")
+	if caFile == "" {
+		return config
+	}
+	if os.Getenv("TLS_CERT_FILE") == "" || os.Getenv("TLS_KEY_FILE") == "" {
+		fatalf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if a.Clients == nil {
+		fatalf("TLS_CLIENT_CA_FILE requires CLIENTS_FILE to map certificates to clients")
+	}
+	// #nosec G304 -- path is configured by the operator
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		fatalf("Failed to read TLS_CLIENT_CA_FILE: %v", err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		fatalf("No certificates in TLS_CLIENT_CA_FILE %s", caFile)
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if a.Verifier != nil {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config
+}
+
+// auditLogger returns a Logger for the sinks named in AUDIT_SINKS, a comma
+// separated list of stdout, file (AUDIT_FILE) and upstream (an AuditEvent
+// created on FHIR_SERVER_URL), or nil if none are.
+func auditLogger() *audit.Logger {
+	format, err := audit.ParseFormat(os.Getenv("AUDIT_FORMAT"))
+	if err != nil {
+		fatalf("Invalid AUDIT_FORMAT: %v", err)
+	}
+	var sinks []audit.Sink
+	for _, name := range strings.Split(os.Getenv("AUDIT_SINKS"), ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "":
+		case "stdout":
+			sinks = append(sinks, &audit.WriterSink{W: os.Stdout, Format: format})
+		case "file":
+			path := os.Getenv("AUDIT_FILE")
+			if path == "" {
+				fatalf("AUDIT_SINKS file requires AUDIT_FILE")
 			}
-			return
+			file, err := audit.OpenFile(path, format)
+			if err != nil {
+				fatalf("Failed to open AUDIT_FILE: %v", err)
+			}
+			if n, ok := positiveIntEnv("AUDIT_FILE_MAX_BYTES"); ok {
+				file.MaxBytes = n
+			}
+			if n, ok := intEnv("AUDIT_FILE_BACKUPS", 0); ok {
+				file.MaxBackups = int(n)
+			}
+			sinks = append(sinks, file)
+		case "upstream":
+			fhirURL := os.Getenv("FHIR_SERVER_URL")
+			if fhirURL == "" {
+				fatalf("AUDIT_SINKS upstream requires FHIR_SERVER_URL")
+			}
+			sink := audit.NewFHIRSink(parseURL("FHIR_SERVER_URL", fhirURL))
+			// The proxy's own credential, unless audit has one of its own
+			sink.Authorization = os.Getenv("AUDIT_UPSTREAM_AUTHORIZATION")
+			if sink.Authorization == "" {
+				sink.Authorization = os.Getenv("UPSTREAM_AUTHORIZATION")
+			}
+			sinks = append(sinks, sink)
+		default:
+			fatalf("Unknown audit sink %q in AUDIT_SINKS", name)
 		}
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+	l := audit.NewLogger(sinks...)
+	l.StorePayload = boolEnv("AUDIT_STORE_PAYLOAD")
+	return l
+}
 
-		// If no FHIR server configured, echo back the valid resource
-		w.Header().Set("Content-Type", "application/fhir+json")
-		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(resource); err != nil {
-			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+// newTracer returns a Tracer exporting to the OTLP/HTTP endpoint in
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or OTEL_EXPORTER_OTLP_ENDPOINT with
+// /v1/traces appended, or to the file TRACE_FILE, or nil if none is set.
+func newTracer() *trace.Tracer {
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		trace.ServiceName = name
+	}
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint == "" && base != "" {
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	file := os.Getenv("TRACE_FILE")
+	switch {
+	case endpoint != "" && file != "":
+		fatalf("Set either an OTLP endpoint or TRACE_FILE, not both")
+	case file != "":
+		exporter, err := trace.OpenFile(file)
+		if err != nil {
+			fatalf("Failed to open TRACE_FILE: %v", err)
+		}
+		return trace.NewTracer(exporter)
+	case endpoint != "":
+		exporter := &trace.OTLPExporter{Endpoint: parseURL("OTEL_EXPORTER_OTLP_ENDPOINT", endpoint), Headers: http.Header{}}
+		// Comma-separated key=value pairs, as for OpenTelemetry SDKs
+		for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+			if key, value, ok := strings.Cut(strings.TrimSpace(pair), "="); ok {
+				exporter.Headers.Set(strings.TrimSpace(key), strings.TrimSpace(value))
+			}
 		}
-	})
+		return trace.NewTracer(exporter)
+	}
+	return nil
+}
 
-	log.Println("Validator running at http://localhost:8080")
-	srv := &http.Server{
-		Addr:         ":8080",
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  60 * time.Second,
+// loadTenants loads the rule set of each tenant from a subdirectory of dir
+// named after it, holding rules.yaml and/or recipes.yaml.
+func loadTenants(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		fatalf("Failed to read TENANTS_DIR: %v", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		rs, err := validator.LoadRuleSet(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			fatalf("Failed to load rules for tenant %s: %v", entry.Name(), err)
+		}
+		api.TenantRules[entry.Name()] = rs
+	}
+}
+
+// fatalf logs an error and exits.
+func fatalf(format string, args ...interface{}) {
+	slog.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// positiveIntEnv reads a positive integer from the named environment
+// variable. It reports false if the variable is unset and exits if the
+// value is invalid.
+func positiveIntEnv(name string) (int64, bool) {
+	return intEnv(name, 1)
+}
+
+// intEnv reads an integer of at least min from the named environment
+// variable. It reports false if the variable is unset and exits if the
+// value is invalid.
+func intEnv(name string, min int64) (int64, bool) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < min {
+		fatalf("Invalid %s: %q", name, v)
+	}
+	return n, true
+}
+
+// boolEnv reads a boolean, such as "true", from the named environment
+// variable. It reports false if the variable is unset and exits if the value
+// is invalid.
+func boolEnv(name string) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		fatalf("Invalid %s: %q", name, v)
+	}
+	return b
+}
+
+// parseURL parses an absolute URL from the named environment variable and
+// exits if it is invalid.
+func parseURL(name, v string) *url.URL {
+	parsedURL, err := url.ParseRequestURI(v)
+	if err != nil {
+		fatalf("Invalid %s: %v", name, err)
+	}
+	return parsedURL
+}
+
+// durationEnv reads a positive duration, such as "30s", from the named
+// environment variable. It reports false if the variable is unset and exits
+// if the value is invalid.
+func durationEnv(name string) (time.Duration, bool) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, false
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		fatalf("Invalid %s: %q", name, v)
 	}
-	log.Fatal(srv.ListenAndServe())
+	return d, true
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+
+	"fhir-validation-proxy/internal/bulk"
+)
+
+// validateNDJSON validates an NDJSON file ("-" for stdin) without starting
+// the server. OperationOutcomes are written to stdout and the summary to
+// stderr. It returns the exit code: 0 if every line is valid, 1 if any line
+// is invalid and 2 if the file could not be read.
+func validateNDJSON(path, resourceType string) int {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		// #nosec G304 -- path is given by the operator on the command line
+		f, err := os.Open(path)
+		if err != nil {
+			slog.Error("Failed to open NDJSON file", "path", path, "error", err)
+			return 2
+		}
+		defer func() {
+			if cerr := f.Close(); cerr != nil {
+				slog.Warn("Failed to close NDJSON file", "path", path, "error", cerr)
+			}
+		}()
+		in = f
+	}
+
+	summary, err := bulk.Validate(in, os.Stdout, bulk.Options{ResourceType: resourceType})
+	if err != nil {
+		slog.Error("Failed to validate NDJSON file", "path", path, "error", err)
+		return 2
+	}
+	if err := json.NewEncoder(os.Stderr).Encode(summary.Parameters()); err != nil {
+		slog.Error("Failed to write summary", "error", err)
+	}
+	if summary.Invalid > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,301 @@
+// Package audit records every submission to the proxy for information
+// governance: who sent it, what resource, the validation verdict and the
+// upstream status. Records are written as FHIR AuditEvent resources or as
+// JSON lines to pluggable sinks. Payloads are hashed, and only kept when a
+// Logger is configured to store them.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Validation verdicts.
+const (
+	VerdictValid   = "valid"
+	VerdictInvalid = "invalid"
+	// VerdictMalformed means the body could not be read as JSON or was too
+	// large, so it was not validated.
+	VerdictMalformed = "malformed"
+)
+
+// DefaultBuffer is how many records a Logger holds for its sinks before
+// requests wait for them.
+const DefaultBuffer = 1024
+
+// Record is the audit record of one request.
+type Record struct {
+	Recorded time.Time `json:"recorded"`
+	// RequestID is the request's X-Request-ID.
+	RequestID string `json:"requestId,omitempty"`
+	// ClientID, Subject, Tenant and AuthMethod describe the authenticated
+	// client; they are empty when the request was not authenticated.
+	ClientID   string `json:"clientId,omitempty"`
+	Subject    string `json:"subject,omitempty"`
+	Tenant     string `json:"tenant,omitempty"`
+	AuthMethod string `json:"authMethod,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	// Interaction is the FHIR interaction requested of the upstream, such
+	// as "create"; see auth.Interaction.
+	Interaction  string `json:"interaction,omitempty"`
+	ResourceType string `json:"resourceType,omitempty"`
+	// Verdict is the validation verdict, or "" if the body was never
+	// validated, as when the client was refused first.
+	Verdict string `json:"verdict,omitempty"`
+	// Errors is the number of validation errors.
+	Errors int `json:"errors,omitempty"`
+	// Status is the HTTP status returned to the client.
+	Status int `json:"status"`
+	// UpstreamStatus is the status the upstream server returned, or 0 if
+	// the request was not forwarded.
+	UpstreamStatus int `json:"upstreamStatus,omitempty"`
+	// Queued is set when the request was queued for later delivery.
+	Queued bool `json:"queued,omitempty"`
+	// JobID is the async job that processes the request, if any.
+	JobID         string `json:"jobId,omitempty"`
+	PayloadSize   int64  `json:"payloadSize,omitempty"`
+	PayloadSHA256 string `json:"payloadSha256,omitempty"`
+	// Payload is the request body, kept only if the Logger stores payloads.
+	// Until the record is written it is spooled to a temporary file, and
+	// it is only read into Payload while the sinks write the record, so
+	// queued records do not hold request bodies in memory.
+	Payload []byte `json:"payload,omitempty"`
+
+	logger *Logger
+	hash   hash.Hash
+	spool  *payloadSpool
+}
+
+// PayloadWriter returns the writer the request body should be copied to as
+// it is read, to be hashed and, if configured, stored.
+func (rec *Record) PayloadWriter() io.Writer {
+	if rec == nil {
+		return io.Discard
+	}
+	if rec.hash == nil {
+		rec.hash = sha256.New()
+		if rec.logger != nil && rec.logger.StorePayload {
+			rec.spool = newPayloadSpool()
+		}
+	}
+	return payloadWriter{rec}
+}
+
+type payloadWriter struct{ rec *Record }
+
+func (w payloadWriter) Write(p []byte) (int, error) {
+	w.rec.PayloadSize += int64(len(p))
+	w.rec.hash.Write(p)
+	if w.rec.spool != nil {
+		w.rec.spool.write(p)
+	}
+	return len(p), nil
+}
+
+// sumPayload sets PayloadSHA256 from what was written to PayloadWriter.
+func (rec *Record) sumPayload() {
+	if rec.hash == nil {
+		return
+	}
+	rec.PayloadSHA256 = hex.EncodeToString(rec.hash.Sum(nil))
+}
+
+// loadPayload reads the spooled payload into Payload and releases the
+// spool.
+func (rec *Record) loadPayload() {
+	if rec.spool == nil {
+		return
+	}
+	payload, err := rec.spool.read()
+	if err != nil {
+		slog.Warn("Audit payload not stored", "requestId", rec.RequestID, "error", err)
+	}
+	rec.Payload = payload
+	rec.spool.release()
+	rec.spool = nil
+}
+
+// payloadSpool is a stored payload in a temporary file. A record and its
+// forks share it, and the last of them to be written removes it.
+type payloadSpool struct {
+	file *os.File
+	size int64
+	err  error
+	refs atomic.Int32
+}
+
+// newPayloadSpool returns a spool, or nil if no temporary file can be
+// created, in which case only the payload's hash is kept.
+func newPayloadSpool() *payloadSpool {
+	file, err := os.CreateTemp("", "fhir-audit-payload-*")
+	if err != nil {
+		slog.Warn("Audit payloads will not be stored", "error", err)
+		return nil
+	}
+	s := &payloadSpool{file: file}
+	s.refs.Store(1)
+	return s
+}
+
+func (s *payloadSpool) write(p []byte) {
+	if s.err != nil {
+		return
+	}
+	n, err := s.file.Write(p)
+	s.size += int64(n)
+	s.err = err
+}
+
+func (s *payloadSpool) read() ([]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return io.ReadAll(io.NewSectionReader(s.file, 0, s.size))
+}
+
+// release removes the file once every record sharing the spool is done
+// with it.
+func (s *payloadSpool) release() {
+	if s.refs.Add(-1) > 0 {
+		return
+	}
+	name := s.file.Name()
+	if err := s.file.Close(); err != nil {
+		slog.Warn("Failed to close audit payload spool", "error", err)
+	}
+	if err := os.Remove(name); err != nil {
+		slog.Warn("Failed to remove audit payload spool", "error", err)
+	}
+}
+
+// Fork returns a new record of the same request and payload, for work that
+// continues after the request, such as an async job. It is logged on its
+// own with Log.
+func (rec *Record) Fork() *Record {
+	if rec == nil {
+		return nil
+	}
+	rec.sumPayload()
+	if rec.spool != nil {
+		rec.spool.refs.Add(1)
+	}
+	fork := *rec
+	fork.Recorded = time.Now().UTC()
+	fork.hash = nil
+	return &fork
+}
+
+// Log sends the record to the sinks of the Logger that created it. It does
+// nothing for a nil record.
+func (rec *Record) Log() {
+	if rec == nil || rec.logger == nil {
+		return
+	}
+	rec.sumPayload()
+	rec.logger.log(rec)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying rec.
+func NewContext(ctx context.Context, rec *Record) context.Context {
+	return context.WithValue(ctx, contextKey{}, rec)
+}
+
+// FromContext returns the record carried by ctx, or nil.
+func FromContext(ctx context.Context) *Record {
+	rec, _ := ctx.Value(contextKey{}).(*Record)
+	return rec
+}
+
+// Logger writes records to its sinks in the background, in the order they
+// are logged. When its buffer is full, Log waits rather than drop records.
+// FHIRSink queues records of its own, so Log only waits for it when the
+// FHIR server falls behind by more than that queue.
+type Logger struct {
+	// StorePayload keeps request bodies in the records, instead of only
+	// their hashes.
+	StorePayload bool
+
+	sinks   []Sink
+	records chan *Record
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewLogger returns a Logger writing to sinks and starts its writer.
+func NewLogger(sinks ...Sink) *Logger {
+	l := &Logger{
+		sinks:   sinks,
+		records: make(chan *Record, DefaultBuffer),
+		done:    make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// NewRecord returns an empty record to be logged by l.
+func (l *Logger) NewRecord() *Record {
+	return &Record{Recorded: time.Now().UTC(), logger: l}
+}
+
+func (l *Logger) log(rec *Record) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		slog.Warn("Audit record dropped after shutdown", "requestId", rec.RequestID, "method", rec.Method, "path", rec.Path)
+		if rec.spool != nil {
+			rec.spool.release()
+			rec.spool = nil
+		}
+		return
+	}
+	l.records <- rec
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+	for rec := range l.records {
+		rec.loadPayload()
+		for _, sink := range l.sinks {
+			if err := sink.Write(rec); err != nil {
+				slog.Error("Failed to write audit record", "requestId", rec.RequestID, "method", rec.Method, "path", rec.Path, "error", err)
+			}
+		}
+		rec.Payload = nil
+	}
+}
+
+// Close writes the records still buffered and closes the sinks. Records
+// logged after Close are dropped with a warning.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.records)
+	l.mu.Unlock()
+
+	<-l.done
+	var err error
+	for _, sink := range l.sinks {
+		if cerr := sink.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
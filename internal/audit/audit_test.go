@@ -0,0 +1,238 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLogger_HashesPayload(t *testing.T) {
+	// Stored payloads are spooled to TMPDIR until they are written
+	spoolDir := t.TempDir()
+	t.Setenv("TMPDIR", spoolDir)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	file, err := OpenFile(path, FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLogger(file)
+	body := `{"resourceType": "Patient"}`
+
+	rec := l.NewRecord()
+	rec.ClientID, rec.Method, rec.Path, rec.Status = "partner-a", "POST", "/fhir/Patient", 201
+	if _, err := io.Copy(rec.PayloadWriter(), strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	rec.Log()
+
+	l.StorePayload = true
+	stored := l.NewRecord()
+	if _, err := io.Copy(stored.PayloadWriter(), strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	// A fork, as for an async job, shares the stored payload
+	fork := stored.Fork()
+	stored.Log()
+	fork.Log()
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// Late records, such as from jobs cancelled at shutdown, are dropped
+	l.NewRecord().Log()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 records after Close, got %d", len(lines))
+	}
+	sum := sha256.Sum256([]byte(body))
+	for i, line := range lines {
+		var got Record
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.PayloadSHA256 != hex.EncodeToString(sum[:]) || got.PayloadSize != int64(len(body)) {
+			t.Errorf("Record %d: unexpected payload hash %q size %d", i, got.PayloadSHA256, got.PayloadSize)
+		}
+		if stored := string(got.Payload); (i == 0) != (stored == "") {
+			t.Errorf("Record %d: payload stored as %q", i, stored)
+		}
+	}
+	if spooled, _ := os.ReadDir(spoolDir); len(spooled) != 0 {
+		t.Errorf("Expected payload spools removed, found %d files", len(spooled))
+	}
+}
+
+func TestRecord_AuditEvent(t *testing.T) {
+	rec := &Record{
+		ClientID:       "partner-a",
+		RemoteAddr:     "10.0.0.1:5000",
+		Method:         "POST",
+		Path:           "/fhir/Observation",
+		Interaction:    "create",
+		ResourceType:   "Observation",
+		Verdict:        VerdictValid,
+		Status:         201,
+		UpstreamStatus: 201,
+		PayloadSHA256:  "abc",
+	}
+	event := rec.AuditEvent()
+	if event["resourceType"] != "AuditEvent" || event["action"] != "C" || event["outcome"] != "0" {
+		t.Errorf("Unexpected AuditEvent %v", event)
+	}
+	agent := event["agent"].([]map[string]interface{})[0]
+	if agent["who"].(map[string]interface{})["identifier"].(map[string]interface{})["value"] != "partner-a" {
+		t.Errorf("Expected the client as agent, got %v", agent)
+	}
+	entity := event["entity"].([]map[string]interface{})[0]
+	details := map[string]string{}
+	for _, d := range entity["detail"].([]map[string]interface{}) {
+		if v, ok := d["valueString"].(string); ok {
+			details[d["type"].(string)] = v
+		}
+	}
+	if details["verdict"] != "valid" || details["upstreamStatus"] != "201" || details["payloadSha256"] != "abc" {
+		t.Errorf("Unexpected entity details %v", details)
+	}
+
+	rec.Status, rec.Verdict = 400, VerdictInvalid
+	if outcome := rec.AuditEvent()["outcome"]; outcome != "4" {
+		t.Errorf("Expected outcome 4 for a rejected request, got %v", outcome)
+	}
+}
+
+func TestFileSink_Rotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	file, err := OpenFile(path, FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.MaxBytes, file.MaxBackups = 1, 2
+	for i := 0; i < 4; i++ {
+		if err := file.Write(&Record{Method: "POST", Path: "/validate", Status: 200 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// One record per file: the newest in path, the two before in backups,
+	// and the oldest dropped.
+	for name, want := range map[string]int{path: 203, path + ".1": 202, path + ".2": 201} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Record
+		err = json.NewDecoder(bufio.NewReader(f)).Decode(&got)
+		_ = f.Close()
+		if err != nil || got.Status != want {
+			t.Errorf("%s: expected status %d, got %d (%v)", filepath.Base(name), want, got.Status, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backups, found %s.3", path)
+	}
+}
+
+func TestFHIRSink_PostsBatches(t *testing.T) {
+	var events int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer audit" {
+			t.Errorf("Expected the audit credential, got Authorization %q", got)
+		}
+		var bundle struct {
+			Type  string `json:"type"`
+			Entry []struct {
+				Resource struct {
+					ResourceType string `json:"resourceType"`
+				} `json:"resource"`
+			} `json:"entry"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&bundle); err != nil || bundle.Type != "batch" {
+			t.Errorf("Expected a batch Bundle, got %+v, %v", bundle, err)
+		}
+		responses := make([]string, 0, len(bundle.Entry))
+		for _, e := range bundle.Entry {
+			if e.Resource.ResourceType == "AuditEvent" {
+				events++
+			}
+			responses = append(responses, `{"response": {"status": "201 Created"}}`)
+		}
+		_, _ = io.WriteString(w, `{"resourceType": "Bundle", "type": "batch-response", "entry": [`+strings.Join(responses, ",")+`]}`)
+	}))
+	defer server.Close()
+
+	base, _ := url.Parse(server.URL)
+	s := NewFHIRSink(base)
+	s.Authorization = "Bearer audit"
+	l := NewLogger(s)
+	for i := 0; i < 3; i++ {
+		l.NewRecord().Log()
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if events != 3 {
+		t.Errorf("Expected 3 AuditEvents created, got %d", events)
+	}
+}
+
+func TestFHIRSink_WaitsWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	var events atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var bundle struct {
+			Entry []json.RawMessage `json:"entry"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&bundle)
+		events.Add(int32(len(bundle.Entry)))
+		responses := strings.Repeat(`{"response": {"status": "201 Created"}},`, len(bundle.Entry))
+		_, _ = io.WriteString(w, `{"resourceType": "Bundle", "entry": [`+strings.TrimSuffix(responses, ",")+`]}`)
+	}))
+	defer server.Close()
+
+	base, _ := url.Parse(server.URL)
+	s := NewFHIRSink(base)
+	s.QueueSize = 1
+	// The first record is being posted and the second fills the queue
+	for i := 0; i < 2; i++ {
+		if err := s.Write(&Record{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	written := make(chan error)
+	go func() { written <- s.Write(&Record{}) }()
+	select {
+	case err := <-written:
+		t.Fatalf("Expected Write to wait for the FHIR server, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := events.Load(); n != 3 {
+		t.Errorf("Expected all 3 AuditEvents created, got %d", n)
+	}
+}
@@ -0,0 +1,479 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format is how a sink writes records.
+type Format string
+
+const (
+	// FormatAuditEvent writes each record as a FHIR AuditEvent resource.
+	FormatAuditEvent Format = "fhir"
+	// FormatJSON writes each record as a JSON object.
+	FormatJSON Format = "json"
+)
+
+// ParseFormat returns the Format named s; "" means FormatAuditEvent.
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case "", FormatAuditEvent:
+		return FormatAuditEvent, nil
+	case FormatJSON:
+		return FormatJSON, nil
+	}
+	return "", fmt.Errorf("unknown audit format %q", s)
+}
+
+// Sink is a destination for audit records. A Logger calls Write from one
+// goroutine at a time.
+type Sink interface {
+	Write(rec *Record) error
+	Close() error
+}
+
+// encode returns rec as one line of JSON in format f.
+func encode(rec *Record, f Format) ([]byte, error) {
+	var v interface{} = rec
+	if f == FormatAuditEvent {
+		v = rec.AuditEvent()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// AuditEvent returns rec as a FHIR R4 AuditEvent resource.
+func (rec *Record) AuditEvent() map[string]interface{} {
+	outcome, desc := "0", fmt.Sprintf("HTTP %d", rec.Status)
+	switch {
+	case rec.Status >= 500:
+		outcome = "8"
+	case rec.Status >= 400:
+		outcome = "4"
+	}
+	if rec.Verdict != "" {
+		desc += "; validation " + rec.Verdict
+	}
+	if rec.UpstreamStatus != 0 {
+		desc += "; upstream HTTP " + strconv.Itoa(rec.UpstreamStatus)
+	}
+	if rec.Queued {
+		desc += "; queued"
+	}
+
+	event := map[string]interface{}{
+		"resourceType": "AuditEvent",
+		"type": map[string]interface{}{
+			"system":  "http://terminology.hl7.org/CodeSystem/audit-event-type",
+			"code":    "rest",
+			"display": "RESTful Operation",
+		},
+		"action":      action(rec.Method),
+		"recorded":    rec.Recorded.Format(time.RFC3339Nano),
+		"outcome":     outcome,
+		"outcomeDesc": desc,
+		"source": map[string]interface{}{
+			"observer": map[string]interface{}{"display": "fhir-validation-proxy"},
+			"type": []map[string]interface{}{{
+				"system":  "http://terminology.hl7.org/CodeSystem/security-source-type",
+				"code":    "4",
+				"display": "Application Server",
+			}},
+		},
+	}
+	if rec.Interaction != "" {
+		event["subtype"] = []map[string]interface{}{{
+			"system": "http://hl7.org/fhir/restful-interaction",
+			"code":   rec.Interaction,
+		}}
+	}
+
+	agent := map[string]interface{}{"requestor": true}
+	if rec.ClientID != "" {
+		agent["who"] = map[string]interface{}{"identifier": map[string]interface{}{"value": rec.ClientID}}
+	}
+	if rec.Subject != "" {
+		agent["altId"] = rec.Subject
+	}
+	if host, _, err := net.SplitHostPort(rec.RemoteAddr); err == nil {
+		agent["network"] = map[string]interface{}{"address": host, "type": "2"}
+	}
+	event["agent"] = []map[string]interface{}{agent}
+
+	details := []map[string]interface{}{
+		{"type": "method", "valueString": rec.Method},
+		{"type": "path", "valueString": rec.Path},
+	}
+	addDetail := func(name, value string) {
+		if value != "" {
+			details = append(details, map[string]interface{}{"type": name, "valueString": value})
+		}
+	}
+	addDetail("requestId", rec.RequestID)
+	addDetail("tenant", rec.Tenant)
+	addDetail("authMethod", rec.AuthMethod)
+	addDetail("verdict", rec.Verdict)
+	if rec.Verdict != "" {
+		addDetail("errors", strconv.Itoa(rec.Errors))
+	}
+	if rec.UpstreamStatus != 0 {
+		addDetail("upstreamStatus", strconv.Itoa(rec.UpstreamStatus))
+	}
+	addDetail("jobId", rec.JobID)
+	if rec.PayloadSHA256 != "" {
+		addDetail("payloadSize", strconv.FormatInt(rec.PayloadSize, 10))
+		addDetail("payloadSha256", rec.PayloadSHA256)
+	}
+	if rec.Payload != nil {
+		details = append(details, map[string]interface{}{
+			"type":              "payload",
+			"valueBase64Binary": base64.StdEncoding.EncodeToString(rec.Payload),
+		})
+	}
+	entity := map[string]interface{}{
+		"type": map[string]interface{}{
+			"system":  "http://terminology.hl7.org/CodeSystem/audit-entity-type",
+			"code":    "2",
+			"display": "System Object",
+		},
+		"detail": details,
+	}
+	if rec.ResourceType != "" {
+		entity["what"] = map[string]interface{}{"type": rec.ResourceType}
+	}
+	event["entity"] = []map[string]interface{}{entity}
+	return event
+}
+
+// action returns the AuditEvent action code for an HTTP method.
+func action(method string) string {
+	switch method {
+	case http.MethodPost:
+		return "C"
+	case http.MethodPut, http.MethodPatch:
+		return "U"
+	case http.MethodDelete:
+		return "D"
+	case http.MethodGet, http.MethodHead:
+		return "R"
+	}
+	return "E"
+}
+
+// WriterSink writes records as lines to W, such as os.Stdout.
+type WriterSink struct {
+	W      io.Writer
+	Format Format
+}
+
+// Write writes one line.
+func (s *WriterSink) Write(rec *Record) error {
+	line, err := encode(rec, s.Format)
+	if err != nil {
+		return err
+	}
+	_, err = s.W.Write(line)
+	return err
+}
+
+// Close does nothing; W is not closed.
+func (s *WriterSink) Close() error { return nil }
+
+// Defaults used by OpenFile.
+const (
+	DefaultMaxFileBytes = 100 << 20
+	DefaultMaxBackups   = 10
+)
+
+// FileSink appends records as lines to a file. When the file would grow
+// past MaxBytes it is rotated: path becomes path.1, path.1 becomes path.2,
+// and so on, keeping MaxBackups old files.
+type FileSink struct {
+	Format     Format
+	MaxBytes   int64
+	MaxBackups int
+
+	path string
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenFile opens, or creates, a rotating audit file at path.
+func OpenFile(path string, f Format) (*FileSink, error) {
+	s := &FileSink{Format: f, MaxBytes: DefaultMaxFileBytes, MaxBackups: DefaultMaxBackups, path: path}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	// #nosec G304 -- path is configured by the operator
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+// Write appends one line, rotating the file first if it is full.
+func (s *FileSink) Write(rec *Record) error {
+	line, err := encode(rec, s.Format)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	if s.MaxBytes > 0 && s.size > 0 && s.size+int64(len(line)) > s.MaxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	if s.MaxBackups < 1 {
+		if err := os.Remove(s.path); err != nil {
+			return err
+		}
+		return s.open()
+	}
+	for i := s.MaxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(s.backup(i), s.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(s.path, s.backup(1)); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileSink) backup(i int) string {
+	return s.path + "." + strconv.Itoa(i)
+}
+
+// Close syncs and closes the file.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	return err
+}
+
+// Defaults used by NewFHIRSink.
+const (
+	// DefaultFHIRTimeout bounds each post when Client is nil.
+	DefaultFHIRTimeout = 10 * time.Second
+	// DefaultFHIRQueue is how many records a FHIRSink holds for the FHIR
+	// server before Write waits for it.
+	DefaultFHIRQueue = 4096
+	// DefaultFHIRQueueBytes is how large the AuditEvents a FHIRSink holds
+	// may be in total before Write waits, as stored payloads make them
+	// as large as request bodies.
+	DefaultFHIRQueueBytes = 64 << 20
+	// DefaultFHIRBatch is the most AuditEvents posted in one Bundle.
+	DefaultFHIRBatch = 100
+)
+
+// FHIRSink creates records as AuditEvents on a FHIR server. Write only
+// queues them; they are posted in the background, as many as are queued
+// at once, in batch Bundles. When the queue is full, Write waits for the
+// server rather than drop records. Batches the server fails are logged,
+// so it should be paired with a FileSink for a complete trail.
+type FHIRSink struct {
+	// Base is the FHIR server base URL; batches are posted to it.
+	Base   *url.URL
+	Client *http.Client
+	// Authorization, if set, is sent as the Authorization header of every
+	// post.
+	Authorization string
+	// QueueSize and QueueBytes bound the AuditEvents queued for the
+	// server, by number and by total size.
+	QueueSize  int
+	QueueBytes int64
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	events [][]byte
+	size   int64
+	closed bool
+	done   chan struct{}
+}
+
+// NewFHIRSink returns a FHIRSink posting to the FHIR server at base and
+// starts its writer.
+func NewFHIRSink(base *url.URL) *FHIRSink {
+	s := &FHIRSink{
+		Base:       base,
+		QueueSize:  DefaultFHIRQueue,
+		QueueBytes: DefaultFHIRQueueBytes,
+		done:       make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.run()
+	return s
+}
+
+// Write queues the record's AuditEvent to be posted, waiting while the
+// queue is full. An event larger than QueueBytes is queued once the queue
+// is empty.
+func (s *FHIRSink) Write(rec *Record) error {
+	event, err := encode(rec, FormatAuditEvent)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.closed && len(s.events) > 0 && (len(s.events) >= s.QueueSize || s.size+int64(len(event)) > s.QueueBytes) {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return os.ErrClosed
+	}
+	s.events = append(s.events, event)
+	s.size += int64(len(event))
+	s.cond.Broadcast()
+	return nil
+}
+
+// next waits for queued events and takes up to a batch of them. It
+// returns nil once the sink is closed and the queue is empty.
+func (s *FHIRSink) next() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.closed && len(s.events) == 0 {
+		s.cond.Wait()
+	}
+	n := min(len(s.events), DefaultFHIRBatch)
+	batch := s.events[:n:n]
+	s.events = s.events[n:]
+	for _, event := range batch {
+		s.size -= int64(len(event))
+	}
+	s.cond.Broadcast()
+	return batch
+}
+
+func (s *FHIRSink) run() {
+	defer close(s.done)
+	for batch := s.next(); len(batch) > 0; batch = s.next() {
+		if err := s.post(batch); err != nil {
+			slog.Error("Failed to create AuditEvents", "records", len(batch), "error", err)
+		}
+	}
+}
+
+// post creates events in a batch Bundle. Any status but 2xx, or any entry
+// that was not created, is an error.
+func (s *FHIRSink) post(events [][]byte) error {
+	entries := make([]map[string]interface{}, 0, len(events))
+	for _, event := range events {
+		entries = append(entries, map[string]interface{}{
+			"resource": json.RawMessage(event),
+			"request":  map[string]interface{}{"method": http.MethodPost, "url": "AuditEvent"},
+		})
+	}
+	body, err := json.Marshal(map[string]interface{}{"resourceType": "Bundle", "type": "batch", "entry": entries})
+	if err != nil {
+		return err
+	}
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultFHIRTimeout}
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, s.Base.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/fhir+json")
+	if s.Authorization != "" {
+		req.Header.Set("Authorization", s.Authorization)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return fmt.Errorf("FHIR server returned %s for AuditEvents", resp.Status)
+	}
+	var bundle struct {
+		Entry []struct {
+			Response struct {
+				Status string `json:"status"`
+			} `json:"response"`
+		} `json:"entry"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&bundle); err != nil {
+		return fmt.Errorf("failed to read batch response: %w", err)
+	}
+	failed := 0
+	for _, e := range bundle.Entry {
+		if !strings.HasPrefix(e.Response.Status, "2") {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("FHIR server did not create %d of %d AuditEvents", failed, len(events))
+	}
+	return nil
+}
+
+// Close posts the records still queued. Records written after Close are
+// refused.
+func (s *FHIRSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	<-s.done
+	return nil
+}
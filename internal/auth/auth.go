@@ -0,0 +1,174 @@
+// Package auth verifies who is sending requests to the proxy and what they
+// may do: bearer tokens are checked against a local JWKS and SMART on FHIR
+// scopes are enforced per resource type and interaction.
+package auth
+
+import (
+	"context"
+	"strings"
+)
+
+// Interactions a SMART scope can grant, named as in FHIR.
+const (
+	InteractionRead   = "read"
+	InteractionSearch = "search"
+	InteractionCreate = "create"
+	InteractionUpdate = "update"
+	InteractionDelete = "delete"
+)
+
+// How an identity was verified.
+const (
+	MethodToken       = "token"
+	MethodCertificate = "certificate"
+)
+
+// AdminScope grants access to the proxy's admin endpoints: the queue, the
+// upstream status and every client's async jobs. It is not a SMART scope
+// and grants nothing else.
+const AdminScope = "proxy.admin"
+
+// Identity is a verified client.
+type Identity struct {
+	// Subject is the token's sub claim, or the certificate's subject DN.
+	Subject string `json:"subject,omitempty"`
+	// ClientID identifies the client application; it is the client_id or
+	// azp claim, or Subject when the token has neither.
+	ClientID string `json:"clientId"`
+	Issuer   string `json:"issuer,omitempty"`
+	// Scopes are the SMART scopes granted to the client.
+	Scopes []string `json:"scopes,omitempty"`
+	// Tenant selects the rule set the client's resources are validated
+	// against; see Client.Tenant.
+	Tenant string `json:"tenant,omitempty"`
+	// Method is how the identity was verified: MethodToken or
+	// MethodCertificate.
+	Method string `json:"method"`
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying id.
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity carried by ctx, or nil.
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+	return id
+}
+
+// ClientID returns the client ID of the identity carried by ctx, or "".
+func ClientID(ctx context.Context) string {
+	if id := FromContext(ctx); id != nil {
+		return id.ClientID
+	}
+	return ""
+}
+
+// Allows reports whether the identity's scopes grant interaction on
+// resourceType. SMART v1 scopes (system/Patient.write, user/*.read,
+// system/Observation.*) and v2 scopes (system/Patient.cu) are understood.
+// Only system and user scopes are honoured: patient scopes limit access to
+// one patient's compartment, which the proxy cannot check.
+func (id *Identity) Allows(resourceType, interaction string) bool {
+	for _, scope := range id.Scopes {
+		if scopeAllows(scope, resourceType, interaction) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdmin reports whether the identity has AdminScope.
+func (id *Identity) IsAdmin() bool {
+	for _, scope := range id.Scopes {
+		if scope == AdminScope {
+			return true
+		}
+	}
+	return false
+}
+
+func scopeAllows(scope, resourceType, interaction string) bool {
+	level, rest, ok := strings.Cut(scope, "/")
+	if !ok || (level != "system" && level != "user") {
+		return false
+	}
+	rt, access, ok := strings.Cut(rest, ".")
+	if !ok || (rt != "*" && rt != resourceType) {
+		return false
+	}
+	// v2 scopes may be narrowed by search parameters, which are not checked
+	access, _, _ = strings.Cut(access, "?")
+
+	switch access {
+	case "*":
+		return true
+	case "read":
+		return interaction == InteractionRead || interaction == InteractionSearch
+	case "write":
+		return interaction == InteractionCreate || interaction == InteractionUpdate || interaction == InteractionDelete
+	}
+	letter := map[string]string{
+		InteractionCreate: "c",
+		InteractionRead:   "r",
+		InteractionUpdate: "u",
+		InteractionDelete: "d",
+		InteractionSearch: "s",
+	}[interaction]
+	return letter != "" && isV2Access(access) && strings.Contains(access, letter)
+}
+
+// isV2Access reports whether access is a SMART v2 permission string: the
+// letters c, r, u, d and s, in that order.
+func isV2Access(access string) bool {
+	if access == "" {
+		return false
+	}
+	order := "cruds"
+	for _, ch := range access {
+		i := strings.IndexRune(order, ch)
+		if i < 0 {
+			return false
+		}
+		order = order[i+1:]
+	}
+	return true
+}
+
+// Interaction returns the FHIR interaction an HTTP method performs on url,
+// a request path relative to the FHIR base such as "Patient" or
+// "Patient/123", or "" for methods that do not map to one.
+func Interaction(method, url string) string {
+	switch strings.ToUpper(method) {
+	case "POST":
+		if strings.HasSuffix(strings.SplitN(url, "?", 2)[0], "/_search") {
+			return InteractionSearch
+		}
+		return InteractionCreate
+	case "PUT", "PATCH":
+		return InteractionUpdate
+	case "DELETE":
+		return InteractionDelete
+	case "GET", "HEAD":
+		path, _, _ := strings.Cut(url, "?")
+		if strings.Contains(strings.Trim(path, "/"), "/") {
+			return InteractionRead
+		}
+		return InteractionSearch
+	}
+	return ""
+}
+
+// ResourceType returns the resource type a request url, relative to the
+// FHIR base, is about, or "".
+func ResourceType(url string) string {
+	path, _, _ := strings.Cut(url, "?")
+	rt, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if rt == "" || rt[0] < 'A' || rt[0] > 'Z' {
+		return ""
+	}
+	return rt
+}
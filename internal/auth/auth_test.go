@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+// sign returns a compact JWT with the given header and claims.
+func sign(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + b64(sig)
+}
+
+// writeJWKS writes the public keys to a JWKS file and returns its path.
+func writeJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	t.Helper()
+	ecPub, err := ecKey.PublicKey.ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	point := ecPub.Bytes() // 0x04 || X || Y
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(point[1:33]), "y": b64(point[33:])},
+		{"kty": "oct", "kid": "secret", "k": "c2VjcmV0"},
+	}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := LoadJWKS(writeJWKS(t, rsaKey, ecKey))
+	if err != nil {
+		t.Fatalf("LoadJWKS: %v", err)
+	}
+	v.Issuer, v.Audience = "https://auth.example", "https://proxy.example"
+	now := time.Unix(1_700_000_000, 0)
+	v.now = func() time.Time { return now }
+
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":       "https://auth.example",
+			"sub":       "svc-1",
+			"aud":       []string{"https://proxy.example"},
+			"exp":       now.Add(time.Hour).Unix(),
+			"client_id": "partner-a",
+			"scope":     "system/Patient.write system/Observation.cu",
+		}
+		for k, val := range changes {
+			if val == nil {
+				delete(c, k)
+			} else {
+				c[k] = val
+			}
+		}
+		return c
+	}
+
+	for _, token := range []string{
+		sign(t, "RS256", "rsa", rsaKey, claims(nil)),
+		sign(t, "ES256", "ec", ecKey, claims(nil)),
+	} {
+		id, err := v.Verify(token)
+		if err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+		if id.ClientID != "partner-a" || id.Subject != "svc-1" || len(id.Scopes) != 2 {
+			t.Errorf("Unexpected identity %+v", id)
+		}
+	}
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	for name, token := range map[string]string{
+		"expired":        sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})),
+		"no exp":         sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": nil})),
+		"not yet valid":  sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})),
+		"wrong issuer":   sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example"})),
+		"wrong audience": sign(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": "https://other.example"})),
+		"bad signature":  sign(t, "RS256", "rsa", otherKey, claims(nil)),
+		"unknown key":    sign(t, "RS256", "secret", rsaKey, claims(nil)),
+		"alg mismatch":   sign(t, "ES256", "rsa", ecKey, claims(nil)),
+		"not a JWT":      "abc",
+	} {
+		if _, err := v.Verify(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: expected ErrInvalidToken, got %v", name, err)
+		}
+	}
+
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySignature("RS256", edKey, "signed", []byte("sig")); err == nil {
+		t.Error("Expected an error for an unsupported key type")
+	}
+}
+
+func TestAllows(t *testing.T) {
+	id := &Identity{Scopes: []string{
+		"system/Patient.write",
+		"user/*.read",
+		"system/Observation.cu",
+		"system/Encounter.*",
+		"patient/Condition.write",
+	}}
+	for _, tc := range []struct {
+		resourceType, interaction string
+		want                      bool
+	}{
+		{"Patient", InteractionCreate, true},
+		{"Patient", InteractionDelete, true},
+		{"Patient", InteractionRead, true},
+		{"Practitioner", InteractionSearch, true},
+		{"Practitioner", InteractionCreate, false},
+		{"Observation", InteractionCreate, true},
+		{"Observation", InteractionUpdate, true},
+		{"Observation", InteractionDelete, false},
+		{"Encounter", InteractionDelete, true},
+		{"Condition", InteractionCreate, false},
+	} {
+		if got := id.Allows(tc.resourceType, tc.interaction); got != tc.want {
+			t.Errorf("Allows(%s, %s) = %v, want %v", tc.resourceType, tc.interaction, got, tc.want)
+		}
+	}
+}
+
+func TestInteraction(t *testing.T) {
+	for _, tc := range []struct{ method, url, want string }{
+		{"POST", "Patient", InteractionCreate},
+		{"POST", "Patient/_search", InteractionSearch},
+		{"PUT", "Patient/1", InteractionUpdate},
+		{"DELETE", "Patient?identifier=x", InteractionDelete},
+		{"GET", "Patient/1", InteractionRead},
+		{"GET", "Patient?name=smith", InteractionSearch},
+		{"OPTIONS", "Patient", ""},
+	} {
+		if got := Interaction(tc.method, tc.url); got != tc.want {
+			t.Errorf("Interaction(%s, %s) = %q, want %q", tc.method, tc.url, got, tc.want)
+		}
+	}
+	if rt := ResourceType("/Patient/1?_format=json"); rt != "Patient" {
+		t.Errorf("Expected Patient, got %q", rt)
+	}
+}
+
+func TestClients_ForCertificate(t *testing.T) {
+	clients := NewClients(map[string]*Client{
+		"partner-a": {Subjects: []string{"CN=partner-a,O=Partner A"}, Tenant: "wales", Scopes: []string{"system/*.write"}},
+		"partner-b": {URIs: []string{"spiffe://example.org/partner-b"}},
+	})
+	spiffe, _ := url.Parse("spiffe://example.org/partner-b")
+
+	for _, tc := range []struct {
+		cert *x509.Certificate
+		want string
+	}{
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "partner-a", Organization: []string{"Partner A"}}}, "partner-a"},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "other"}, URIs: []*url.URL{spiffe}}, "partner-b"},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "stranger"}}, ""},
+	} {
+		id := clients.ForCertificate(tc.cert)
+		got := ""
+		if id != nil {
+			got = id.ClientID
+			if id.Method != MethodCertificate || id.Subject != tc.cert.Subject.String() {
+				t.Errorf("Unexpected identity %+v", id)
+			}
+		}
+		if got != tc.want {
+			t.Errorf("Certificate %s: expected client %q, got %q", tc.cert.Subject, tc.want, got)
+		}
+	}
+
+	id := &Identity{ClientID: "partner-a", Method: MethodToken}
+	clients.Apply(id)
+	if id.Tenant != "wales" {
+		t.Errorf("Expected a token client's tenant to be applied, got %q", id.Tenant)
+	}
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Client is a known client of the proxy, identified by its certificate or
+// by the client ID in its tokens.
+type Client struct {
+	// Subjects are certificate subject DNs that identify the client, as
+	// formatted by crypto/x509 (RFC 2253), such as "CN=partner-a,O=Partner A,C=GB".
+	Subjects []string `yaml:"subjects"`
+	// DNSNames, URIs and Emails are certificate SANs that identify the
+	// client.
+	DNSNames []string `yaml:"dnsNames"`
+	URIs     []string `yaml:"uris"`
+	Emails   []string `yaml:"emails"`
+	// Scopes are the SMART scopes granted to the client when it presents a
+	// certificate. Token clients get the scopes in their token.
+	Scopes []string `yaml:"scopes"`
+	// Tenant selects the rule set the client's resources are validated
+	// against.
+	Tenant string `yaml:"tenant"`
+	// RateLimit is the number of requests per second the client may make,
+	// with bursts of up to Burst. Zero means no limit.
+	RateLimit float64 `yaml:"rateLimit"`
+	Burst     int     `yaml:"burst"`
+}
+
+// Clients holds the known clients by ID.
+type Clients struct {
+	byID map[string]*Client
+}
+
+// LoadClients reads known clients from a YAML file mapping client IDs to
+// Client settings.
+func LoadClients(path string) (*Clients, error) {
+	// #nosec G304 -- path is configured by the operator
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[string]*Client{}
+	if err := yaml.Unmarshal(data, &byID); err != nil {
+		return nil, fmt.Errorf("error parsing clients %s: %w", path, err)
+	}
+	return NewClients(byID), nil
+}
+
+// NewClients returns Clients for settings keyed by client ID.
+func NewClients(byID map[string]*Client) *Clients {
+	if byID == nil {
+		byID = map[string]*Client{}
+	}
+	return &Clients{byID: byID}
+}
+
+// Get returns the settings of a client, or nil if it is not known.
+func (c *Clients) Get(clientID string) *Client {
+	if c == nil {
+		return nil
+	}
+	return c.byID[clientID]
+}
+
+// ForCertificate returns the identity of the client a verified certificate
+// belongs to, matched by subject DN or SAN, or nil if none matches. If
+// several clients match, the first by ID wins.
+func (c *Clients) ForCertificate(cert *x509.Certificate) *Identity {
+	if c == nil {
+		return nil
+	}
+	ids := make([]string, 0, len(c.byID))
+	for id := range c.byID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	subject := cert.Subject.String()
+	for _, id := range ids {
+		client := c.byID[id]
+		if client.matches(cert, subject) {
+			return &Identity{
+				Subject:  subject,
+				ClientID: id,
+				Scopes:   client.Scopes,
+				Tenant:   client.Tenant,
+				Method:   MethodCertificate,
+			}
+		}
+	}
+	return nil
+}
+
+func (cl *Client) matches(cert *x509.Certificate, subject string) bool {
+	if contains(cl.Subjects, subject) {
+		return true
+	}
+	for _, name := range cert.DNSNames {
+		if contains(cl.DNSNames, name) {
+			return true
+		}
+	}
+	for _, u := range cert.URIs {
+		if contains(cl.URIs, u.String()) {
+			return true
+		}
+	}
+	for _, email := range cert.EmailAddresses {
+		if contains(cl.Emails, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply adds the settings of a known client to a token identity.
+func (c *Clients) Apply(id *Identity) {
+	if client := c.Get(id.ClientID); client != nil && id.Tenant == "" {
+		id.Tenant = client.Tenant
+	}
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+// Package bulk validates FHIR Bulk Data NDJSON, one resource per line.
+package bulk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"fhir-validation-proxy/internal/validator"
+)
+
+// Options controls how NDJSON is validated.
+type Options struct {
+	// ResourceType, if set, is the only resourceType accepted on a line.
+	ResourceType string
+	// Valid, if set, receives every valid line as NDJSON.
+	Valid io.Writer
+}
+
+// Summary counts the lines processed by Validate.
+type Summary struct {
+	Lines   int
+	Valid   int
+	Invalid int
+	// Issues and Errors count the issues, and the errors among them, of
+	// every line.
+	Issues int
+	Errors int
+	// ByType counts valid and invalid lines per resourceType.
+	ByType map[string]*Count
+}
+
+// Count is the number of valid and invalid lines of one resourceType.
+type Count struct {
+	Valid   int
+	Invalid int
+}
+
+// Line is a validated NDJSON line.
+type Line struct {
+	// Number is the 1-based line number.
+	Number       int
+	ResourceType string
+	// Raw is the line with surrounding whitespace removed.
+	Raw    []byte
+	Result validator.ValidationResult
+}
+
+// Scan reads NDJSON from r, validates each non-blank line with
+// validator.Validate and passes it to fn. Scanning stops at the first error
+// returned by fn. Options.Valid receives every valid line.
+//
+// The returned error reports a failure to read r or an error from fn;
+// invalid lines are reported to fn and counted in the Summary.
+func Scan(r io.Reader, opts Options, fn func(Line) error) (Summary, error) {
+	summary := Summary{ByType: map[string]*Count{}}
+	reader := bufio.NewReader(r)
+
+	for n := 1; ; n++ {
+		raw, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return summary, err
+		}
+		if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 {
+			line := Line{Number: n, Raw: trimmed}
+			line.ResourceType, line.Result = validateLine(trimmed, opts.ResourceType)
+			summary.add(line)
+
+			if line.Result.Valid && opts.Valid != nil {
+				if _, werr := opts.Valid.Write(append(trimmed, '\n')); werr != nil {
+					return summary, werr
+				}
+			}
+			if ferr := fn(line); ferr != nil {
+				return summary, ferr
+			}
+		}
+		if err == io.EOF {
+			return summary, nil
+		}
+	}
+}
+
+// Validate is Scan writing, for every resource line, an OperationOutcome
+// with id "line-N" to outcomes as NDJSON.
+func Validate(r io.Reader, outcomes io.Writer, opts Options) (Summary, error) {
+	enc := json.NewEncoder(outcomes)
+	return Scan(r, opts, func(line Line) error {
+		line.Result.Outcome["id"] = fmt.Sprintf("line-%d", line.Number)
+		return enc.Encode(line.Result.Outcome)
+	})
+}
+
+func (s *Summary) add(line Line) {
+	s.Lines++
+	s.Issues += len(line.Result.Issues)
+	s.Errors += len(line.Result.Errors)
+	count := &Count{}
+	if line.ResourceType != "" {
+		if s.ByType[line.ResourceType] == nil {
+			s.ByType[line.ResourceType] = &Count{}
+		}
+		count = s.ByType[line.ResourceType]
+	}
+	if line.Result.Valid {
+		s.Valid++
+		count.Valid++
+	} else {
+		s.Invalid++
+		count.Invalid++
+	}
+}
+
+// validateLine validates a single NDJSON line and returns its resourceType.
+func validateLine(line []byte, expectedType string) (string, validator.ValidationResult) {
+	var resource map[string]interface{}
+	if err := json.Unmarshal(line, &resource); err != nil {
+		return "", invalid("Invalid JSON")
+	}
+	resourceType, _ := resource["resourceType"].(string)
+	if expectedType != "" && resourceType != expectedType {
+		return resourceType, invalid(fmt.Sprintf("Expected resourceType %s, got %q", expectedType, resourceType))
+	}
+	return resourceType, validator.Validate(resource)
+}
+
+func invalid(message string) validator.ValidationResult {
+	return validator.NewResult([]validator.Issue{{
+		Severity:    validator.SeverityError,
+		Code:        "invalid",
+		Diagnostics: message,
+	}})
+}
+
+// Parameters renders the summary as a FHIR Parameters resource with id
+// "summary".
+func (s Summary) Parameters() map[string]interface{} {
+	params := []map[string]interface{}{
+		{"name": "lines", "valueInteger": s.Lines},
+		{"name": "valid", "valueInteger": s.Valid},
+		{"name": "invalid", "valueInteger": s.Invalid},
+	}
+
+	types := make([]string, 0, len(s.ByType))
+	for rt := range s.ByType {
+		types = append(types, rt)
+	}
+	sort.Strings(types)
+	for _, rt := range types {
+		params = append(params, map[string]interface{}{
+			"name": "resourceType",
+			"part": []map[string]interface{}{
+				{"name": "type", "valueCode": rt},
+				{"name": "valid", "valueInteger": s.ByType[rt].Valid},
+				{"name": "invalid", "valueInteger": s.ByType[rt].Invalid},
+			},
+		})
+	}
+
+	return map[string]interface{}{
+		"resourceType": "Parameters",
+		"id":           "summary",
+		"parameter":    params,
+	}
+}
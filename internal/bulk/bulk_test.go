@@ -0,0 +1,88 @@
+package bulk
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	input := strings.Join([]string{
+		`{"resourceType": "Observation", "id": "obs1"}`,
+		``,
+		`{not json`,
+		`{"resourceType": "Patient", "id": "pat1"}`,
+		`{"resourceType": "Observation", "id": "obs2"}`,
+	}, "\n")
+
+	tests := []struct {
+		name         string
+		resourceType string
+		wantValid    int
+		wantInvalid  int
+		wantIDs      []string
+	}{
+		{
+			name:        "mixed resource types",
+			wantValid:   3,
+			wantInvalid: 1,
+			wantIDs:     []string{"line-1", "line-3", "line-4", "line-5"},
+		},
+		{
+			name:         "single resource type",
+			resourceType: "Observation",
+			wantValid:    2,
+			wantInvalid:  2,
+			wantIDs:      []string{"line-1", "line-3", "line-4", "line-5"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var outcomes, valid bytes.Buffer
+			summary, err := Validate(strings.NewReader(input), &outcomes, Options{ResourceType: tt.resourceType, Valid: &valid})
+			if err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if summary.Lines != 4 || summary.Valid != tt.wantValid || summary.Invalid != tt.wantInvalid {
+				t.Errorf("Validate() summary = %+v, want %d valid, %d invalid", summary, tt.wantValid, tt.wantInvalid)
+			}
+			if summary.Errors < summary.Invalid || summary.Issues < summary.Errors {
+				t.Errorf("Validate() summary = %+v, want an error for every invalid line", summary)
+			}
+
+			var ids []string
+			dec := json.NewDecoder(&outcomes)
+			for dec.More() {
+				var outcome map[string]interface{}
+				if err := dec.Decode(&outcome); err != nil {
+					t.Fatalf("failed to decode outcome: %v", err)
+				}
+				ids = append(ids, outcome["id"].(string))
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.wantIDs, ",") {
+				t.Errorf("outcome ids = %v, want %v", ids, tt.wantIDs)
+			}
+
+			if got := strings.Count(valid.String(), "\n"); got != tt.wantValid {
+				t.Errorf("valid lines written = %d, want %d", got, tt.wantValid)
+			}
+		})
+	}
+}
+
+func TestSummaryParameters(t *testing.T) {
+	summary := Summary{Lines: 3, Valid: 2, Invalid: 1, ByType: map[string]*Count{
+		"Patient":     {Valid: 1},
+		"Observation": {Valid: 1, Invalid: 1},
+	}}
+	params := summary.Parameters()["parameter"].([]map[string]interface{})
+	if len(params) != 5 {
+		t.Fatalf("expected 5 parameters, got %d", len(params))
+	}
+	first := params[3]["part"].([]map[string]interface{})[0]
+	if first["valueCode"] != "Observation" {
+		t.Errorf("expected resource types in name order, got %v first", first["valueCode"])
+	}
+}
@@ -0,0 +1,178 @@
+// Package capability builds the proxy's CapabilityStatement, describing the
+// profiles, rules and operations it enforces in front of the upstream FHIR
+// server.
+package capability
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"fhir-validation-proxy/internal/validator"
+)
+
+// ValidateOperation is the canonical definition of the $validate operation
+// served by the proxy.
+const ValidateOperation = "http://hl7.org/fhir/OperationDefinition/Resource-validate"
+
+// FHIRVersion is reported when the upstream statement does not give one.
+const FHIRVersion = "4.0.1"
+
+// Formats are the formats the proxy accepts. Only JSON can be validated, so
+// they replace the upstream's.
+var Formats = []string{"application/fhir+json", "json"}
+
+// Statement returns the proxy's CapabilityStatement. If upstream is the
+// upstream server's statement, the proxy's details are merged into it and
+// only resource types the upstream supports are listed; otherwise every
+// resource type with a profile or rule is listed. upstream is modified.
+func Statement(upstream map[string]interface{}, now time.Time) map[string]interface{} {
+	cs := upstream
+	if cs == nil {
+		cs = map[string]interface{}{}
+	}
+	// The merged statement is not the upstream's published one.
+	for _, k := range []string{"id", "meta", "text", "url", "version"} {
+		delete(cs, k)
+	}
+	cs["resourceType"] = "CapabilityStatement"
+	cs["status"] = "active"
+	cs["date"] = now.UTC().Format(time.RFC3339)
+	cs["kind"] = "instance"
+	if _, ok := cs["fhirVersion"]; !ok {
+		cs["fhirVersion"] = FHIRVersion
+	}
+	cs["format"] = Formats
+	software := map[string]interface{}{"name": "FHIR Validation Proxy"}
+	if up, ok := cs["software"].(map[string]interface{}); ok {
+		if name, ok := up["name"].(string); ok {
+			software["name"] = "FHIR Validation Proxy for " + name
+		}
+	}
+	cs["software"] = software
+
+	rest := serverRest(cs)
+	profiles := profilesByType()
+	rules, _ := validator.ActiveRules()
+
+	resources, _ := rest["resource"].([]interface{})
+	listed := map[string]bool{}
+	for _, r := range resources {
+		if res, ok := r.(map[string]interface{}); ok {
+			if rt, ok := res["type"].(string); ok {
+				listed[rt] = true
+				describe(res, profiles[rt], len(rules[rt]))
+			}
+		}
+	}
+	if upstream == nil {
+		for _, rt := range resourceTypes(profiles, rules) {
+			res := map[string]interface{}{
+				"type": rt,
+				"interaction": []interface{}{
+					map[string]interface{}{"code": "create"},
+					map[string]interface{}{"code": "update"},
+				},
+			}
+			describe(res, profiles[rt], len(rules[rt]))
+			resources = append(resources, res)
+		}
+	}
+	if resources != nil {
+		rest["resource"] = resources
+	}
+
+	operations, _ := rest["operation"].([]interface{})
+	if !hasOperation(operations, "validate") {
+		rest["operation"] = append(operations, map[string]interface{}{
+			"name":       "validate",
+			"definition": ValidateOperation,
+		})
+	}
+	return cs
+}
+
+// serverRest returns the server-mode rest entry of cs, adding one if needed.
+func serverRest(cs map[string]interface{}) map[string]interface{} {
+	rests, _ := cs["rest"].([]interface{})
+	for _, r := range rests {
+		if rest, ok := r.(map[string]interface{}); ok && rest["mode"] == "server" {
+			return rest
+		}
+	}
+	rest := map[string]interface{}{"mode": "server"}
+	cs["rest"] = append(rests, rest)
+	return rest
+}
+
+// describe adds the proxy's profiles and rule count to a rest resource.
+func describe(res map[string]interface{}, profiles []string, rules int) {
+	if len(profiles) > 0 {
+		seen := map[string]bool{}
+		merged := []interface{}{}
+		existing, _ := res["supportedProfile"].([]interface{})
+		for _, p := range existing {
+			if s, ok := p.(string); ok && !seen[s] {
+				seen[s] = true
+				merged = append(merged, s)
+			}
+		}
+		for _, p := range profiles {
+			if !seen[p] {
+				seen[p] = true
+				merged = append(merged, p)
+			}
+		}
+		res["supportedProfile"] = merged
+	}
+	if rules > 0 {
+		note := fmt.Sprintf("Validated by the proxy against %d field rules (see /_rules).", rules)
+		if doc, ok := res["documentation"].(string); ok && doc != "" {
+			note = doc + "\n\n" + note
+		}
+		res["documentation"] = note
+	}
+}
+
+// profilesByType returns the URLs of the loaded profiles by the
+// resourceType they constrain, in order. Each URL is listed once, however
+// many versions of it are loaded.
+func profilesByType() map[string][]string {
+	byType := map[string][]string{}
+	seen := map[string]bool{}
+	for _, sd := range validator.Profiles {
+		if sd.Type != "" && !seen[sd.URL] {
+			seen[sd.URL] = true
+			byType[sd.Type] = append(byType[sd.Type], sd.URL)
+		}
+	}
+	for _, urls := range byType {
+		sort.Strings(urls)
+	}
+	return byType
+}
+
+func resourceTypes(profiles map[string][]string, rules map[string]map[string]validator.FieldRule) []string {
+	seen := map[string]bool{}
+	var types []string
+	for rt := range profiles {
+		seen[rt] = true
+		types = append(types, rt)
+	}
+	for rt := range rules {
+		if !seen[rt] {
+			types = append(types, rt)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+func hasOperation(operations []interface{}, name string) bool {
+	for _, o := range operations {
+		if op, ok := o.(map[string]interface{}); ok && op["name"] == name {
+			return true
+		}
+	}
+	return false
+}
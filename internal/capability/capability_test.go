@@ -0,0 +1,95 @@
+package capability
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"fhir-validation-proxy/internal/validator"
+)
+
+const patientProfile = "https://fhir.nhs.wales/StructureDefinition/DataStandardsWales-Patient"
+
+func load(t *testing.T) {
+	t.Helper()
+	if err := validator.LoadConfigDir("../../configs"); err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+}
+
+func resources(t *testing.T, cs map[string]interface{}) map[string]map[string]interface{} {
+	t.Helper()
+	byType := map[string]map[string]interface{}{}
+	rest := cs["rest"].([]interface{})[0].(map[string]interface{})
+	for _, r := range rest["resource"].([]interface{}) {
+		res := r.(map[string]interface{})
+		byType[res["type"].(string)] = res
+	}
+	return byType
+}
+
+func TestStatement_ProxyOnly(t *testing.T) {
+	load(t)
+	cs := Statement(nil, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	if cs["date"] != "2024-01-02T03:04:05Z" || cs["fhirVersion"] != FHIRVersion {
+		t.Errorf("Unexpected statement header %v", cs)
+	}
+	patient := resources(t, cs)["Patient"]
+	if patient == nil {
+		t.Fatalf("Expected Patient to be listed")
+	}
+	profiles := patient["supportedProfile"].([]interface{})
+	if len(profiles) != 1 || profiles[0] != patientProfile {
+		t.Errorf("supportedProfile = %v", profiles)
+	}
+	if patient["documentation"] == nil {
+		t.Errorf("Expected Patient rules to be documented")
+	}
+}
+
+func TestStatement_MergesUpstream(t *testing.T) {
+	load(t)
+	var upstream map[string]interface{}
+	if err := json.Unmarshal([]byte(`{
+		"resourceType": "CapabilityStatement",
+		"id": "upstream",
+		"fhirVersion": "4.0.1",
+		"format": ["xml", "json"],
+		"software": {"name": "HAPI FHIR"},
+		"rest": [{
+			"mode": "server",
+			"resource": [
+				{"type": "Patient", "supportedProfile": ["http://example.org/Patient"]},
+				{"type": "Observation"}
+			],
+			"operation": [{"name": "validate", "definition": "http://example.org/validate"}]
+		}]
+	}`), &upstream); err != nil {
+		t.Fatal(err)
+	}
+
+	cs := Statement(upstream, time.Now())
+	if _, ok := cs["id"]; ok {
+		t.Errorf("Expected upstream id to be dropped")
+	}
+	if formats := cs["format"].([]string); len(formats) != 2 || formats[0] != "application/fhir+json" {
+		t.Errorf("format = %v", formats)
+	}
+	if name := cs["software"].(map[string]interface{})["name"]; name != "FHIR Validation Proxy for HAPI FHIR" {
+		t.Errorf("software.name = %v", name)
+	}
+
+	byType := resources(t, cs)
+	if len(byType) != 2 {
+		t.Errorf("Expected only the upstream's resource types, got %v", byType)
+	}
+	profiles := byType["Patient"]["supportedProfile"].([]interface{})
+	if len(profiles) != 2 || profiles[0] != "http://example.org/Patient" || profiles[1] != patientProfile {
+		t.Errorf("supportedProfile = %v", profiles)
+	}
+	rest := cs["rest"].([]interface{})[0].(map[string]interface{})
+	if ops := rest["operation"].([]interface{}); len(ops) != 1 {
+		t.Errorf("Expected the upstream's validate operation to be kept, got %v", ops)
+	}
+}
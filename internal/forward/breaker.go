@@ -0,0 +1,133 @@
+package forward
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the state of an upstream's circuit breaker.
+type State string
+
+const (
+	// StateClosed means requests are sent to the upstream.
+	StateClosed State = "closed"
+	// StateOpen means the upstream has failed repeatedly and is skipped
+	// until the cooldown has passed.
+	StateOpen State = "open"
+	// StateHalfOpen means the cooldown has passed and a single trial
+	// request decides whether the circuit closes again.
+	StateHalfOpen State = "half-open"
+)
+
+// breaker is a consecutive-failure circuit breaker for one upstream.
+type breaker struct {
+	mu        sync.Mutex
+	state     State
+	failures  int
+	openedAt  time.Time
+	trial     bool
+	lastError string
+}
+
+func newBreaker() *breaker {
+	return &breaker{state: StateClosed}
+}
+
+// allow reports whether a request may be sent now. After cooldown an open
+// breaker lets one trial request through.
+func (b *breaker) allow(now time.Time, cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case StateOpen:
+		if now.Sub(b.openedAt) < cooldown {
+			return false
+		}
+		b.state = StateHalfOpen
+	case StateHalfOpen:
+		if b.trial {
+			return false
+		}
+	}
+	if b.state == StateHalfOpen {
+		b.trial = true
+	}
+	return true
+}
+
+// success closes the breaker.
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = StateClosed
+	b.failures = 0
+	b.trial = false
+}
+
+// failure records a failed request and opens the breaker after threshold
+// consecutive failures, or at once if it was a trial request.
+func (b *breaker) failure(now time.Time, threshold int, message string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastError = message
+	if b.state == StateHalfOpen || b.failures >= threshold {
+		b.state = StateOpen
+		b.openedAt = now
+	}
+	b.trial = false
+}
+
+// release ends a request that neither succeeded nor failed, such as one
+// cancelled by the client.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// remaining returns how long until an open breaker allows a trial request.
+func (b *breaker) remaining(now time.Time, cooldown time.Duration) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != StateOpen {
+		return 0
+	}
+	if d := cooldown - now.Sub(b.openedAt); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// UpstreamStatus describes an upstream and its circuit breaker.
+type UpstreamStatus struct {
+	URL                 string     `json:"url"`
+	State               State      `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+}
+
+// open reports whether the breaker is open and its cooldown has not yet
+// passed, so no request would be sent.
+func (b *breaker) open(now time.Time, cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == StateOpen && now.Sub(b.openedAt) < cooldown
+}
+
+func (b *breaker) status(url string) UpstreamStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := UpstreamStatus{
+		URL:                 url,
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		LastError:           b.lastError,
+	}
+	if b.state != StateClosed {
+		opened := b.openedAt.UTC()
+		s.OpenedAt = &opened
+	}
+	return s
+}
@@ -0,0 +1,478 @@
+// Package forward sends validated requests to an upstream FHIR server with
+// reverse-proxy semantics: the method, path and query are kept, end-to-end
+// headers are passed through in both directions and the upstream response
+// is streamed back to the client.
+//
+// Upstreams are tried in order. Each has a circuit breaker, so an upstream
+// that keeps failing is skipped until its cooldown has passed. Idempotent
+// requests are retried with exponential backoff.
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"fhir-validation-proxy/internal/metrics"
+	"fhir-validation-proxy/internal/trace"
+)
+
+// Defaults used by New.
+const (
+	// DefaultTimeout bounds an upstream exchange, including reading the
+	// response body.
+	DefaultTimeout    = 30 * time.Second
+	DefaultRetries    = 2
+	DefaultBackoff    = 200 * time.Millisecond
+	DefaultMaxBackoff = 5 * time.Second
+	DefaultThreshold  = 5
+	DefaultCooldown   = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned when every upstream's circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit open for all upstreams")
+
+// hopHeaders are meaningful only for a single connection and are never
+// forwarded (RFC 9110, section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Forwarder forwards requests to an ordered list of upstream FHIR servers.
+type Forwarder struct {
+	Client *http.Client
+	// Retries is how many times an idempotent request is retried after the
+	// first attempt fails.
+	Retries int
+	// Backoff is the delay before the first retry. It doubles for each
+	// further retry, up to MaxBackoff, with jitter.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Threshold is the number of consecutive failures that opens an
+	// upstream's circuit breaker.
+	Threshold int
+	// Cooldown is how long an open circuit breaker skips its upstream.
+	Cooldown time.Duration
+	// Authorization, if set, is sent as the Authorization header of every
+	// upstream request, in place of the client's. It is the credential for
+	// upstreams that authenticate the proxy, and the only one requests
+	// replayed from the queue have.
+	Authorization string
+	// StripAuthorization removes the client's Authorization header when
+	// Authorization is not set. It is for proxies that verify bearer
+	// tokens themselves: those tokens were issued for the proxy, not for
+	// the upstream, and must not be replayed to it.
+	StripAuthorization bool
+
+	upstreams []*upstream
+}
+
+type upstream struct {
+	url     *url.URL
+	breaker *breaker
+}
+
+// New returns a Forwarder for upstreams, in failover order, whose exchanges
+// time out after timeout, or DefaultTimeout if timeout is not positive.
+func New(timeout time.Duration, upstreams ...*url.URL) *Forwarder {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	f := &Forwarder{
+		Client:     &http.Client{Timeout: timeout},
+		Retries:    DefaultRetries,
+		Backoff:    DefaultBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+		Threshold:  DefaultThreshold,
+		Cooldown:   DefaultCooldown,
+	}
+	for _, u := range upstreams {
+		f.upstreams = append(f.upstreams, &upstream{url: u, breaker: newBreaker()})
+	}
+	return f
+}
+
+// Do sends a request upstream with the method and headers of in. path is
+// appended to the upstream path, and the query of in is added to the
+// upstream query. body is called for a fresh reader on every attempt. The
+// caller must close the response body.
+//
+// A request is sent to the first upstream whose circuit breaker allows it.
+// A connection failure or a 502, 503 or 504 response fails over to the next
+// upstream; for requests that are not idempotent this happens only if the
+// request was never sent. Idempotent requests are then retried. If every
+// circuit breaker is open Do returns ErrCircuitOpen.
+func (f *Forwarder) Do(ctx context.Context, in *http.Request, path string, body func() (io.Reader, error), size int64) (*http.Response, error) {
+	ctx, span := trace.Start(ctx, "forward", trace.KindInternal)
+	defer span.End()
+	resp, err := f.do(ctx, in, path, body, size)
+	if err != nil {
+		span.SetError(err)
+	} else {
+		span.SetAttributes(trace.Int("http.response.status_code", resp.StatusCode))
+	}
+	return resp, err
+}
+
+func (f *Forwarder) do(ctx context.Context, in *http.Request, path string, body func() (io.Reader, error), size int64) (*http.Response, error) {
+	retries := 0
+	if idempotent(in) {
+		retries = f.Retries
+	}
+
+	var lastResp *http.Response
+	lastErr := ErrCircuitOpen
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, f.backoff(attempt)); err != nil {
+				break
+			}
+		}
+		for _, u := range f.upstreams {
+			if !u.breaker.allow(time.Now(), f.Cooldown) {
+				continue
+			}
+			if lastResp != nil {
+				discard(lastResp)
+				lastResp = nil
+			}
+
+			resp, err := f.send(ctx, u.url, in, path, body, size, attempt)
+			if ctx.Err() != nil {
+				u.breaker.release()
+				return resp, err
+			}
+			if err == nil && !unavailable(resp.StatusCode) {
+				u.breaker.success()
+				return resp, nil
+			}
+
+			message := ""
+			if err != nil {
+				message = err.Error()
+			} else {
+				message = fmt.Sprintf("upstream returned %d", resp.StatusCode)
+			}
+			u.breaker.failure(time.Now(), f.Threshold, message)
+			lastResp, lastErr = resp, err
+			if retries == 0 && !notSent(err) {
+				return resp, err
+			}
+		}
+	}
+	if lastResp != nil {
+		return lastResp, nil
+	}
+	return nil, lastErr
+}
+
+// send makes one request to the upstream at base; attempt counts the
+// retries before it.
+func (f *Forwarder) send(ctx context.Context, base *url.URL, in *http.Request, path string, body func() (io.Reader, error), size int64, attempt int) (*http.Response, error) {
+	ctx, span := trace.Start(ctx, in.Method, trace.KindClient)
+	defer span.End()
+	span.SetAttributes(
+		trace.String("http.request.method", in.Method),
+		trace.String("server.address", base.Host),
+		trace.String("url.path", joinPath(base.Path, path)),
+	)
+	if attempt > 0 {
+		span.SetAttributes(trace.Int("http.request.resend_count", attempt))
+	}
+
+	reader, err := body()
+	if err != nil {
+		return nil, err
+	}
+	out, err := http.NewRequestWithContext(ctx, in.Method, target(base, in, path), reader)
+	if err != nil {
+		return nil, err
+	}
+	out.ContentLength = size
+	out.Header = in.Header.Clone()
+	if out.Header == nil {
+		out.Header = http.Header{}
+	}
+	RemoveHopHeaders(out.Header)
+	out.Header.Del("Content-Length")
+	if f.Authorization != "" {
+		out.Header.Set("Authorization", f.Authorization)
+	} else if f.StripAuthorization {
+		out.Header.Del("Authorization")
+	}
+	if size != 0 && out.Header.Get("Content-Type") == "" {
+		out.Header.Set("Content-Type", "application/fhir+json")
+	}
+	setForwardedHeaders(out.Header, in)
+	trace.Inject(ctx, out.Header)
+
+	start := time.Now()
+	resp, err := f.client().Do(out)
+	metrics.UpstreamDuration.Observe(metrics.Since(start), base.Host)
+	switch {
+	case err != nil && ctx.Err() == nil:
+		metrics.UpstreamErrors.Inc(base.Host, failureReason(err))
+	case err == nil && unavailable(resp.StatusCode):
+		metrics.UpstreamErrors.Inc(base.Host, strconv.Itoa(resp.StatusCode))
+	}
+	if err != nil {
+		span.SetError(err)
+	} else {
+		span.SetAttributes(trace.Int("http.response.status_code", resp.StatusCode))
+		if resp.StatusCode >= 500 {
+			span.SetErrorMessage(resp.Status)
+		}
+	}
+	return resp, err
+}
+
+// Target returns the URL a request would be sent to on the first upstream,
+// or "" if there is none.
+func (f *Forwarder) Target(in *http.Request, path string) string {
+	if len(f.upstreams) == 0 {
+		return ""
+	}
+	return target(f.upstreams[0].url, in, path)
+}
+
+func target(base *url.URL, in *http.Request, path string) string {
+	u := *base
+	u.Path = joinPath(base.Path, path)
+	u.RawPath = ""
+	u.RawQuery = joinQuery(base.RawQuery, in.URL.RawQuery)
+	return u.String()
+}
+
+// Status returns the state of each upstream, in failover order.
+func (f *Forwarder) Status() []UpstreamStatus {
+	status := make([]UpstreamStatus, 0, len(f.upstreams))
+	for _, u := range f.upstreams {
+		status = append(status, u.breaker.status(u.url.String()))
+	}
+	return status
+}
+
+// RetryAfter returns how long until some upstream's circuit breaker allows
+// a request again, or 0 if one allows requests now.
+func (f *Forwarder) RetryAfter() time.Duration {
+	var wait time.Duration
+	for i, u := range f.upstreams {
+		d := u.breaker.remaining(time.Now(), f.Cooldown)
+		if i == 0 || d < wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// backoff returns the delay before the given retry.
+func (f *Forwarder) backoff(retry int) time.Duration {
+	d := f.backoffCeiling(retry)
+	if d <= 0 {
+		return 0
+	}
+	// #nosec G404 -- jitter does not need a secure source
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// MaxDuration returns the longest Do can take to return a response: every
+// attempt at every upstream timing out, with the longest backoff between
+// attempts. It is zero if exchanges have no timeout.
+func (f *Forwarder) MaxDuration() time.Duration {
+	timeout := f.client().Timeout
+	if timeout <= 0 {
+		return 0
+	}
+	d := time.Duration(f.Retries+1) * time.Duration(len(f.upstreams)) * timeout
+	for retry := 1; retry <= f.Retries; retry++ {
+		d += f.backoffCeiling(retry)
+	}
+	return d
+}
+
+// backoffCeiling returns the delay before a retry, before jitter.
+func (f *Forwarder) backoffCeiling(retry int) time.Duration {
+	d := f.Backoff
+	for i := 1; i < retry && d < f.MaxBackoff; i++ {
+		d *= 2
+	}
+	if f.MaxBackoff > 0 && d > f.MaxBackoff {
+		d = f.MaxBackoff
+	}
+	return d
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Undelivered reports whether a result of Do shows that the upstream never
+// accepted the request, so it is safe to send it again later.
+func Undelivered(resp *http.Response, err error) bool {
+	if err != nil {
+		return errors.Is(err, ErrCircuitOpen) || notSent(err)
+	}
+	return resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// idempotent reports whether a request may safely be sent more than once:
+// reads, updates guarded by If-Match and conditional creates.
+func idempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPut:
+		return r.Header.Get("If-Match") != ""
+	case http.MethodPost:
+		return r.Header.Get("If-None-Exist") != ""
+	}
+	return false
+}
+
+// unavailable reports whether a status means the upstream could not handle
+// the request, rather than that it rejected it.
+func unavailable(status int) bool {
+	return status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+}
+
+// failureReason returns the metrics label for an error sending a request:
+// timeout or transport.
+func failureReason(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "transport"
+}
+
+// notSent reports whether err shows the request never reached the upstream.
+func notSent(err error) bool {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) || (errors.As(err, &opErr) && opErr.Op == "dial")
+}
+
+func discard(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
+
+func (f *Forwarder) client() *http.Client {
+	if f.Client != nil {
+		return f.Client
+	}
+	return http.DefaultClient
+}
+
+// CopyResponse writes the status, end-to-end headers and body of resp to w,
+// flushing as the body arrives.
+func CopyResponse(w http.ResponseWriter, resp *http.Response) error {
+	header := resp.Header.Clone()
+	RemoveHopHeaders(header)
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		_, err := io.Copy(w, resp.Body)
+		return err
+	}
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// RemoveHopHeaders deletes hop-by-hop headers from h, including any named
+// in its Connection header.
+func RemoveHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// setForwardedHeaders records the client address, host and scheme of in.
+func setForwardedHeaders(h http.Header, in *http.Request) {
+	if ip, _, err := net.SplitHostPort(in.RemoteAddr); err == nil {
+		if prior := h.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		h.Set("X-Forwarded-For", ip)
+	}
+	if h.Get("X-Forwarded-Host") == "" && in.Host != "" {
+		h.Set("X-Forwarded-Host", in.Host)
+	}
+	if h.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if in.TLS != nil {
+			proto = "https"
+		}
+		h.Set("X-Forwarded-Proto", proto)
+	}
+}
+
+func joinPath(base, path string) string {
+	switch {
+	case path == "" || path == "/":
+		if base == "" {
+			return path
+		}
+		return base
+	case base == "":
+		return path
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+func joinQuery(base, query string) string {
+	if base == "" || query == "" {
+		return base + query
+	}
+	return base + "&" + query
+}
@@ -0,0 +1,212 @@
+package forward
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flaky returns a server that answers 503 to the first failures requests.
+func flaky(failures int32, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(calls, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func do(t *testing.T, f *Forwarder, method string, header http.Header) (*http.Response, error) {
+	t.Helper()
+	in := httptest.NewRequest(method, "/fhir/Patient/1", nil)
+	for k, v := range header {
+		in.Header[k] = v
+	}
+	const resource = `{"resourceType": "Patient"}`
+	body := func() (io.Reader, error) { return strings.NewReader(resource), nil }
+	resp, err := f.Do(in.Context(), in, "/Patient/1", body, int64(len(resource)))
+	if resp != nil {
+		discard(resp)
+	}
+	return resp, err
+}
+
+func mustParse(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestForwarder_RetriesIdempotentRequests(t *testing.T) {
+	var calls int32
+	server := flaky(2, &calls)
+	defer server.Close()
+
+	f := New(time.Second, mustParse(t, server.URL))
+	f.Backoff = time.Millisecond
+
+	resp, err := do(t, f, http.MethodPut, http.Header{"If-Match": {`W/"1"`}})
+	if err != nil || resp.StatusCode != http.StatusOK || calls != 3 {
+		t.Fatalf("Expected 200 after 3 calls, got %v, %v after %d calls", resp, err, calls)
+	}
+
+	calls = 0
+	resp, err = do(t, f, http.MethodPost, nil)
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable || calls != 1 {
+		t.Fatalf("Expected a plain POST to be sent once, got %v, %v after %d calls", resp, err, calls)
+	}
+}
+
+func TestForwarder_FailsOver(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := mustParse(t, down.URL)
+	down.Close()
+
+	var calls int32
+	backup := flaky(0, &calls)
+	defer backup.Close()
+
+	f := New(time.Second, downURL, mustParse(t, backup.URL))
+	resp, err := do(t, f, http.MethodPost, nil)
+	if err != nil || resp.StatusCode != http.StatusOK || calls != 1 {
+		t.Fatalf("Expected failover to the backup, got %v, %v after %d calls", resp, err, calls)
+	}
+	if status := f.Status(); status[0].ConsecutiveFailures != 1 || status[1].State != StateClosed {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
+
+func TestForwarder_CircuitBreaker(t *testing.T) {
+	var calls int32
+	server := flaky(1, &calls)
+	defer server.Close()
+
+	f := New(time.Second, mustParse(t, server.URL))
+	f.Threshold = 1
+	f.Cooldown = 20 * time.Millisecond
+
+	if resp, err := do(t, f, http.MethodPost, nil); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 from upstream, got %v, %v", resp, err)
+	}
+	if status := f.Status(); status[0].State != StateOpen || status[0].OpenedAt == nil {
+		t.Fatalf("Expected open circuit, got %+v", status)
+	}
+	if _, err := do(t, f, http.MethodPost, nil); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected ErrCircuitOpen, got %v", err)
+	}
+	if f.RetryAfter() <= 0 || calls != 1 {
+		t.Errorf("Expected upstream to be skipped while open, RetryAfter %v, calls %d", f.RetryAfter(), calls)
+	}
+
+	time.Sleep(f.Cooldown)
+	resp, err := do(t, f, http.MethodPost, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected trial request to succeed, got %v, %v", resp, err)
+	}
+	if status := f.Status(); status[0].State != StateClosed {
+		t.Errorf("Expected circuit to close, got %+v", status)
+	}
+}
+
+func TestForwarder_MaxDuration(t *testing.T) {
+	f := New(time.Second, mustParse(t, "http://a.example"), mustParse(t, "http://b.example"))
+	f.Backoff, f.MaxBackoff = 300*time.Millisecond, 500*time.Millisecond
+	// 3 attempts at 2 upstreams, then backoffs of 300ms and 500ms
+	if got, want := f.MaxDuration(), 6800*time.Millisecond; got != want {
+		t.Errorf("MaxDuration() = %v, want %v", got, want)
+	}
+}
+
+func TestForwarder_Authorization(t *testing.T) {
+	var got atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.Store(r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+
+	cases := []struct {
+		name          string
+		authorization string
+		strip         bool
+		want          string
+	}{
+		{"passed through", "", false, "Bearer client"},
+		{"stripped", "", true, ""},
+		{"replaced", "Bearer service", true, "Bearer service"},
+	}
+	for _, c := range cases {
+		f := New(time.Second, mustParse(t, upstream.URL))
+		f.Authorization, f.StripAuthorization = c.authorization, c.strip
+		if _, err := do(t, f, http.MethodPut, http.Header{"Authorization": {"Bearer client"}}); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got.Load() != c.want {
+			t.Errorf("%s: upstream got Authorization %q, want %q", c.name, got.Load(), c.want)
+		}
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "keep-alive, X-Hop")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("X-Hop", "1")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("ETag", `W/"1"`)
+
+	RemoveHopHeaders(h)
+
+	if len(h) != 1 || h.Get("ETag") != `W/"1"` {
+		t.Errorf("Expected only ETag to remain, got %v", h)
+	}
+}
+
+func TestJoinPath(t *testing.T) {
+	cases := []struct{ base, path, want string }{
+		{"/fhir", "", "/fhir"},
+		{"/fhir/", "/Patient/1", "/fhir/Patient/1"},
+		{"", "/Patient", "/Patient"},
+		{"/fhir", "/", "/fhir"},
+	}
+	for _, c := range cases {
+		if got := joinPath(c.base, c.path); got != c.want {
+			t.Errorf("joinPath(%q, %q) = %q, want %q", c.base, c.path, got, c.want)
+		}
+	}
+}
+
+func TestCopyResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(strings.Repeat("x", 100<<10)))
+	}))
+	defer upstream.Close()
+
+	resp, err := http.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	rw := httptest.NewRecorder()
+	if err := CopyResponse(rw, resp); err != nil {
+		t.Fatalf("CopyResponse() error = %v", err)
+	}
+	if rw.Code != http.StatusCreated || rw.Body.Len() != 100<<10 || !rw.Flushed {
+		t.Errorf("Unexpected copy: status %d, %d bytes, flushed %v", rw.Code, rw.Body.Len(), rw.Flushed)
+	}
+	if rw.Header().Get("Last-Modified") == "" {
+		t.Errorf("Expected Last-Modified to be copied")
+	}
+}
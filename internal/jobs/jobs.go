@@ -0,0 +1,215 @@
+// Package jobs runs validation requests in the background for FHIR
+// asynchronous request handling (Prefer: respond-async).
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Status is the state of an async job.
+type Status string
+
+const (
+	// StatusInProgress means the job is still running.
+	StatusInProgress Status = "in-progress"
+	// StatusComplete means the job has finished and holds its response.
+	StatusComplete Status = "complete"
+	// StatusFailed means the job stopped without a response, because the
+	// proxy restarted while it was running.
+	StatusFailed Status = "failed"
+)
+
+// DefaultTTL is how long jobs are kept after they are created.
+const DefaultTTL = 24 * time.Hour
+
+// DefaultPruneInterval is how often expired jobs are removed.
+const DefaultPruneInterval = 10 * time.Minute
+
+// Job is a background request and, once it has finished, its response.
+type Job struct {
+	ID     string `json:"id"`
+	Status Status `json:"status"`
+	// Client is the ID of the client that started the job, or "" if
+	// clients are not identified.
+	Client   string    `json:"client,omitempty"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	Response *Response `json:"response,omitempty"`
+}
+
+// Response is the final HTTP response of a job, returned when it is polled.
+type Response struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+}
+
+// Manager starts jobs and records them in a Store.
+type Manager struct {
+	store Store
+	// TTL is how long a job is kept after it is created.
+	TTL time.Duration
+	// PruneInterval is how often jobs older than TTL are removed. Pruning
+	// starts with the first job and stops when the Manager is drained.
+	// Values of zero or less use DefaultPruneInterval.
+	PruneInterval time.Duration
+
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+	wg      sync.WaitGroup
+
+	pruneOnce sync.Once
+	stopOnce  sync.Once
+	stop      chan struct{}
+}
+
+// NewManager returns a Manager that keeps jobs in store.
+func NewManager(store Store) *Manager {
+	return &Manager{
+		store:         store,
+		TTL:           DefaultTTL,
+		PruneInterval: DefaultPruneInterval,
+		cancels:       map[string]context.CancelFunc{},
+		stop:          make(chan struct{}),
+	}
+}
+
+// Start records a new in-progress job for client and runs fn in the
+// background. The response fn returns is stored with the job when it
+// completes.
+func (m *Manager) Start(client string, fn func(ctx context.Context) *Response) (*Job, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	m.pruneOnce.Do(func() {
+		interval := m.PruneInterval
+		if interval <= 0 {
+			interval = DefaultPruneInterval
+		}
+		go m.prune(m.TTL, interval)
+	})
+
+	now := time.Now().UTC()
+	job := &Job{ID: id, Status: StatusInProgress, Client: client, Created: now, Updated: now}
+	if err := m.store.Put(job); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), idKey{}, id))
+	m.mu.Lock()
+	m.cancels[id] = cancel
+	m.mu.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		resp := fn(ctx)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if _, running := m.cancels[id]; !running {
+			// Cancelled while running; the job has already been deleted.
+			return
+		}
+		delete(m.cancels, id)
+		cancel()
+
+		done := *job
+		done.Status = StatusComplete
+		done.Updated = time.Now().UTC()
+		done.Response = resp
+		if err := m.store.Put(&done); err != nil {
+			slog.Error("Failed to store job result", "job", id, "error", err)
+		}
+	}()
+
+	return job, nil
+}
+
+// prune removes jobs older than ttl every interval until the Manager is
+// drained.
+func (m *Manager) prune(ttl, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := m.store.DeleteBefore(time.Now().UTC().Add(-ttl)); err != nil {
+			slog.Warn("Failed to prune expired jobs", "error", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Get returns the job with the given id, or ErrNotFound.
+func (m *Manager) Get(id string) (*Job, error) {
+	return m.store.Get(id)
+}
+
+// Cancel stops a running job and deletes it, or deletes a completed one.
+func (m *Manager) Cancel(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cancel, running := m.cancels[id]; running {
+		cancel()
+		delete(m.cancels, id)
+	}
+	return m.store.Delete(id)
+}
+
+type idKey struct{}
+
+// ID returns the ID of the job whose context ctx is, or "".
+func ID(ctx context.Context) string {
+	id, _ := ctx.Value(idKey{}).(string)
+	return id
+}
+
+// Wait blocks until every job started so far has finished.
+func (m *Manager) Wait() {
+	m.wg.Wait()
+}
+
+// Drain stops pruning expired jobs and waits for every job started so far
+// to finish, as Wait does, until ctx is done. Jobs still running then are
+// cancelled, so they complete with whatever response they make when their
+// context is done, and Drain returns the context's error.
+func (m *Manager) Drain(ctx context.Context) error {
+	m.stopOnce.Do(func() { close(m.stop) })
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, cancel := range m.cancels {
+		cancel()
+	}
+	return ctx.Err()
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,189 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStores(t *testing.T) {
+	fileStore, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "file": fileStore} {
+		t.Run(name, func(t *testing.T) {
+			old := &Job{ID: "old", Status: StatusComplete, Created: time.Now().Add(-time.Hour)}
+			job := &Job{
+				ID:       "abc123",
+				Status:   StatusComplete,
+				Created:  time.Now(),
+				Response: &Response{StatusCode: http.StatusCreated, Body: []byte(`{"resourceType":"Patient"}`)},
+			}
+			for _, j := range []*Job{old, job} {
+				if err := store.Put(j); err != nil {
+					t.Fatalf("Put() error = %v", err)
+				}
+			}
+
+			got, err := store.Get("abc123")
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if got.Response == nil || got.Response.StatusCode != http.StatusCreated || string(got.Response.Body) != `{"resourceType":"Patient"}` {
+				t.Errorf("Get() = %+v, want stored response", got)
+			}
+
+			if err := store.DeleteBefore(time.Now().Add(-time.Minute)); err != nil {
+				t.Fatalf("DeleteBefore() error = %v", err)
+			}
+			if _, err := store.Get("old"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(old) error = %v, want ErrNotFound", err)
+			}
+
+			if err := store.Delete("abc123"); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			if err := store.Delete("abc123"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("second Delete() error = %v, want ErrNotFound", err)
+			}
+			if _, err := store.Get("../etc/passwd"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(traversal) error = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestFileStore_FailInProgress(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	for _, j := range []*Job{
+		{ID: "running", Status: StatusInProgress, Created: time.Now()},
+		{ID: "done", Status: StatusComplete, Created: time.Now(), Response: &Response{StatusCode: http.StatusOK}},
+	} {
+		if err := store.Put(j); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+
+	n, err := store.FailInProgress()
+	if err != nil || n != 1 {
+		t.Fatalf("FailInProgress() = %d, %v, want 1, nil", n, err)
+	}
+	for id, want := range map[string]Status{"running": StatusFailed, "done": StatusComplete} {
+		if got, _ := store.Get(id); got.Status != want {
+			t.Errorf("job %s status = %s, want %s", id, got.Status, want)
+		}
+	}
+}
+
+func TestManager(t *testing.T) {
+	t.Run("completes", func(t *testing.T) {
+		m := NewManager(NewMemoryStore())
+		release := make(chan struct{})
+		job, err := m.Start("", func(ctx context.Context) *Response {
+			<-release
+			return &Response{StatusCode: http.StatusOK}
+		})
+		if err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+
+		got, _ := m.Get(job.ID)
+		if got.Status != StatusInProgress {
+			t.Errorf("status = %s, want %s", got.Status, StatusInProgress)
+		}
+
+		close(release)
+		m.Wait()
+		got, _ = m.Get(job.ID)
+		if got.Status != StatusComplete || got.Response.StatusCode != http.StatusOK {
+			t.Errorf("job = %+v, want complete with 200", got)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		m := NewManager(NewMemoryStore())
+		job, err := m.Start("", func(ctx context.Context) *Response {
+			<-ctx.Done()
+			return &Response{StatusCode: http.StatusOK}
+		})
+		if err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		if err := m.Cancel(job.ID); err != nil {
+			t.Fatalf("Cancel() error = %v", err)
+		}
+		m.Wait()
+		if _, err := m.Get(job.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get() after cancel error = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("prunes expired jobs", func(t *testing.T) {
+		m := NewManager(NewMemoryStore())
+		m.TTL, m.PruneInterval = time.Millisecond, time.Millisecond
+		job, err := m.Start("", func(ctx context.Context) *Response {
+			return &Response{StatusCode: http.StatusOK}
+		})
+		if err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		m.Wait()
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			if _, err := m.Get(job.ID); errors.Is(err, ErrNotFound) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("Expected the expired job to be pruned")
+			}
+		}
+		if err := m.Drain(context.Background()); err != nil {
+			t.Fatalf("Drain() error = %v", err)
+		}
+	})
+
+	t.Run("defaults prune interval", func(t *testing.T) {
+		m := NewManager(NewMemoryStore())
+		m.PruneInterval = 0
+		if _, err := m.Start("", func(ctx context.Context) *Response {
+			return &Response{StatusCode: http.StatusOK}
+		}); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		if err := m.Drain(context.Background()); err != nil {
+			t.Fatalf("Drain() error = %v", err)
+		}
+	})
+
+	t.Run("drain", func(t *testing.T) {
+		m := NewManager(NewMemoryStore())
+		quick, _ := m.Start("", func(ctx context.Context) *Response {
+			return &Response{StatusCode: http.StatusOK}
+		})
+		if err := m.Drain(context.Background()); err != nil {
+			t.Fatalf("Drain() error = %v", err)
+		}
+
+		slow, _ := m.Start("", func(ctx context.Context) *Response {
+			<-ctx.Done()
+			return &Response{StatusCode: http.StatusServiceUnavailable}
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := m.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Drain() error = %v, want DeadlineExceeded", err)
+		}
+		m.Wait()
+		for id, want := range map[string]int{quick.ID: http.StatusOK, slow.ID: http.StatusServiceUnavailable} {
+			if got, _ := m.Get(id); got.Status != StatusComplete || got.Response.StatusCode != want {
+				t.Errorf("job = %+v, want complete with %d", got, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for a job id that is not in the store.
+var ErrNotFound = errors.New("job not found")
+
+// Store persists async jobs.
+type Store interface {
+	// Put creates or replaces a job.
+	Put(job *Job) error
+	// Get returns a job by id, or ErrNotFound.
+	Get(id string) (*Job, error)
+	// Delete removes a job, or returns ErrNotFound.
+	Delete(id string) error
+	// DeleteBefore removes every job created before t.
+	DeleteBefore(t time.Time) error
+}
+
+// MemoryStore keeps jobs in memory. Jobs are lost when the process exits.
+type MemoryStore struct {
+	mu   sync.Mutex
+	jobs map[string]Job
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{jobs: map[string]Job{}}
+}
+
+// Put creates or replaces a job.
+func (s *MemoryStore) Put(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = *job
+	return nil
+}
+
+// Get returns a job by id, or ErrNotFound.
+func (s *MemoryStore) Get(id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &job, nil
+}
+
+// Delete removes a job, or returns ErrNotFound.
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.jobs, id)
+	return nil
+}
+
+// DeleteBefore removes every job created before t.
+func (s *MemoryStore) DeleteBefore(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, job := range s.jobs {
+		if job.Created.Before(t) {
+			delete(s.jobs, id)
+		}
+	}
+	return nil
+}
+
+// FileStore keeps each job as a JSON file in a directory, so jobs survive
+// a restart of the proxy.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a FileStore in dir, creating the directory if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", ErrNotFound
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+// Put creates or replaces a job.
+func (s *FileStore) Put(job *Job) error {
+	path, err := s.path(job.ID)
+	if err != nil {
+		return fmt.Errorf("invalid job id %q", job.ID)
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".job-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get returns a job by id, or ErrNotFound.
+func (s *FileStore) Get(id string) (*Job, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	// #nosec G304 -- path is built from a validated job id inside the store directory
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("error parsing job %s: %w", id, err)
+	}
+	return &job, nil
+}
+
+// Delete removes a job, or returns ErrNotFound.
+func (s *FileStore) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// DeleteBefore removes every job created before t.
+func (s *FileStore) DeleteBefore(t time.Time) error {
+	return s.each(func(path string, job *Job) error {
+		if !job.Created.Before(t) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	})
+}
+
+// FailInProgress marks every in-progress job failed and returns how many
+// there were. Jobs run in the process that started them, so an in-progress
+// job found when the proxy starts will never complete. Call it before the
+// store is given to a Manager.
+func (s *FileStore) FailInProgress() (int, error) {
+	failed := 0
+	err := s.each(func(_ string, job *Job) error {
+		if job.Status != StatusInProgress {
+			return nil
+		}
+		job.Status = StatusFailed
+		job.Updated = time.Now().UTC()
+		if err := s.Put(job); err != nil {
+			return err
+		}
+		failed++
+		return nil
+	})
+	return failed, err
+}
+
+// each calls fn with the path and contents of every job in the store.
+func (s *FileStore) each(fn func(path string, job *Job) error) error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		job, err := s.Get(strings.TrimSuffix(filepath.Base(f), ".json"))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(f, job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	const patient = `{"resourceType":"Patient","active":true,"name":[{"family":"Smith","given":["Ann"]}]}`
+
+	tests := []struct {
+		name    string
+		patch   string
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "add and replace",
+			patch: `[{"op":"add","path":"/gender","value":"female"},{"op":"replace","path":"/active","value":false}]`,
+			want:  `{"resourceType":"Patient","active":false,"gender":"female","name":[{"family":"Smith","given":["Ann"]}]}`,
+		},
+		{
+			name:  "array insert and append",
+			patch: `[{"op":"add","path":"/name/0/given/0","value":"Jo"},{"op":"add","path":"/name/0/given/-","value":"Lee"}]`,
+			want:  `{"resourceType":"Patient","active":true,"name":[{"family":"Smith","given":["Jo","Ann","Lee"]}]}`,
+		},
+		{
+			name:  "remove, copy and move",
+			patch: `[{"op":"copy","from":"/name/0","path":"/name/-"},{"op":"move","from":"/active","path":"/name/1/active"},{"op":"remove","path":"/name/0/given"}]`,
+			want:  `{"resourceType":"Patient","name":[{"family":"Smith"},{"active":true,"family":"Smith","given":["Ann"]}]}`,
+		},
+		{
+			name:  "test passes",
+			patch: `[{"op":"test","path":"/name/0/family","value":"Smith"}]`,
+			want:  patient,
+		},
+		{
+			name:    "test fails",
+			patch:   `[{"op":"test","path":"/active","value":false}]`,
+			wantErr: "test failed",
+		},
+		{
+			name:    "missing target",
+			patch:   `[{"op":"replace","path":"/gender","value":"male"}]`,
+			wantErr: `"gender" not found`,
+		},
+		{
+			name:    "index out of range",
+			patch:   `[{"op":"remove","path":"/name/3"}]`,
+			wantErr: "out of range",
+		},
+		{
+			name:    "missing value",
+			patch:   `[{"op":"add","path":"/gender"}]`,
+			wantErr: "missing value",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc interface{}
+			if err := json.Unmarshal([]byte(patient), &doc); err != nil {
+				t.Fatal(err)
+			}
+			ops, err := Decode(strings.NewReader(tt.patch))
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+
+			got, err := Apply(doc, ops)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Apply() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			var want interface{}
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("Apply() = %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
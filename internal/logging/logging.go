@@ -0,0 +1,114 @@
+// Package logging sets up the proxy's structured JSON logs. Every record
+// logged with a request's context carries its request ID, and patient data
+// is kept out of the logs unless ShowPHI is set.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// RequestIDHeader carries the ID of a request, from the client or generated
+// by the proxy, and is passed upstream.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds request IDs accepted from clients.
+const maxRequestIDLength = 128
+
+// Redacted replaces patient data in logs.
+const Redacted = "[redacted]"
+
+// ShowPHI logs values that may hold patient data, such as query strings
+// and issue diagnostics, instead of redacting them.
+var ShowPHI bool
+
+// PHI returns an attribute for a value that may hold patient data: the
+// value if ShowPHI is set, and Redacted otherwise.
+func PHI(key string, value interface{}) slog.Attr {
+	if !ShowPHI {
+		return slog.String(key, Redacted)
+	}
+	return slog.Any(key, value)
+}
+
+// RedactPHI returns s if ShowPHI is set, and Redacted otherwise.
+func RedactPHI(s string) string {
+	if !ShowPHI {
+		return Redacted
+	}
+	return s
+}
+
+// New returns a logger writing JSON lines to w at level and above.
+func New(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(contextHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})})
+}
+
+// ParseLevel returns the level named s: debug, info, warn or error; ""
+// means info.
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+	return level, nil
+}
+
+// contextHandler adds the request ID of the context to each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("requestId", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying a request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns a random request ID.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// ValidRequestID reports whether a client's request ID can be used as is:
+// it must be short and printable ASCII without spaces.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	return !strings.ContainsFunc(id, func(r rune) bool { return r <= ' ' || r > '~' })
+}
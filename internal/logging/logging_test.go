@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNew_AddsRequestIDAndRedacts(t *testing.T) {
+	var out strings.Builder
+	logger := New(&out, slog.LevelInfo)
+	ctx := WithRequestID(context.Background(), "req-1")
+
+	logger.DebugContext(ctx, "hidden")
+	logger.InfoContext(ctx, "Request handled", PHI("query", "name=smith"))
+	ShowPHI = true
+	logger.InfoContext(ctx, "Request handled", PHI("query", "name=smith"))
+	ShowPHI = false
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines at info level, got %q", out.String())
+	}
+	if !strings.Contains(lines[0], `"query":"[redacted]"`) || !strings.Contains(lines[0], `"requestId":"req-1"`) {
+		t.Errorf("Expected a redacted query and the request ID, got %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"query":"name=smith"`) {
+		t.Errorf("Expected the query with ShowPHI, got %s", lines[1])
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]slog.Level{"": slog.LevelInfo, "debug": slog.LevelDebug, "WARN": slog.LevelWarn, "error": slog.LevelError} {
+		if got, err := ParseLevel(s); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Errorf("Expected an error for an unknown level")
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"abc-123":                true,
+		"":                       false,
+		"has space":              false,
+		"line\nbreak":            false,
+		strings.Repeat("a", 129): false,
+	} {
+		if got := ValidRequestID(id); got != want {
+			t.Errorf("ValidRequestID(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+// Package metrics keeps the proxy's counters, gauges and histograms and
+// serves them in the Prometheus text exposition format, so they can be
+// scraped without a client library or any other service.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// MaxSeries bounds the label combinations kept for each metric. Once it is
+// reached, new combinations are counted under Other for every label, so
+// label values taken from requests cannot exhaust memory.
+const MaxSeries = 1000
+
+// Other replaces label values once a metric has MaxSeries series.
+const Other = "other"
+
+// DefaultBuckets are histogram upper bounds, in seconds, suited to request
+// latencies.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry holds metrics in the order they were registered.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// Default is the registry the proxy's metrics are registered with.
+var Default = &Registry{}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes every metric in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the metrics to a scraper.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	if req.Method == http.MethodHead {
+		return
+	}
+	_, _ = r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// desc describes a metric and keeps its series by label values.
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string][]string
+}
+
+func newDesc(name, help, kind string, labels []string) desc {
+	return desc{name: name, help: help, kind: kind, labels: labels, series: map[string][]string{}}
+}
+
+// key returns the series key for label values, folding them into Other once
+// the metric has MaxSeries series. d.mu must be held.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic("metrics: " + d.name + " takes " + strconv.Itoa(len(d.labels)) + " label values")
+	}
+	k := strings.Join(values, "\xff")
+	if _, ok := d.series[k]; ok {
+		return k
+	}
+	if len(d.series) >= MaxSeries {
+		values = make([]string, len(d.labels))
+		for i := range values {
+			values[i] = Other
+		}
+		k = strings.Join(values, "\xff")
+		if _, ok := d.series[k]; ok {
+			return k
+		}
+	}
+	d.series[k] = append([]string(nil), values...)
+	return k
+}
+
+// keys returns the series keys in order of their label values. d.mu must be
+// held.
+func (d *desc) keys() []string {
+	keys := make([]string, 0, len(d.series))
+	for k := range d.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	w.WriteString("# HELP " + d.name + " " + escapeHelp(d.help) + "\n")
+	w.WriteString("# TYPE " + d.name + " " + d.kind + "\n")
+}
+
+// writeSample writes one sample of the series k, with an extra label if
+// extra is not empty.
+func (d *desc) writeSample(w *bufio.Writer, suffix, k string, extra [2]string, v float64) {
+	w.WriteString(d.name + suffix)
+	values := d.series[k]
+	if len(values) > 0 || extra[0] != "" {
+		w.WriteByte('{')
+		for i, label := range d.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label + `="` + escapeLabel(values[i]) + `"`)
+		}
+		if extra[0] != "" {
+			if len(values) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extra[0] + `="` + extra[1] + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+// CounterVec counts events by label values.
+type CounterVec struct {
+	desc
+	values map[string]float64
+}
+
+// NewCounterVec registers a counter with r.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{desc: newDesc(name, help, "counter", labels), values: map[string]float64{}}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the counter for the label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v, which must not be negative, to the counter for the label
+// values.
+func (c *CounterVec) Add(v float64, values ...string) {
+	if v < 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := c.key(values)
+	c.values[k] += v
+}
+
+// Value returns the counter for the label values.
+func (c *CounterVec) Value(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[strings.Join(values, "\xff")]
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w)
+	for _, k := range c.keys() {
+		c.writeSample(w, "", k, [2]string{}, c.values[k])
+	}
+}
+
+// GaugeVec holds values, by label values, that may go up and down.
+type GaugeVec struct {
+	desc
+	values map[string]float64
+}
+
+// NewGaugeVec registers a gauge with r.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{desc: newDesc(name, help, "gauge", labels), values: map[string]float64{}}
+	r.register(g)
+	return g
+}
+
+// Set sets the gauge for the label values.
+func (g *GaugeVec) Set(v float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	k := g.key(values)
+	g.values[k] = v
+}
+
+// Value returns the gauge for the label values.
+func (g *GaugeVec) Value(values ...string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.values[strings.Join(values, "\xff")]
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.writeHeader(w)
+	for _, k := range g.keys() {
+		g.writeSample(w, "", k, [2]string{}, g.values[k])
+	}
+}
+
+// HistogramVec counts observations, by label values, in buckets.
+type HistogramVec struct {
+	desc
+	buckets []float64
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec registers a histogram with r. buckets are the upper
+// bounds of its buckets, in increasing order; a +Inf bucket is added.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{desc: newDesc(name, help, "histogram", labels), buckets: buckets, values: map[string]*histogram{}}
+	r.register(h)
+	return h
+}
+
+// Observe counts v for the label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k := h.key(values)
+	s := h.values[k]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[k] = s
+	}
+	s.counts[sort.SearchFloat64s(h.buckets, v)]++
+	s.count++
+	s.sum += v
+}
+
+// Count returns the number of observations for the label values.
+func (h *HistogramVec) Count(values ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s := h.values[strings.Join(values, "\xff")]; s != nil {
+		return s.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w)
+	for _, k := range h.keys() {
+		s := h.values[k]
+		var cumulative uint64
+		for i, n := range s.counts {
+			cumulative += n
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			h.writeSample(w, "_bucket", k, [2]string{"le", formatFloat(le)}, float64(cumulative))
+		}
+		h.writeSample(w, "_sum", k, [2]string{}, s.sum)
+		h.writeSample(w, "_count", k, [2]string{}, float64(s.count))
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
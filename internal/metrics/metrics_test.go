@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WritesTextFormat(t *testing.T) {
+	r := &Registry{}
+	requests := r.NewCounterVec("requests_total", "Requests.\nBy path.", "path", "status")
+	temperature := r.NewGaugeVec("temperature", "Temperature.")
+	latency := r.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+
+	requests.Inc("/b", "200")
+	requests.Add(2, "/a\"\n", "500")
+	requests.Add(-1, "/b", "200")
+	temperature.Set(21.5)
+	latency.Observe(0.05, "/a")
+	latency.Observe(0.1, "/a")
+	latency.Observe(3, "/a")
+
+	var out strings.Builder
+	if _, err := r.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP requests_total Requests.\nBy path.
+# TYPE requests_total counter
+requests_total{path="/a\"\n",status="500"} 2
+requests_total{path="/b",status="200"} 1
+# HELP temperature Temperature.
+# TYPE temperature gauge
+temperature 21.5
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/a",le="0.1"} 2
+latency_seconds_bucket{route="/a",le="1"} 2
+latency_seconds_bucket{route="/a",le="+Inf"} 3
+latency_seconds_sum{route="/a"} 3.15
+latency_seconds_count{route="/a"} 3
+`
+	if out.String() != want {
+		t.Errorf("Got:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestCounterVec_FoldsExcessSeries(t *testing.T) {
+	c := (&Registry{}).NewCounterVec("c_total", "C.", "label")
+	for i := 0; i < MaxSeries+5; i++ {
+		c.Inc(strconv.Itoa(i))
+	}
+	if len(c.series) != MaxSeries+1 {
+		t.Errorf("Expected %d series, got %d", MaxSeries+1, len(c.series))
+	}
+	if got := c.Value(Other); got != 5 {
+		t.Errorf("Expected 5 counted under %q, got %v", Other, got)
+	}
+}
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	r := &Registry{}
+	r.NewCounterVec("c_total", "C.").Inc()
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != ContentType {
+		t.Fatalf("Expected 200 with %s, got %d %s", ContentType, rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), "c_total 1\n") {
+		t.Errorf("Expected the counter, got %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", rec.Code)
+	}
+}
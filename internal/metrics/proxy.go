@@ -0,0 +1,50 @@
+package metrics
+
+import "time"
+
+// The proxy's metrics, served from Default.
+var (
+	Requests = Default.NewCounterVec("fhir_proxy_requests_total",
+		"HTTP requests handled, by route pattern, method and status.",
+		"route", "method", "status")
+	ValidationDuration = Default.NewHistogramVec("fhir_proxy_validation_duration_seconds",
+		"Time to read and validate a request body, by verdict.",
+		DefaultBuckets, "verdict")
+	Rejections = Default.NewCounterVec("fhir_proxy_rejections_total",
+		"Validation errors, by resource type and the rule that raised them (builtin for profile and structural checks).",
+		"resource_type", "rule_id")
+	BundleEntries = Default.NewHistogramVec("fhir_proxy_bundle_entries",
+		"Number of entries in validated transaction and batch bundles.",
+		[]float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 5000})
+	UpstreamDuration = Default.NewHistogramVec("fhir_proxy_upstream_duration_seconds",
+		"Time for each attempt to send a request upstream, by upstream host.",
+		DefaultBuckets, "upstream")
+	UpstreamErrors = Default.NewCounterVec("fhir_proxy_upstream_errors_total",
+		"Failed attempts to send a request upstream, by upstream host and reason: timeout, transport, or the status of an unavailable upstream.",
+		"upstream", "reason")
+	ShadowDropped = Default.NewCounterVec("fhir_proxy_shadow_dropped_total",
+		"Requests not compared against shadow rules because every shadow worker was busy.")
+	ConfigLoads = Default.NewCounterVec("fhir_proxy_config_loads_total",
+		"Configuration loads, by result: success or failure.",
+		"result")
+	ConfigLastSuccess = Default.NewGaugeVec("fhir_proxy_config_last_success_timestamp_seconds",
+		"Unix time of the last successful configuration load.")
+)
+
+// BuiltinRule labels rejections not raised by a configured rule.
+const BuiltinRule = "builtin"
+
+// Since returns the seconds since start, for histograms of durations.
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+// ConfigLoaded counts a configuration load that ended with err.
+func ConfigLoaded(err error) {
+	if err != nil {
+		ConfigLoads.Inc("failure")
+		return
+	}
+	ConfigLoads.Inc("success")
+	ConfigLastSuccess.Set(float64(time.Now().Unix()))
+}
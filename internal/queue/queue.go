@@ -0,0 +1,496 @@
+// Package queue is a durable store-and-forward queue for validated requests
+// that could not be delivered upstream. Entries are kept as files in a
+// directory and replayed in the order they were queued; entries the
+// upstream rejects are moved to a dead-letter directory for an operator.
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults used by Open.
+const (
+	DefaultRetryInterval = 5 * time.Second
+	DefaultMaxAttempts   = 5
+)
+
+// ErrNotFound is returned for an unknown dead-letter entry.
+var ErrNotFound = errors.New("queue entry not found")
+
+// Entry is a queued request. Its body is stored beside it.
+type Entry struct {
+	Seq        uint64      `json:"seq"`
+	Enqueued   time.Time   `json:"enqueued"`
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	Query      string      `json:"query,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	RemoteAddr string      `json:"remoteAddr,omitempty"`
+	Host       string      `json:"host,omitempty"`
+	Size       int64       `json:"size"`
+	Attempts   int         `json:"attempts"`
+	// Status is the last upstream status, 0 if the upstream was not reached.
+	Status    int    `json:"status,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// Sender delivers an entry upstream. body returns a fresh reader over the
+// entry body on every call. A non-nil error means the upstream could not be
+// reached; otherwise the upstream status is returned.
+type Sender func(ctx context.Context, e *Entry, body func() (io.Reader, error)) (int, error)
+
+// Queue is a durable FIFO of entries in a directory.
+type Queue struct {
+	dir  string
+	dead string
+	// RetryInterval is how long replay waits after a failed delivery.
+	RetryInterval time.Duration
+	// MaxAttempts is how many times an entry the upstream fails with a
+	// server error is tried before it is dead-lettered. Entries that cannot
+	// be delivered because the upstream is unreachable are kept.
+	MaxAttempts int
+
+	mu      sync.Mutex
+	next    uint64
+	pending []uint64
+	notify  chan struct{}
+}
+
+// Open returns the queue in dir, creating it if needed and recovering any
+// entries left by a previous run.
+func Open(dir string) (*Queue, error) {
+	q := &Queue{
+		dir:           dir,
+		dead:          filepath.Join(dir, "dead"),
+		RetryInterval: DefaultRetryInterval,
+		MaxAttempts:   DefaultMaxAttempts,
+		next:          1,
+		notify:        make(chan struct{}, 1),
+	}
+	if err := os.MkdirAll(q.dead, 0o750); err != nil {
+		return nil, err
+	}
+
+	pending, err := listSeqs(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	dead, err := listSeqs(q.dead)
+	if err != nil {
+		return nil, err
+	}
+	q.pending = pending
+	// #nosec G304 -- the sequence file is inside the queue directory
+	if data, err := os.ReadFile(filepath.Join(dir, seqFile)); err == nil {
+		if n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err == nil {
+			q.next = n
+		}
+	}
+	for _, seqs := range [][]uint64{pending, dead} {
+		if n := len(seqs); n > 0 && seqs[n-1] >= q.next {
+			q.next = seqs[n-1] + 1
+		}
+	}
+	return q, nil
+}
+
+// listSeqs returns the sequence numbers of the entries in dir, in order.
+func listSeqs(dir string) ([]uint64, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	seqs := make([]uint64, 0, len(files))
+	for _, f := range files {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(f), ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// seqFile records the next sequence number, so numbers are not reused after
+// the entries holding them have been delivered.
+const seqFile = "next"
+
+func name(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+// Enqueue appends e with the given body to the queue and sets e.Seq and
+// e.Enqueued. The entry is on disk when Enqueue returns.
+func (q *Queue) Enqueue(e *Entry, body io.Reader) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.enqueue(e, body)
+}
+
+// enqueue is Enqueue with q.mu held.
+func (q *Queue) enqueue(e *Entry, body io.Reader) error {
+	e.Seq = q.next
+	e.Enqueued = time.Now().UTC()
+	base := filepath.Join(q.dir, name(e.Seq))
+
+	// The body is written first: an entry is only visible once its
+	// metadata has been renamed into place.
+	size, err := writeFile(q.dir, base+".body", func(w io.Writer) error {
+		_, err := io.Copy(w, body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	e.Size = size
+	next := strconv.FormatUint(e.Seq+1, 10)
+	if _, err := writeFile(q.dir, filepath.Join(q.dir, seqFile), func(w io.Writer) error {
+		_, err := io.WriteString(w, next)
+		return err
+	}); err != nil {
+		_ = os.Remove(base + ".body")
+		return err
+	}
+	if err := writeEntry(q.dir, base+".json", e); err != nil {
+		_ = os.Remove(base + ".body")
+		return err
+	}
+
+	q.next++
+	q.pending = append(q.pending, e.Seq)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Depth returns the number of entries waiting to be delivered.
+func (q *Queue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Oldest returns the entry at the head of the queue, or nil if it is empty.
+func (q *Queue) Oldest() (*Entry, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return nil, nil
+	}
+	return readEntry(filepath.Join(q.dir, name(q.pending[0])+".json"))
+}
+
+// DeadLetters returns the dead-letter entries, oldest first.
+func (q *Queue) DeadLetters() ([]*Entry, error) {
+	seqs, err := listSeqs(q.dead)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*Entry, 0, len(seqs))
+	for _, seq := range seqs {
+		e, err := readEntry(filepath.Join(q.dead, name(seq)+".json"))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// DeadLetter returns a dead-letter entry and its body. The caller must
+// close the body.
+func (q *Queue) DeadLetter(seq uint64) (*Entry, io.ReadCloser, error) {
+	base := filepath.Join(q.dead, name(seq))
+	e, err := readEntry(base + ".json")
+	if err != nil {
+		return nil, nil, err
+	}
+	// #nosec G304 -- path is built from a sequence number inside the queue directory
+	body, err := os.Open(base + ".body")
+	if err != nil {
+		return nil, nil, err
+	}
+	return e, body, nil
+}
+
+// Requeue moves a dead-letter entry to the tail of the queue.
+func (q *Queue) Requeue(seq uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, body, err := q.DeadLetter(seq)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := body.Close(); cerr != nil {
+			slog.Warn("Failed to close dead-letter body", "error", cerr)
+		}
+	}()
+	e.Attempts, e.Status, e.LastError = 0, 0, ""
+	if err := q.enqueue(e, body); err != nil {
+		return err
+	}
+	return removeEntry(filepath.Join(q.dead, name(seq)))
+}
+
+// Discard deletes a dead-letter entry.
+func (q *Queue) Discard(seq uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	base := filepath.Join(q.dead, name(seq))
+	if _, err := os.Stat(base + ".json"); errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	return removeEntry(base)
+}
+
+// Replay delivers entries with send, in order, until ctx is done. The head
+// of the queue is retried every RetryInterval while the upstream is
+// unreachable, so later entries are never delivered before it.
+func (q *Queue) Replay(ctx context.Context, send Sender) {
+	q.replay(ctx, ctx.Done(), send)
+}
+
+// replay is Replay that also returns, between deliveries, once stop is
+// closed.
+func (q *Queue) replay(ctx context.Context, stop <-chan struct{}, send Sender) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		wait, err := q.deliverHead(ctx, send)
+		if err != nil {
+			slog.Error("Failed to replay queued request", "error", err)
+			wait = q.RetryInterval
+		}
+		if wait < 0 {
+			continue
+		}
+
+		// While the head is backing off, new entries do not cut the wait
+		// short.
+		var timer *time.Timer
+		var tick <-chan time.Time
+		notify := q.notify
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			tick = timer.C
+			notify = nil
+		}
+		select {
+		case <-stop:
+		case <-notify:
+		case <-tick:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Replayer is a replay running in the background; see StartReplay.
+type Replayer struct {
+	stop   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartReplay runs Replay with send in the background until the returned
+// Replayer is drained.
+func (q *Queue) StartReplay(send Sender) *Replayer {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Replayer{stop: make(chan struct{}), cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		defer cancel()
+		q.replay(ctx, r.stop, send)
+	}()
+	return r
+}
+
+// Drain stops the replay once the delivery in progress, if any, is done,
+// and waits for it. A delivery still in progress when ctx is done is
+// cancelled and its entry stays at the head. Either way the queue's files
+// are consistent when Drain returns. It returns ctx.Err() if the delivery
+// had to be cancelled.
+func (r *Replayer) Drain(ctx context.Context) error {
+	close(r.stop)
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+	}
+	r.cancel()
+	<-r.done
+	return ctx.Err()
+}
+
+// deliverHead tries to deliver the oldest entry. It returns how long to
+// wait before the next attempt: negative to continue at once, zero to wait
+// for a new entry.
+func (q *Queue) deliverHead(ctx context.Context, send Sender) (time.Duration, error) {
+	e, err := q.Oldest()
+	if errors.Is(err, ErrNotFound) {
+		// Removed from the directory behind our back; skip it.
+		q.mu.Lock()
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+		return -1, nil
+	}
+	if err != nil || e == nil {
+		return 0, err
+	}
+	base := filepath.Join(q.dir, name(e.Seq))
+	// #nosec G304 -- path is built from a sequence number inside the queue directory
+	f, err := os.Open(base + ".body")
+	if err != nil {
+		return 0, err
+	}
+	body := func() (io.Reader, error) { return io.NewSectionReader(f, 0, e.Size), nil }
+	status, sendErr := send(ctx, e, body)
+	if cerr := f.Close(); cerr != nil {
+		slog.Warn("Failed to close queued body", "error", cerr)
+	}
+	if sendErr != nil && ctx.Err() != nil {
+		// Stopped mid-delivery; the entry stays at the head.
+		return 0, nil
+	}
+
+	e.Attempts++
+	e.Status = status
+	e.LastError = ""
+	switch {
+	case sendErr != nil:
+		e.LastError = sendErr.Error()
+		return q.RetryInterval, writeEntry(q.dir, base+".json", e)
+	case status < 400:
+		return -1, q.pop(e.Seq, "")
+	case transient(status) || (status >= 500 && e.Attempts < q.MaxAttempts):
+		e.LastError = fmt.Sprintf("upstream returned %d", status)
+		return q.RetryInterval, writeEntry(q.dir, base+".json", e)
+	default:
+		e.LastError = fmt.Sprintf("upstream returned %d", status)
+		if err := writeEntry(q.dir, base+".json", e); err != nil {
+			return q.RetryInterval, err
+		}
+		slog.Warn("Moved queued request to dead letters", "seq", e.Seq, "lastError", e.LastError)
+		return -1, q.pop(e.Seq, q.dead)
+	}
+}
+
+// transient reports whether a status means the request should be retried
+// however many attempts it has had.
+func transient(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// pop removes the head entry, moving it to dir if dir is set.
+func (q *Queue) pop(seq uint64, dir string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	base := filepath.Join(q.dir, name(seq))
+	if dir != "" {
+		target := filepath.Join(dir, name(seq))
+		if err := os.Rename(base+".body", target+".body"); err != nil {
+			return err
+		}
+		if err := os.Rename(base+".json", target+".json"); err != nil {
+			return err
+		}
+	} else if err := removeEntry(base); err != nil {
+		return err
+	}
+	if len(q.pending) > 0 && q.pending[0] == seq {
+		q.pending = q.pending[1:]
+	}
+	return nil
+}
+
+func readEntry(path string) (*Entry, error) {
+	// #nosec G304 -- path is built from a sequence number inside the queue directory
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("error parsing queue entry %s: %w", path, err)
+	}
+	return &e, nil
+}
+
+func writeEntry(dir, path string, e *Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = writeFile(dir, path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	return err
+}
+
+// writeFile atomically writes path through a synced temporary file in dir.
+func writeFile(dir, path string, write func(io.Writer) error) (int64, error) {
+	tmp, err := os.CreateTemp(dir, ".entry-*")
+	if err != nil {
+		return 0, err
+	}
+	fail := func(err error) (int64, error) {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return 0, err
+	}
+	if err := write(tmp); err != nil {
+		return fail(err)
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return 0, err
+	}
+	return size, os.Rename(tmp.Name(), path)
+}
+
+func removeEntry(base string) error {
+	if err := os.Remove(base + ".json"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(base + ".body"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
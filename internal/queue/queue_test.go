@@ -0,0 +1,214 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func enqueue(t *testing.T, q *Queue, body string) *Entry {
+	t.Helper()
+	e := &Entry{Method: "POST", Path: "/Patient"}
+	if err := q.Enqueue(e, strings.NewReader(body)); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	return e
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.RetryInterval = time.Millisecond
+	for _, body := range []string{"first", "second", "third"} {
+		enqueue(t, q, body)
+	}
+
+	// The upstream is unreachable at first, then rejects "second".
+	var mu sync.Mutex
+	var delivered []string
+	calls := 0
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Replay(ctx, func(ctx context.Context, e *Entry, body func() (io.Reader, error)) (int, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			if calls == 1 {
+				return 0, errors.New("connection refused")
+			}
+			r, _ := body()
+			b, _ := io.ReadAll(r)
+			if string(b) == "second" {
+				return 422, nil
+			}
+			delivered = append(delivered, string(b))
+			if len(delivered) == 2 {
+				cancel()
+			}
+			return 201, nil
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		cancel()
+		t.Fatal("Replay did not drain the queue")
+	}
+
+	if strings.Join(delivered, ",") != "first,third" || q.Depth() != 0 {
+		t.Fatalf("Expected first,third delivered and an empty queue, got %v, depth %d", delivered, q.Depth())
+	}
+	dead, err := q.DeadLetters()
+	if err != nil || len(dead) != 1 || dead[0].Seq != 2 || dead[0].Status != 422 {
+		t.Fatalf("Expected entry 2 dead-lettered with status 422, got %+v, %v", dead, err)
+	}
+
+	// A reopened queue continues the sequence after dead letters.
+	q, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Requeue(2); err != nil {
+		t.Fatalf("Requeue() error = %v", err)
+	}
+	head, err := q.Oldest()
+	if err != nil || head.Seq != 4 || head.Attempts != 0 || q.Depth() != 1 {
+		t.Fatalf("Expected requeued entry 4 at the head, got %+v, %v", head, err)
+	}
+	if err := q.Discard(2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a requeued entry, got %v", err)
+	}
+}
+
+func TestReplayer_Drain(t *testing.T) {
+	q, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	enqueue(t, q, "first")
+	enqueue(t, q, "second")
+
+	// Drain lets the delivery in progress finish, then stops before the next
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	var delivered []string
+	r := q.StartReplay(func(ctx context.Context, e *Entry, body func() (io.Reader, error)) (int, error) {
+		close(sending)
+		<-release
+		b, _ := body()
+		data, _ := io.ReadAll(b)
+		delivered = append(delivered, string(data))
+		return 201, nil
+	})
+	<-sending
+	drained := make(chan error)
+	go func() { drained <- r.Drain(context.Background()) }()
+	select {
+	case err := <-drained:
+		t.Fatalf("Expected Drain to wait for the delivery in progress, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-drained; err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+	if strings.Join(delivered, ",") != "first" || q.Depth() != 1 {
+		t.Fatalf("Expected only first delivered, got %v, depth %d", delivered, q.Depth())
+	}
+
+	// At the deadline, the delivery in progress is cancelled and stays queued
+	sending = make(chan struct{})
+	r = q.StartReplay(func(ctx context.Context, e *Entry, body func() (io.Reader, error)) (int, error) {
+		close(sending)
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+	<-sending
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected Drain to cancel the delivery at the deadline, got %v", err)
+	}
+	head, err := q.Oldest()
+	if err != nil || head == nil || head.Attempts != 0 || q.Depth() != 1 {
+		t.Fatalf("Expected the cancelled entry at the head with no attempts, got %+v, %v", head, err)
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	q, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.MaxAttempts = 2
+	enqueue(t, q, "body")
+
+	send := func(ctx context.Context, e *Entry, body func() (io.Reader, error)) (int, error) {
+		return 500, nil
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := q.deliverHead(context.Background(), send); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dead, _ := q.DeadLetters()
+	if q.Depth() != 0 || len(dead) != 1 || dead[0].Attempts != 2 {
+		t.Fatalf("Expected entry dead-lettered after 2 attempts, got depth %d, %+v", q.Depth(), dead)
+	}
+	if err := q.Discard(dead[0].Seq); err != nil {
+		t.Errorf("Discard() error = %v", err)
+	}
+}
+
+func TestRequeueOnce(t *testing.T) {
+	q, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.MaxAttempts = 1
+	enqueue(t, q, "body")
+	send := func(ctx context.Context, e *Entry, body func() (io.Reader, error)) (int, error) {
+		return 400, nil
+	}
+	if _, err := q.deliverHead(context.Background(), send); err != nil {
+		t.Fatal(err)
+	}
+	dead, _ := q.DeadLetters()
+	if len(dead) != 1 {
+		t.Fatalf("Expected one dead letter, got %d", len(dead))
+	}
+
+	// Concurrent requeues of the same entry queue it once
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- q.Requeue(dead[0].Seq)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	requeued := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			requeued++
+		case !errors.Is(err, ErrNotFound):
+			t.Errorf("Requeue() error = %v", err)
+		}
+	}
+	if requeued != 1 || q.Depth() != 1 {
+		t.Errorf("Requeued %d times, depth %d; want once", requeued, q.Depth())
+	}
+}
@@ -0,0 +1,233 @@
+// Package ruletest runs declarative fixtures against the validator, so that
+// rules in rules.yaml and recipes.yaml can be tested without writing Go.
+//
+// A fixture file lists resources and the issues they are expected to raise:
+//
+//	name: Patient rules
+//	tests:
+//	  - name: lowercase postcode is rejected
+//	    resource:
+//	      resourceType: Patient
+//	      address: [{postalCode: cf10 1ep}]
+//	    expect:
+//	      issues:
+//	        - rule: Patient.address.postalCode:pattern
+//
+// A resource may instead be read from a JSON file with "file:", relative to
+// the fixture. Expected issues match on any of rule, severity and a
+// diagnostics substring. Every warning, error or fatal issue raised must be
+// expected; with no issues listed the resource must be valid.
+package ruletest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"fhir-validation-proxy/internal/validator"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Suite is a fixture file.
+type Suite struct {
+	// File is the path the suite was loaded from.
+	File  string `yaml:"-"`
+	Name  string `yaml:"name"`
+	Cases []Case `yaml:"tests"`
+}
+
+// Case is a single resource and the outcome expected from validating it.
+type Case struct {
+	Name     string                 `yaml:"name"`
+	Resource map[string]interface{} `yaml:"resource"`
+	File     string                 `yaml:"file"`
+	Expect   Expect                 `yaml:"expect"`
+}
+
+// Expect describes the expected validation outcome.
+type Expect struct {
+	// Valid, if set, must equal ValidationResult.Valid.
+	Valid  *bool           `yaml:"valid"`
+	Issues []ExpectedIssue `yaml:"issues"`
+}
+
+// ExpectedIssue matches an issue on each field that is set.
+type ExpectedIssue struct {
+	Rule        string `yaml:"rule"`
+	Severity    string `yaml:"severity"`
+	Diagnostics string `yaml:"diagnostics"`
+}
+
+// LoadSuites loads every .yaml fixture file in dir, in name order.
+func LoadSuites(dir string) ([]Suite, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	suites := make([]Suite, 0, len(files))
+	for _, file := range files {
+		// #nosec G304 -- file comes from a glob of the fixture directory
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var suite Suite
+		if err := yaml.Unmarshal(data, &suite); err != nil {
+			return nil, fmt.Errorf("error parsing fixture %s: %w", file, err)
+		}
+		suite.File = file
+		if err := suite.loadResources(); err != nil {
+			return nil, err
+		}
+		suites = append(suites, suite)
+	}
+	return suites, nil
+}
+
+// loadResources reads file: resources and round-trips inline ones through
+// JSON, so numbers decode as they would from a request body.
+func (s *Suite) loadResources() error {
+	for i := range s.Cases {
+		c := &s.Cases[i]
+		var data []byte
+		var err error
+		if c.File != "" {
+			// #nosec G304 -- file is named by the fixture, relative to it
+			data, err = os.ReadFile(filepath.Join(filepath.Dir(s.File), c.File))
+		} else {
+			data, err = json.Marshal(c.Resource)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", s.File, c.Name, err)
+		}
+		c.Resource = nil
+		if err := json.Unmarshal(data, &c.Resource); err != nil {
+			return fmt.Errorf("%s: %s: %w", s.File, c.Name, err)
+		}
+	}
+	return nil
+}
+
+// CaseResult is the result of running one Case.
+type CaseResult struct {
+	Suite    string
+	Case     string
+	Failures []string
+}
+
+// Passed reports whether the case met its expectations.
+func (r CaseResult) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// Report is the result of running fixtures.
+type Report struct {
+	Results []CaseResult
+	// Uncovered lists the rule IDs that no passing case expects.
+	Uncovered []string
+}
+
+// Failed reports how many cases failed.
+func (r Report) Failed() int {
+	n := 0
+	for _, res := range r.Results {
+		if !res.Passed() {
+			n++
+		}
+	}
+	return n
+}
+
+// Run validates each case with validator.Validate against the loaded
+// configuration and checks its expectations.
+func Run(suites []Suite) Report {
+	var report Report
+	covered := map[string]bool{}
+
+	for _, suite := range suites {
+		for _, c := range suite.Cases {
+			result := validator.Validate(c.Resource)
+			res := CaseResult{Suite: suite.File, Case: c.Name, Failures: check(c.Expect, result)}
+			if res.Passed() {
+				for _, exp := range c.Expect.Issues {
+					covered[exp.Rule] = true
+				}
+			}
+			report.Results = append(report.Results, res)
+		}
+	}
+
+	for _, id := range validator.RuleIDs() {
+		if !covered[id] {
+			report.Uncovered = append(report.Uncovered, id)
+		}
+	}
+	return report
+}
+
+// check compares a result with expectations and describes any mismatch.
+func check(expect Expect, result validator.ValidationResult) []string {
+	var failures []string
+	wantValid := len(expect.Issues) == 0
+	if expect.Valid != nil {
+		wantValid = *expect.Valid
+	}
+	if result.Valid != wantValid {
+		failures = append(failures, fmt.Sprintf("valid = %v, want %v", result.Valid, wantValid))
+	}
+
+	matched := make([]bool, len(result.Issues))
+	for _, exp := range expect.Issues {
+		found := false
+		for i, issue := range result.Issues {
+			if !matched[i] && exp.matches(issue) {
+				matched[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			failures = append(failures, "expected issue not raised: "+exp.String())
+		}
+	}
+
+	for i, issue := range result.Issues {
+		if !matched[i] && issue.Severity != validator.SeverityInformation {
+			failures = append(failures, fmt.Sprintf("unexpected %s: %s", issue.Severity, describe(issue)))
+		}
+	}
+	return failures
+}
+
+func (e ExpectedIssue) matches(issue validator.Issue) bool {
+	return (e.Rule == "" || e.Rule == issue.RuleID) &&
+		(e.Severity == "" || e.Severity == issue.Severity) &&
+		strings.Contains(issue.Diagnostics, e.Diagnostics)
+}
+
+func (e ExpectedIssue) String() string {
+	var parts []string
+	if e.Rule != "" {
+		parts = append(parts, "rule "+e.Rule)
+	}
+	if e.Severity != "" {
+		parts = append(parts, "severity "+e.Severity)
+	}
+	if e.Diagnostics != "" {
+		parts = append(parts, fmt.Sprintf("diagnostics %q", e.Diagnostics))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func describe(issue validator.Issue) string {
+	if issue.RuleID != "" {
+		return fmt.Sprintf("%s (rule %s)", issue.Diagnostics, issue.RuleID)
+	}
+	return issue.Diagnostics
+}
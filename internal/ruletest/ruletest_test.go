@@ -0,0 +1,95 @@
+package ruletest
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fhir-validation-proxy/internal/validator"
+)
+
+func TestRun(t *testing.T) {
+	if err := validator.LoadConfigDir("../../configs"); err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	dir := t.TempDir()
+	fixture := `
+name: sample
+tests:
+  - name: expected issue raised
+    resource:
+      resourceType: Patient
+      active: true
+      gender: female
+      birthDate: "1980-01-01"
+      name: [{family: Smith}]
+      address: [{postalCode: cf10 1ep}]
+    expect:
+      issues:
+        - rule: Patient.address.postalCode:pattern
+  - name: wrong expectation
+    file: patient.json
+    expect:
+      issues:
+        - rule: Patient.birthDate:min
+`
+	patient := `{"resourceType": "Patient", "active": true, "gender": "Male", "birthDate": "1980-01-01",
+		"name": [{"family": "Smith"}], "address": [{"postalCode": "CF10 1EP"}]}`
+	if err := os.WriteFile(filepath.Join(dir, "sample.yaml"), []byte(fixture), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "patient.json"), []byte(patient), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	suites, err := LoadSuites(dir)
+	if err != nil {
+		t.Fatalf("LoadSuites() error = %v", err)
+	}
+	report := Run(suites)
+
+	if len(report.Results) != 2 || !report.Results[0].Passed() {
+		t.Fatalf("expected first case to pass, got %+v", report.Results)
+	}
+	failures := strings.Join(report.Results[1].Failures, "\n")
+	for _, want := range []string{
+		"expected issue not raised: rule Patient.birthDate:min",
+		"unexpected error: Field gender has disallowed value (rule Patient.gender:allowedValues)",
+	} {
+		if !strings.Contains(failures, want) {
+			t.Errorf("failures missing %q:\n%s", want, failures)
+		}
+	}
+	if report.Failed() != 1 {
+		t.Errorf("Failed() = %d, want 1", report.Failed())
+	}
+
+	uncovered := strings.Join(report.Uncovered, ",")
+	if strings.Contains(uncovered, "Patient.address.postalCode:pattern") {
+		t.Errorf("pattern rule should be covered, uncovered = %s", uncovered)
+	}
+	if !strings.Contains(uncovered, "Patient.birthDate:min") {
+		t.Errorf("birthDate rule from a failing case should be uncovered, uncovered = %s", uncovered)
+	}
+}
+
+func TestShippedFixtures(t *testing.T) {
+	if err := validator.LoadConfigDir("../../configs"); err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	suites, err := LoadSuites("../../configs/tests")
+	if err != nil {
+		t.Fatalf("LoadSuites() error = %v", err)
+	}
+	report := Run(suites)
+	for _, res := range report.Results {
+		if !res.Passed() {
+			t.Errorf("%s: %s: %v", res.Suite, res.Case, res.Failures)
+		}
+	}
+	if len(report.Uncovered) > 0 {
+		t.Errorf("rules without a fixture: %v", report.Uncovered)
+	}
+}
@@ -0,0 +1,173 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ServiceName is reported as the service.name of exported spans.
+var ServiceName = "fhir-validation-proxy"
+
+// scopeName is the instrumentation scope of exported spans.
+const scopeName = "fhir-validation-proxy/internal/trace"
+
+// OTLP status codes.
+const (
+	statusUnset = 0
+	statusError = 2
+)
+
+// encode returns spans as an OTLP ExportTraceServiceRequest in the JSON
+// encoding of OTLP/HTTP: IDs in hex and 64-bit integers as strings.
+func encode(spans []*Span) ([]byte, error) {
+	out := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		span := map[string]interface{}{
+			"traceId":           s.Context.TraceID.String(),
+			"spanId":            s.Context.SpanID.String(),
+			"name":              s.Name,
+			"kind":              int(s.Kind),
+			"startTimeUnixNano": strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			"attributes":        attributes(s.Attributes()),
+			"status":            map[string]interface{}{"code": statusUnset},
+		}
+		if s.Parent != (SpanID{}) {
+			span["parentSpanId"] = s.Parent.String()
+		}
+		if msg := s.Err(); msg != "" {
+			span["status"] = map[string]interface{}{"code": statusError, "message": msg}
+		}
+		out = append(out, span)
+	}
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": attributes([]Attribute{String("service.name", ServiceName)}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": scopeName},
+				"spans": out,
+			}},
+		}},
+	})
+}
+
+// attributes returns attrs as OTLP KeyValues.
+func attributes(attrs []Attribute) []interface{} {
+	out := make([]interface{}, 0, len(attrs))
+	for _, a := range attrs {
+		var value map[string]interface{}
+		switch v := a.Value.(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]interface{}{"key": a.Key, "value": value})
+	}
+	return out
+}
+
+// DefaultOTLPTimeout bounds each export when OTLPExporter.Client is nil.
+const DefaultOTLPTimeout = 10 * time.Second
+
+// OTLPExporter posts spans to an OTLP/HTTP collector endpoint in JSON.
+type OTLPExporter struct {
+	// Endpoint is the traces URL, such as http://collector:4318/v1/traces.
+	Endpoint *url.URL
+	// Headers are added to every export, such as an API key.
+	Headers http.Header
+	Client  *http.Client
+}
+
+// Export posts spans. Any status but 2xx is an error.
+func (e *OTLPExporter) Export(spans []*Span) error {
+	body, err := encode(spans)
+	if err != nil {
+		return err
+	}
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultOTLPTimeout}
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, e.Endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range e.Headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("OTLP endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Close does nothing.
+func (e *OTLPExporter) Close() error { return nil }
+
+// FileExporter writes each batch of spans as one line of OTLP JSON, as the
+// OpenTelemetry Collector's file exporter does, for local testing.
+type FileExporter struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// NewFileExporter returns a FileExporter writing to w.
+func NewFileExporter(w io.WriteCloser) *FileExporter {
+	return &FileExporter{w: w}
+}
+
+// OpenFile returns a FileExporter appending to the file at path.
+func OpenFile(path string) (*FileExporter, error) {
+	// #nosec G304 -- path is configured by the operator
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileExporter(f), nil
+}
+
+// Export writes spans.
+func (e *FileExporter) Export(spans []*Span) error {
+	b, err := encode(spans)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the file.
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.w.Close()
+}
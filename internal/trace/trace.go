@@ -0,0 +1,363 @@
+// Package trace records OpenTelemetry-compatible spans of the time spent
+// handling a request: parsing, rules, recipes and the upstream call. Trace
+// context arrives and leaves in W3C traceparent headers, and spans are
+// exported in OTLP JSON, to a collector or a file, without an OpenTelemetry
+// SDK.
+//
+// Tracing is off until SetTracer is called; Start then returns nil spans,
+// whose methods do nothing.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceparentHeader carries the W3C trace context of a request.
+const TraceparentHeader = "traceparent"
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// String returns the ID in lowercase hex.
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// String returns the ID in lowercase hex.
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanContext is what is propagated of a span to other services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Sampled is set when the span is recorded; its children are recorded
+	// only if it is.
+	Sampled bool
+}
+
+// IsValid reports whether both IDs are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent returns sc as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a traceparent header value. It reports false if
+// the value is malformed or its IDs are zero. Versions after 00 are read
+// as 00, as the W3C specification asks.
+func ParseTraceparent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' || (len(s) > 55 && s[55] != '-') {
+		return sc, false
+	}
+	var version, flags [1]byte
+	if !decodeHex(version[:], s[0:2]) || version[0] == 0xff || (version[0] == 0 && len(s) != 55) {
+		return sc, false
+	}
+	if !decodeHex(sc.TraceID[:], s[3:35]) || !decodeHex(sc.SpanID[:], s[36:52]) || !decodeHex(flags[:], s[53:55]) {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// decodeHex decodes lowercase hex s into dst, which must be len(s)/2 long.
+func decodeHex(dst []byte, s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// Kind is the role of a span, as in OTLP.
+type Kind int
+
+// Span kinds.
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Attribute is a key and a string, bool, int, int64 or float64 value.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute.
+func String(key, value string) Attribute { return Attribute{key, value} }
+
+// Int returns an integer attribute.
+func Int(key string, value int) Attribute { return Attribute{key, int64(value)} }
+
+// Bool returns a boolean attribute.
+func Bool(key string, value bool) Attribute { return Attribute{key, value} }
+
+// Span is one timed operation of a trace. A nil *Span may be used, and
+// does nothing.
+type Span struct {
+	Name    string
+	Kind    Kind
+	Context SpanContext
+	// Parent is the ID of the parent span, or zero for the root of a trace.
+	Parent    SpanID
+	StartTime time.Time
+	EndTime   time.Time
+
+	mu         sync.Mutex
+	attributes []Attribute
+	err        string
+	ended      bool
+	tracer     *Tracer // nil when the span is not recorded
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil || s.tracer == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, attrs...)
+}
+
+// SetError marks the span as failed with err. It does nothing if err is
+// nil.
+func (s *Span) SetError(err error) {
+	if err != nil {
+		s.SetErrorMessage(err.Error())
+	}
+}
+
+// SetErrorMessage marks the span as failed with message.
+func (s *Span) SetErrorMessage(message string) {
+	if s == nil || s.tracer == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = message
+}
+
+// Attributes returns the attributes set on the span.
+func (s *Span) Attributes() []Attribute {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Attribute(nil), s.attributes...)
+}
+
+// Err returns the error message the span failed with, or "".
+func (s *Span) Err() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// End ends the span and queues it for export. Later calls do nothing.
+func (s *Span) End() {
+	if s == nil || s.tracer == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+	s.tracer.queue(s)
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// FromContext returns the span carried by ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// NewContext returns a copy of ctx carrying s, so spans started with it are
+// children of s.
+func NewContext(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// Extract returns a copy of ctx carrying the trace context of the
+// traceparent header in h, if it has a valid one, so spans started with it
+// continue the caller's trace.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, ok := ParseTraceparent(h.Get(TraceparentHeader))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Inject sets the traceparent header in h to the span carried by ctx, so
+// the receiver continues its trace. Without a span h is left unchanged,
+// and an incoming traceparent copied into h is passed on as it is.
+func Inject(ctx context.Context, h http.Header) {
+	if s := FromContext(ctx); s != nil {
+		h.Set(TraceparentHeader, s.Context.Traceparent())
+	}
+}
+
+// Start starts a span named name, a child of the span carried by ctx or of
+// the trace context extracted into it, and returns a copy of ctx carrying
+// the new span. It returns ctx and a nil span when tracing is off. The
+// caller must call End on the span.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	t := tracer.Load()
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{Name: name, Kind: kind, StartTime: time.Now(), tracer: t}
+	switch {
+	case FromContext(ctx) != nil:
+		parent := FromContext(ctx).Context
+		s.Context.TraceID, s.Parent, s.Context.Sampled = parent.TraceID, parent.SpanID, parent.Sampled
+	case ctx.Value(remoteKey{}) != nil:
+		parent := ctx.Value(remoteKey{}).(SpanContext)
+		s.Context.TraceID, s.Parent, s.Context.Sampled = parent.TraceID, parent.SpanID, parent.Sampled
+	default:
+		_, _ = rand.Read(s.Context.TraceID[:])
+		s.Context.Sampled = true
+	}
+	_, _ = rand.Read(s.Context.SpanID[:])
+	if !s.Context.Sampled {
+		s.tracer = nil
+	}
+	return NewContext(ctx, s), s
+}
+
+// Exporter sends finished spans to a tracing backend. A Tracer calls
+// Export from one goroutine at a time.
+type Exporter interface {
+	Export(spans []*Span) error
+	Close() error
+}
+
+// Defaults used by NewTracer.
+const (
+	// DefaultQueue is how many finished spans a Tracer holds for export.
+	// Spans finished while it is full are dropped, so tracing never holds
+	// up requests.
+	DefaultQueue = 2048
+	// DefaultBatch is the most spans exported at once.
+	DefaultBatch = 512
+	// DefaultInterval is how long a span may wait to be exported.
+	DefaultInterval = 5 * time.Second
+)
+
+var tracer atomic.Pointer[Tracer]
+
+// SetTracer makes t record the spans started from now on; nil turns
+// tracing off.
+func SetTracer(t *Tracer) {
+	tracer.Store(t)
+}
+
+// Tracer exports finished spans in batches in the background.
+type Tracer struct {
+	exporter Exporter
+	spans    chan *Span
+	done     chan struct{}
+	dropped  atomic.Int64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewTracer returns a Tracer exporting to e and starts its exporter.
+func NewTracer(e Exporter) *Tracer {
+	t := &Tracer{exporter: e, spans: make(chan *Span, DefaultQueue), done: make(chan struct{})}
+	go t.run()
+	return t
+}
+
+func (t *Tracer) queue(s *Span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(DefaultInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	export := func() {
+		if n := t.dropped.Swap(0); n > 0 {
+			slog.Warn("Dropped spans: export queue full", "spans", n)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			slog.Error("Failed to export spans", "spans", len(batch), "error", err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				export()
+				return
+			}
+			if batch = append(batch, s); len(batch) >= DefaultBatch {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		}
+	}
+}
+
+// Close exports the spans still queued and closes the exporter. Spans
+// ended after Close are dropped.
+func (t *Tracer) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.spans)
+	t.mu.Unlock()
+
+	<-t.done
+	return t.exporter.Close()
+}
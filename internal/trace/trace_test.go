@@ -0,0 +1,146 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// recordExporter keeps exported spans.
+type recordExporter struct {
+	spans  []*Span
+	closed bool
+}
+
+func (e *recordExporter) Export(spans []*Span) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordExporter) Close() error {
+	e.closed = true
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(valid)
+	if !ok || !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Fatalf("ParseTraceparent(%q) = %+v, %v", valid, sc, ok)
+	}
+	if sc.Traceparent() != valid {
+		t.Errorf("Traceparent() = %q, want %q", sc.Traceparent(), valid)
+	}
+	for s, want := range map[string]bool{
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra": true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra": false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":       false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":       false,
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01":       false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7":          false,
+		"": false,
+	} {
+		if _, ok := ParseTraceparent(s); ok != want {
+			t.Errorf("ParseTraceparent(%q) reported %v, want %v", s, ok, want)
+		}
+	}
+}
+
+func TestStart_ContinuesTraceAndExports(t *testing.T) {
+	if _, span := Start(context.Background(), "off", KindInternal); span != nil {
+		t.Fatalf("Expected no span while tracing is off")
+	}
+
+	exporter := &recordExporter{}
+	tracer := NewTracer(exporter)
+	SetTracer(tracer)
+	defer SetTracer(nil)
+
+	incoming := http.Header{}
+	incoming.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, server := Start(Extract(context.Background(), incoming), "POST", KindServer)
+	_, child := Start(ctx, "validator.rules", KindInternal)
+	child.SetAttributes(Int("fhir.validation.issues", 2))
+	child.SetError(errors.New("boom"))
+	child.End()
+	child.End()
+
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	server.End()
+
+	unsampled := http.Header{}
+	unsampled.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, dropped := Start(Extract(context.Background(), unsampled), "GET", KindServer)
+	dropped.End()
+
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !exporter.closed || len(exporter.spans) != 2 {
+		t.Fatalf("Expected 2 sampled spans exported and the exporter closed, got %d", len(exporter.spans))
+	}
+	if server.Context.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || server.Parent.String() != "00f067aa0ba902b7" {
+		t.Errorf("Expected the server span to continue the incoming trace, got %s parent %s", server.Context.TraceID, server.Parent)
+	}
+	if child.Context.TraceID != server.Context.TraceID || child.Parent != server.Context.SpanID {
+		t.Errorf("Expected the child span under the server span")
+	}
+	if got := outgoing.Get(TraceparentHeader); got != server.Context.Traceparent() {
+		t.Errorf("Injected traceparent %q, want %q", got, server.Context.Traceparent())
+	}
+	if dropped.Context.Sampled || dropped.Context.SpanID == (SpanID{}) {
+		t.Errorf("Expected an unsampled span with its own ID, got %+v", dropped.Context)
+	}
+}
+
+func TestEncode_OTLPJSON(t *testing.T) {
+	tracer := NewTracer(&recordExporter{})
+	SetTracer(tracer)
+	defer func() { SetTracer(nil); _ = tracer.Close() }()
+	_, span := Start(context.Background(), "forward", KindClient)
+	span.SetAttributes(String("server.address", "fhir.example"), Int("http.response.status_code", 503), Bool("retry", true))
+	span.SetErrorMessage("503 Service Unavailable")
+	span.End()
+
+	b, err := encode([]*Span{span})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID           string `json:"traceId"`
+					ParentSpanID      string `json:"parentSpanId"`
+					Kind              int    `json:"kind"`
+					StartTimeUnixNano string `json:"startTimeUnixNano"`
+					Attributes        []struct {
+						Key   string                 `json:"key"`
+						Value map[string]interface{} `json:"value"`
+					} `json:"attributes"`
+					Status struct {
+						Code    int    `json:"code"`
+						Message string `json:"message"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		t.Fatal(err)
+	}
+	got := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if got.TraceID != span.Context.TraceID.String() || got.ParentSpanID != "" || got.Kind != int(KindClient) || got.StartTimeUnixNano == "" {
+		t.Errorf("Unexpected span %+v", got)
+	}
+	if got.Attributes[1].Value["intValue"] != "503" || got.Attributes[2].Value["boolValue"] != true {
+		t.Errorf("Unexpected attributes %+v", got.Attributes)
+	}
+	if got.Status.Code != statusError || !strings.Contains(got.Status.Message, "503") {
+		t.Errorf("Expected an error status, got %+v", got.Status)
+	}
+}
@@ -0,0 +1,89 @@
+package validator
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func loadBenchConfig(b *testing.B) {
+	b.Helper()
+	if err := LoadRules("../../configs/rules.yaml"); err != nil {
+		b.Fatalf("Failed to load rules: %v", err)
+	}
+	if err := LoadRecipes("../../configs/recipes.yaml"); err != nil {
+		b.Fatalf("Failed to load recipes: %v", err)
+	}
+}
+
+func benchPatient(id string) map[string]interface{} {
+	return map[string]interface{}{
+		"resourceType": "Patient",
+		"id":           id,
+		"active":       true,
+		"gender":       "female",
+		"birthDate":    "1980-01-01",
+		"name":         []interface{}{map[string]interface{}{"family": "Smith"}},
+		"address":      []interface{}{map[string]interface{}{"postalCode": "CF10 1EP"}},
+	}
+}
+
+func benchBundle(patients int) map[string]interface{} {
+	entries := make([]interface{}, 0, patients+1)
+	targets := make([]interface{}, 0, patients)
+	for i := 0; i < patients; i++ {
+		id := fmt.Sprintf("pat%d", i)
+		entries = append(entries, map[string]interface{}{"resource": benchPatient(id)})
+		targets = append(targets, map[string]interface{}{"reference": "Patient/" + id})
+	}
+	entries = append(entries, map[string]interface{}{
+		"resource": map[string]interface{}{
+			"resourceType": "Provenance",
+			"id":           "prov1",
+			"target":       targets,
+		},
+	})
+	return map[string]interface{}{
+		"resourceType": "Bundle",
+		"type":         "transaction",
+		"entry":        entries,
+	}
+}
+
+func BenchmarkApplyExtraRules(b *testing.B) {
+	loadBenchConfig(b)
+	patient := benchPatient("pat1")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if errs := ApplyExtraRules("Patient", patient); len(errs) != 0 {
+			b.Fatalf("unexpected errors: %v", errs)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "resources/s")
+}
+
+func BenchmarkValidateTransactionBundle(b *testing.B) {
+	loadBenchConfig(b)
+
+	defer func(n int) { EntryWorkers = n }(EntryWorkers)
+
+	for _, workers := range []int{1, runtime.GOMAXPROCS(0) * 2} {
+		for _, size := range []int{100, 1000, 5000} {
+			b.Run(fmt.Sprintf("workers=%d/entries=%d", workers, size), func(b *testing.B) {
+				EntryWorkers = workers
+				bundle := benchBundle(size)
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if result := Validate(bundle); !result.Valid {
+						b.Fatalf("unexpected errors: %v", result.Errors)
+					}
+				}
+				b.ReportMetric(float64(size*b.N)/b.Elapsed().Seconds(), "resources/s")
+			})
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package validator
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// EntryWorkers bounds how many bundle entries are validated concurrently.
+// Values below 2 validate entries sequentially.
+var EntryWorkers = runtime.GOMAXPROCS(0)
+
+// EntryRules also normalises each bundle entry's resource and checks it
+// against the profiles and field rules for its resourceType. It is off by
+// default: entries are otherwise only checked as part of the transaction,
+// for references, recipes and the Provenance.
+var EntryRules bool
+
+// entryResult holds what validating a single bundle entry produced.
+type entryResult struct {
+	issues       []Issue
+	refs         []string
+	resourceType string
+	id           string
+	fullURL      string
+}
+
+// validateEntry indexes the entry at position i, whose fullUrl is fullURL,
+// and runs the per-resource checks of plan on it when EntryRules is set.
+// It only reads shared state, so entries can be validated concurrently.
+func validateEntry(plan *RulePlan, i int, fullURL string, resource map[string]interface{}) entryResult {
+	res := entryResult{refs: collectReferences(resource), fullURL: fullURL}
+
+	base := fmt.Sprintf("Bundle.entry[%d].resource", i)
+	rt, ok := resource["resourceType"].(string)
+	if !ok {
+		if !EntryRules {
+			return res
+		}
+		issue := errorIssue(base + ": Missing or invalid resourceType")
+		issue.Expression = base
+		res.issues = []Issue{issue}
+		return res
+	}
+	res.resourceType = rt
+	res.id, _ = resource["id"].(string)
+	if !EntryRules {
+		return res
+	}
+
+	res.issues = append(plan.normalize(rt, resource, base), profileIssues(resource, base)...)
+	res.issues = append(res.issues, plan.issues(rt, resource, base)...)
+	for j := range res.issues {
+		res.issues[j].Diagnostics = base + ": " + res.issues[j].Diagnostics
+	}
+	return res
+}
+
+// entryPool validates bundle entries on a bounded number of goroutines and
+// keeps their results in entry order.
+type entryPool struct {
+	plan    *RulePlan
+	jobs    chan entryJob
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	results []entryResult
+}
+
+type entryJob struct {
+	slot     int
+	entry    int
+	fullURL  string
+	resource map[string]interface{}
+}
+
+func newEntryPool(plan *RulePlan) *entryPool {
+	p := &entryPool{plan: plan}
+	if EntryWorkers < 2 {
+		return p
+	}
+	p.jobs = make(chan entryJob, EntryWorkers)
+	for w := 0; w < EntryWorkers; w++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				res := validateEntry(p.plan, job.entry, job.fullURL, job.resource)
+				p.mu.Lock()
+				p.results[job.slot] = res
+				p.mu.Unlock()
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues the resource of the entry at position i, whose fullUrl is
+// fullURL.
+func (p *entryPool) submit(i int, fullURL string, resource map[string]interface{}) {
+	p.mu.Lock()
+	slot := len(p.results)
+	p.results = append(p.results, entryResult{})
+	p.mu.Unlock()
+
+	if p.jobs == nil {
+		p.results[slot] = validateEntry(p.plan, i, fullURL, resource)
+		return
+	}
+	p.jobs <- entryJob{slot: slot, entry: i, fullURL: fullURL, resource: resource}
+}
+
+// wait blocks until every submitted entry is validated and returns an index
+// built from the results in entry order.
+func (p *entryPool) wait() *bundleIndex {
+	if p.jobs != nil {
+		close(p.jobs)
+		p.wg.Wait()
+	}
+	index := newBundleIndex()
+	for _, res := range p.results {
+		index.add(res)
+	}
+	return index
+}
+
+// bundleIndex accumulates what the transaction checks need from each entry,
+// so a bundle can be checked without holding every resource in memory.
+type bundleIndex struct {
+	entryIssues []Issue
+	found       map[string]bool
+	ids         map[string]bool
+	// fullURLs maps each entry's fullUrl, such as "urn:uuid:...", to its
+	// resourceType, so references to it resolve.
+	fullURLs map[string]string
+	// refs holds every reference, with the resourceType of its source.
+	refs []entryRef
+	// entries describes every decoded entry, when the bundle was streamed.
+	entries []BundleEntry
+}
+
+// entryRef is a reference made by a bundle entry of resourceType source.
+type entryRef struct {
+	source string
+	ref    string
+}
+
+func newBundleIndex() *bundleIndex {
+	return &bundleIndex{
+		found:    map[string]bool{},
+		ids:      map[string]bool{},
+		fullURLs: map[string]string{},
+	}
+}
+
+// add records the result of validating a single entry.
+func (ix *bundleIndex) add(res entryResult) {
+	ix.entryIssues = append(ix.entryIssues, res.issues...)
+	for _, ref := range res.refs {
+		ix.refs = append(ix.refs, entryRef{source: res.resourceType, ref: ref})
+	}
+
+	rt := res.resourceType
+	if rt == "" {
+		return
+	}
+	ix.found[rt] = true
+	if res.id != "" {
+		ix.ids[rt+"/"+res.id] = true
+	}
+	if res.fullURL != "" {
+		ix.fullURLs[res.fullURL] = rt
+	}
+}
+
+// resolve returns the resourceType a reference points to and whether an
+// entry of the bundle is its target, by fullUrl or by "Type/id". The type
+// of an unresolved "Type/id" reference is still returned.
+func (ix *bundleIndex) resolve(ref string) (string, bool) {
+	if rt, ok := ix.fullURLs[ref]; ok {
+		return rt, true
+	}
+	rt, _, ok := strings.Cut(ref, "/")
+	if !ok {
+		return "", false
+	}
+	return rt, ix.ids[ref]
+}
+
+// targets returns, per source resourceType, the resourceTypes its entries
+// reference.
+func (ix *bundleIndex) targets() map[string]map[string]bool {
+	targets := map[string]map[string]bool{}
+	for _, r := range ix.refs {
+		target, _ := ix.resolve(r.ref)
+		if r.source == "" || target == "" {
+			continue
+		}
+		if targets[r.source] == nil {
+			targets[r.source] = map[string]bool{}
+		}
+		targets[r.source][target] = true
+	}
+	return targets
+}
+
+// issues returns the per-entry issues in entry order, followed by the
+// cross-entry transaction checks, including those of the default recipe,
+// over everything added so far.
+func (ix *bundleIndex) issues(recipes map[string]Recipe) []Issue {
+	issues := append([]Issue{}, ix.entryIssues...)
+
+	if !ix.found["Provenance"] {
+		issues = append(issues, errorIssue("Missing required Provenance resource in transaction"))
+	}
+
+	if recipe, hasRecipe := recipes["default"]; hasRecipe {
+		for _, req := range recipe.RequiredResources {
+			if !ix.found[req.ResourceType] {
+				issue := errorIssue("Missing required resource in bundle: " + req.ResourceType)
+				issue.RuleID = requiredResourceID("default", req.ResourceType)
+				issues = append(issues, issue)
+			}
+		}
+
+		// MustReference
+		targets := ix.targets()
+		for _, rule := range recipe.MustReference {
+			if !targets[rule.Source][rule.Target] {
+				issue := errorIssue(fmt.Sprintf("No %s -> %s reference found", rule.Source, rule.Target))
+				issue.RuleID = mustReferenceID("default", rule.Source, rule.Target)
+				issues = append(issues, issue)
+			}
+		}
+	}
+
+	for _, r := range ix.refs {
+		if _, ok := ix.resolve(r.ref); !ok {
+			issues = append(issues, errorIssue("Unresolved reference: "+r.ref))
+		}
+	}
+
+	return issues
+}
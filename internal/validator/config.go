@@ -0,0 +1,93 @@
+package validator
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// LoadConfigDir loads the profiles, rules and recipes of a configuration
+// directory laid out like configs/: a profiles/ directory, an optional
+// packages/ directory of FHIR packages, rules.yaml and recipes.yaml. The
+// outcome, and the hash of each file in dir, is reported by Status.
+func LoadConfigDir(dir string) error {
+	loaded := time.Now().UTC()
+	err := loadConfigDir(dir)
+	var files []ConfigFile
+	if err == nil {
+		files, err = hashConfigFiles(dir, loaded)
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	configErr, configReloadErr = err, nil
+	if err == nil {
+		configFiles, configLoaded = files, loaded
+	}
+	return err
+}
+
+// ReloadConfigDir reloads rules.yaml and recipes.yaml from dir into a
+// running proxy, replacing the active rules and recipes rather than adding
+// to them. If either fails to load, the active ones are kept, and the
+// error is reported by Status without affecting ConfigReady. Profiles and
+// packages are only loaded by LoadConfigDir.
+func ReloadConfigDir(dir string) error {
+	loaded := time.Now().UTC()
+	err := reloadRules(dir)
+	var files []ConfigFile
+	if err == nil {
+		files, err = hashConfigFiles(dir, loaded)
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	configReloadErr = err
+	if err == nil {
+		configFiles, configLoaded = files, loaded
+	}
+	return err
+}
+
+func reloadRules(dir string) error {
+	rules, err := readRules(filepath.Join(dir, "rules.yaml"), nil)
+	if err != nil {
+		return fmt.Errorf("failed to load rules: %w", err)
+	}
+	plan, err := CompileRules(rules)
+	if err != nil {
+		return fmt.Errorf("failed to load rules: %w", err)
+	}
+	recipes, err := readRecipes(filepath.Join(dir, "recipes.yaml"))
+	if err != nil {
+		return fmt.Errorf("failed to load recipes: %w", err)
+	}
+	if recipes == nil {
+		recipes = map[string]Recipe{}
+	}
+
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	ExtraRules, activePlan, Recipes = rules, plan, recipes
+	return nil
+}
+
+func loadConfigDir(dir string) error {
+	// FHIR Packages (implementation guides), overridden by local profiles
+	if err := LoadPackages(filepath.Join(dir, "packages")); err != nil {
+		return fmt.Errorf("failed to load packages: %w", err)
+	}
+	// FHIR Profiles
+	if err := LoadProfiles(filepath.Join(dir, "profiles")); err != nil {
+		return fmt.Errorf("failed to load profiles: %w", err)
+	}
+	// FHIR Rules
+	if err := LoadRules(filepath.Join(dir, "rules.yaml")); err != nil {
+		return fmt.Errorf("failed to load rules: %w", err)
+	}
+	// Bundle Recipes
+	if err := LoadRecipes(filepath.Join(dir, "recipes.yaml")); err != nil {
+		return fmt.Errorf("failed to load recipes: %w", err)
+	}
+	return nil
+}
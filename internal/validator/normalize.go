@@ -0,0 +1,133 @@
+package validator
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Normalize describes corrections made to a field before it is validated.
+// They are applied in the order trim, uppercase, map, then default.
+type Normalize struct {
+	// Trim removes leading and trailing whitespace from string values.
+	Trim bool `yaml:"trim" json:"trim,omitempty"`
+	// Uppercase converts string values to upper case.
+	Uppercase bool `yaml:"uppercase" json:"uppercase,omitempty"`
+	// Map replaces string values that are keys of the map with their value.
+	// Values must be scalars, so configs mapping to a list or an object
+	// fail to load.
+	Map map[string]string `yaml:"map" json:"map,omitempty"`
+	// Default is set when the field is missing from an element that exists.
+	Default interface{} `yaml:"default" json:"default,omitempty"`
+}
+
+// checkNormalize names normalisation in rule IDs.
+const checkNormalize = "normalize"
+
+// normalizes reports whether any rule in the plan corrects resources.
+func (p *RulePlan) normalizes() bool {
+	for rt := range p.byType {
+		if p.normalizesType(rt) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizesType reports whether any rule in the plan corrects resources
+// of type rt.
+func (p *RulePlan) normalizesType(rt string) bool {
+	for _, cr := range p.byType[rt] {
+		if cr.rule.Normalize != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize applies the plan's normalisation rules for resourceType to a
+// resource in place and returns an information issue for each change.
+// Issue expressions are rooted at base, as for issues. Issues name only the
+// path, as the values are patient data.
+func (p *RulePlan) normalize(resourceType string, resource map[string]interface{}, base string) []Issue {
+	var issues []Issue
+	for _, cr := range p.byType[resourceType] {
+		n := cr.rule.Normalize
+		if n == nil || !p.applies(cr) {
+			continue
+		}
+		changed := func(message string) {
+			issues = append(issues, Issue{
+				Severity:    SeverityInformation,
+				Code:        "informational",
+				Diagnostics: message,
+				Expression:  base + "." + cr.path,
+				RuleID:      ruleID(resourceType, cr.path, checkNormalize),
+			})
+		}
+
+		leaf := cr.segments[len(cr.segments)-1]
+		eachParent(resource, cr.segments[:len(cr.segments)-1], func(parent map[string]interface{}) {
+			val, ok := parent[leaf]
+			if !ok {
+				if n.Default != nil {
+					parent[leaf] = n.Default
+					changed(fmt.Sprintf("Set missing %s to default %v", cr.path, n.Default))
+				}
+				return
+			}
+			if values, ok := val.([]interface{}); ok {
+				for i, v := range values {
+					if to, ok := n.apply(v); ok {
+						changed("Normalised " + cr.path)
+						values[i] = to
+					}
+				}
+				return
+			}
+			if to, ok := n.apply(val); ok {
+				changed("Normalised " + cr.path)
+				parent[leaf] = to
+			}
+		})
+	}
+	return issues
+}
+
+// apply returns the corrected form of a string value and whether it
+// differs from v.
+func (n *Normalize) apply(v interface{}) (interface{}, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return v, false
+	}
+	t := s
+	if n.Trim {
+		t = strings.TrimSpace(t)
+	}
+	if n.Uppercase {
+		t = strings.ToUpper(t)
+	}
+	if mapped, ok := n.Map[t]; ok {
+		return mapped, mapped != s
+	}
+	return t, t != s
+}
+
+// eachParent calls fn for every element reached by following segments from
+// resource, descending into each element of arrays along the way.
+func eachParent(resource map[string]interface{}, segments []string, fn func(map[string]interface{})) {
+	if len(segments) == 0 {
+		fn(resource)
+		return
+	}
+	switch v := resource[segments[0]].(type) {
+	case map[string]interface{}:
+		eachParent(v, segments[1:], fn)
+	case []interface{}:
+		for _, item := range v {
+			if itemMap, ok := item.(map[string]interface{}); ok {
+				eachParent(itemMap, segments[1:], fn)
+			}
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package validator
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PackageCacheDir is the local FHIR package cache, laid out as
+// {name}#{version}/package/, where package dependencies are found when they
+// are not in the packages directory itself. Nothing is downloaded.
+var PackageCacheDir = defaultPackageCacheDir()
+
+func defaultPackageCacheDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".fhir", "packages")
+}
+
+// fhirPackage is a FHIR NPM package, either a package.tgz or an extracted
+// directory containing package/package.json.
+type fhirPackage struct {
+	Name         string            `json:"name"`
+	Version      string            `json:"version"`
+	Dependencies map[string]string `json:"dependencies"`
+
+	path string
+	tgz  bool
+}
+
+func (p *fhirPackage) id() string { return p.Name + "#" + p.Version }
+
+// packageIndex lists the files of an extracted package by resourceType, as
+// in its .index.json.
+type packageIndex struct {
+	Files []struct {
+		Filename     string `json:"filename"`
+		ResourceType string `json:"resourceType"`
+	} `json:"files"`
+}
+
+// LoadPackages loads the conformance resources of every FHIR package in dir
+// (package .tgz files or extracted package directories) and of the packages
+// they depend on, found in dir or PackageCacheDir. A missing dependency is
+// an error. Only the StructureDefinitions, ValueSets and CodeSystems
+// directly in package/ are loaded; examples/ and other subdirectories are
+// not read, and files that do not parse are skipped with a warning.
+// Resources without a version take their package's version, marked as
+// VersionInferred.
+func LoadPackages(dir string) error {
+	roots, err := findPackages(dir)
+	if err != nil || len(roots) == 0 {
+		return err
+	}
+	available := map[string][]*fhirPackage{}
+	for _, p := range roots {
+		available[p.Name] = append(available[p.Name], p)
+	}
+	if PackageCacheDir != "" {
+		cached, err := findPackages(PackageCacheDir)
+		if err != nil {
+			return err
+		}
+		for _, p := range cached {
+			available[p.Name] = append(available[p.Name], p)
+		}
+	}
+
+	loaded := map[string]bool{}
+	var load func(p *fhirPackage, from string) error
+	load = func(p *fhirPackage, from string) error {
+		if loaded[p.id()] {
+			return nil
+		}
+		loaded[p.id()] = true
+		// Dependencies first, so the package's own resources win
+		names := make([]string, 0, len(p.Dependencies))
+		for name := range p.Dependencies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			dep := resolvePackage(available[name], p.Dependencies[name])
+			if dep == nil {
+				return fmt.Errorf("package %s%s depends on %s#%s, which is not in %s or the package cache",
+					p.id(), from, name, p.Dependencies[name], dir)
+			}
+			if err := load(dep, from+" <- "+p.id()); err != nil {
+				return err
+			}
+		}
+		if err := loadPackageResources(p); err != nil {
+			return fmt.Errorf("failed to load package %s: %w", p.id(), err)
+		}
+		return nil
+	}
+	for _, p := range roots {
+		if err := load(p, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findPackages returns the packages directly in dir. A missing dir has no
+// packages.
+func findPackages(dir string) ([]*fhirPackage, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var packages []*fhirPackage
+	for _, entry := range entries {
+		p := &fhirPackage{path: filepath.Join(dir, entry.Name())}
+		switch {
+		case !entry.IsDir() && strings.HasSuffix(entry.Name(), ".tgz"):
+			p.tgz = true
+			err = readTgz(p.path, func(name string, r io.Reader) error {
+				if name != "package.json" {
+					return nil
+				}
+				return json.NewDecoder(r).Decode(p)
+			})
+		case entry.IsDir():
+			var data []byte
+			// #nosec G304 -- path is under the configured packages directory
+			data, err = os.ReadFile(filepath.Join(p.path, "package", "package.json"))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err == nil {
+				err = json.Unmarshal(data, p)
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading package %s: %w", p.path, err)
+		}
+		if p.Name == "" || p.Version == "" {
+			return nil, fmt.Errorf("error reading package %s: package.json has no name or version", p.path)
+		}
+		packages = append(packages, p)
+	}
+	return packages, nil
+}
+
+// resolvePackage returns the package matching a dependency version: an
+// exact version, a pattern such as 1.0.x, or "latest". The highest matching
+// version wins.
+func resolvePackage(candidates []*fhirPackage, version string) *fhirPackage {
+	var best *fhirPackage
+	for _, p := range candidates {
+		if !packageVersionMatches(p.Version, version) {
+			continue
+		}
+		if best == nil || compareVersions(p.Version, best.Version) > 0 {
+			best = p
+		}
+	}
+	return best
+}
+
+func packageVersionMatches(version, want string) bool {
+	if want == "" || want == "latest" || want == version {
+		return true
+	}
+	if !strings.HasSuffix(want, ".x") {
+		return false
+	}
+	return strings.HasPrefix(version, strings.TrimSuffix(want, "x"))
+}
+
+// compareVersions compares dotted versions numerically where both parts are
+// numbers, and as strings otherwise.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		switch {
+		case aerr == nil && berr == nil && an != bn:
+			if an < bn {
+				return -1
+			}
+			return 1
+		case (aerr != nil || berr != nil) && as[i] != bs[i]:
+			return strings.Compare(as[i], bs[i])
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// loadPackageResources adds the conformance resources in the package
+// directory of p. Extracted packages are read through their .index.json
+// when they have one, so only conformance resources are parsed.
+func loadPackageResources(p *fhirPackage) error {
+	if p.tgz {
+		return readTgz(p.path, func(name string, r io.Reader) error {
+			if !strings.HasSuffix(name, ".json") || name == "package.json" || name == ".index.json" {
+				return nil
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			addPackageResource(p, name, data)
+			return nil
+		})
+	}
+
+	dir := filepath.Join(p.path, "package")
+	files, indexed := indexedFiles(p, dir)
+	if !indexed {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.IsDir() && strings.HasSuffix(name, ".json") && name != "package.json" && name != ".index.json" {
+				files = append(files, name)
+			}
+		}
+	}
+	for _, name := range files {
+		// #nosec G304 -- path is under the configured packages directory
+		data, err := os.ReadFile(filepath.Join(dir, filepath.Base(name)))
+		if err != nil {
+			return err
+		}
+		addPackageResource(p, name, data)
+	}
+	return nil
+}
+
+// indexedFiles returns the conformance resources listed in the .index.json
+// of dir, the package directory of the extracted package p, or false if it
+// has no readable index.
+func indexedFiles(p *fhirPackage, dir string) ([]string, bool) {
+	// #nosec G304 -- path is under the configured packages directory
+	data, err := os.ReadFile(filepath.Join(dir, ".index.json"))
+	if err != nil {
+		return nil, false
+	}
+	var index packageIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		slog.Warn("Ignored an unreadable FHIR package index", "package", p.id(), "error", err)
+		return nil, false
+	}
+	var files []string
+	for _, f := range index.Files {
+		if _, ok := conformanceTypes[f.ResourceType]; ok {
+			files = append(files, f.Filename)
+		}
+	}
+	return files, true
+}
+
+// addPackageResource adds the file name of p if it is a conformance
+// resource. Other resources are skipped, and so, with a warning, are files
+// that do not parse, so one bad file does not fail the package.
+func addPackageResource(p *fhirPackage, name string, data []byte) {
+	var header struct {
+		ResourceType string `json:"resourceType"`
+	}
+	err := json.Unmarshal(data, &header)
+	if err == nil {
+		if _, ok := conformanceTypes[header.ResourceType]; !ok {
+			slog.Debug("Skipped a FHIR package file that is not a conformance resource",
+				"package", p.id(), "file", name, "resourceType", header.ResourceType)
+			return
+		}
+		err = addConformanceVersion(data, p.Version)
+	}
+	if err != nil {
+		slog.Warn("Skipped an unreadable FHIR package file", "package", p.id(), "file", name, "error", err)
+	}
+}
+
+// readTgz calls fn for each regular file directly in the package/ directory
+// of a package .tgz, with its name relative to package/.
+func readTgz(file string, fn func(name string, r io.Reader) error) error {
+	// #nosec G304 -- path is under the configured packages directory
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = gz.Close() }()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		dir, name := path.Split(path.Clean(strings.TrimPrefix(hdr.Name, "./")))
+		if dir != "package/" {
+			continue
+		}
+		if err := fn(name, tr); err != nil {
+			return err
+		}
+	}
+}
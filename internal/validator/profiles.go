@@ -5,15 +5,42 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
-// Profiles holds loaded FHIR StructureDefinitions by URL.
+// Profiles holds loaded FHIR StructureDefinitions by canonical reference
+// (url|version, or url when they have no version), so several versions of a
+// profile can be loaded side by side.
 var Profiles = map[string]StructureDefinition{}
 
+// ValueSets and CodeSystems hold loaded terminology resources by canonical
+// reference, as Profiles does.
+var (
+	ValueSets   = map[string]Conformance{}
+	CodeSystems = map[string]Conformance{}
+)
+
+// Conformance describes a loaded conformance resource and keeps its
+// original JSON, so it can be served as it was published.
+type Conformance struct {
+	ResourceType string `json:"resourceType"`
+	ID           string `json:"id"`
+	URL          string `json:"url"`
+	Version      string `json:"version"`
+	Name         string `json:"name"`
+	// Type is the resourceType a StructureDefinition constrains.
+	Type string `json:"type"`
+	// VersionInferred is set when the resource has no version of its own
+	// and Version is that of the package it was loaded from.
+	VersionInferred bool `json:"-"`
+	// Raw is the resource as it was loaded.
+	Raw json.RawMessage `json:"-"`
+}
+
 // StructureDefinition represents a FHIR StructureDefinition profile.
 type StructureDefinition struct {
-	URL      string `json:"url"`
+	Conformance
 	Snapshot struct {
 		Element []ElementDefinition `json:"element"`
 	} `json:"snapshot"`
@@ -25,7 +52,9 @@ type ElementDefinition struct {
 	Min  int    `json:"min"`
 }
 
-// LoadProfiles loads FHIR StructureDefinitions from a directory.
+// LoadProfiles loads FHIR StructureDefinitions, ValueSets and CodeSystems
+// from a directory. Files without a resourceType are read as
+// StructureDefinitions; other resource types are ignored.
 func LoadProfiles(dir string) error {
 	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".json") {
@@ -37,15 +66,170 @@ func LoadProfiles(dir string) error {
 		if err != nil {
 			return err
 		}
-
-		var sd StructureDefinition
-		if err := json.Unmarshal(data, &sd); err != nil {
+		if err := addConformance(data); err != nil {
 			return fmt.Errorf("error parsing profile %s: %w", path, err)
 		}
+		return nil
+	})
+}
 
-		if sd.URL != "" {
-			Profiles[sd.URL] = sd
-		}
+// conformanceTypes are the resource types LoadProfiles and LoadPackages
+// keep.
+var conformanceTypes = map[string]struct{}{
+	"StructureDefinition": {},
+	"ValueSet":            {},
+	"CodeSystem":          {},
+}
+
+// addConformance parses a conformance resource and adds it to the map for
+// its resourceType.
+func addConformance(data []byte) error {
+	return addConformanceVersion(data, "")
+}
+
+// addConformanceVersion is addConformance, giving resources without a
+// version the version defaultVersion and marking it as inferred.
+func addConformanceVersion(data []byte, defaultVersion string) error {
+	var sd StructureDefinition
+	if err := json.Unmarshal(data, &sd); err != nil {
+		return err
+	}
+	if sd.URL == "" {
 		return nil
+	}
+	if sd.Version == "" && defaultVersion != "" {
+		sd.Version, sd.VersionInferred = defaultVersion, true
+	}
+	sd.Raw = append(json.RawMessage(nil), data...)
+
+	key := Canonical(sd.URL, sd.Version)
+	switch sd.ResourceType {
+	case "", "StructureDefinition":
+		Profiles[key] = sd
+	case "ValueSet":
+		ValueSets[key] = sd.Conformance
+	case "CodeSystem":
+		CodeSystems[key] = sd.Conformance
+	}
+	return nil
+}
+
+// Canonical returns the canonical reference to version of url.
+func Canonical(url, version string) string {
+	if version == "" {
+		return url
+	}
+	return url + "|" + version
+}
+
+// ResolveProfile returns the StructureDefinition a canonical reference
+// names. A reference with a version (url|version) must match it exactly;
+// one without resolves to the latest loaded version.
+func ResolveProfile(ref string) (StructureDefinition, bool) {
+	return resolveCanonical(Profiles, ref, func(sd StructureDefinition) Conformance { return sd.Conformance })
+}
+
+// ResolveValueSet resolves a canonical reference to a ValueSet as
+// ResolveProfile does.
+func ResolveValueSet(ref string) (Conformance, bool) {
+	return resolveCanonical(ValueSets, ref, func(c Conformance) Conformance { return c })
+}
+
+// ResolveCodeSystem resolves a canonical reference to a CodeSystem as
+// ResolveProfile does.
+func ResolveCodeSystem(ref string) (Conformance, bool) {
+	return resolveCanonical(CodeSystems, ref, func(c Conformance) Conformance { return c })
+}
+
+func resolveCanonical[T any](loaded map[string]T, ref string, conformance func(T) Conformance) (T, bool) {
+	ref, _, _ = strings.Cut(ref, "#")
+	if r, ok := loaded[ref]; ok || strings.Contains(ref, "|") {
+		return r, ok
+	}
+	var latest T
+	found := false
+	for _, r := range loaded {
+		c := conformance(r)
+		if c.URL != ref {
+			continue
+		}
+		if !found || compareVersions(c.Version, conformance(latest).Version) > 0 {
+			latest, found = r, true
+		}
+	}
+	return latest, found
+}
+
+// profileVersions returns the loaded versions of the profile url, in order.
+func profileVersions(url string) []string {
+	var versions []string
+	for _, sd := range Profiles {
+		if sd.URL == url && sd.Version != "" {
+			versions = append(versions, sd.Version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return compareVersions(versions[i], versions[j]) < 0 })
+	return versions
+}
+
+// profileIssues warns about profiles in meta.profile that claim a version
+// that is not loaded. Issue expressions are rooted at base.
+func profileIssues(resource map[string]interface{}, base string) []Issue {
+	meta, _ := resource["meta"].(map[string]interface{})
+	claimed, _ := meta["profile"].([]interface{})
+	var issues []Issue
+	for i, p := range claimed {
+		ref, ok := p.(string)
+		if !ok {
+			continue
+		}
+		url, version, versioned := strings.Cut(ref, "|")
+		if !versioned {
+			continue
+		}
+		if _, ok := ResolveProfile(ref); ok {
+			continue
+		}
+		message := fmt.Sprintf("Profile %s version %s is not loaded", url, version)
+		if versions := profileVersions(url); len(versions) > 0 {
+			message += "; loaded versions: " + strings.Join(versions, ", ")
+		}
+		issues = append(issues, Issue{
+			Severity:    SeverityWarning,
+			Code:        "not-found",
+			Diagnostics: message,
+			Expression:  fmt.Sprintf("%s.meta.profile[%d]", base, i),
+		})
+	}
+	return issues
+}
+
+// ConformanceResources returns the loaded resources of a conformance
+// resourceType (StructureDefinition, ValueSet or CodeSystem) ordered by URL
+// and version, and whether the type is served.
+func ConformanceResources(resourceType string) ([]Conformance, bool) {
+	var resources []Conformance
+	switch resourceType {
+	case "StructureDefinition":
+		for _, sd := range Profiles {
+			resources = append(resources, sd.Conformance)
+		}
+	case "ValueSet":
+		for _, c := range ValueSets {
+			resources = append(resources, c)
+		}
+	case "CodeSystem":
+		for _, c := range CodeSystems {
+			resources = append(resources, c)
+		}
+	default:
+		return nil, false
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		if resources[i].URL != resources[j].URL {
+			return resources[i].URL < resources[j].URL
+		}
+		return compareVersions(resources[i].Version, resources[j].Version) < 0
 	})
+	return resources, true
 }
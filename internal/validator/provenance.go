@@ -0,0 +1,87 @@
+package validator
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// InjectProvenance adds a Provenance resource to transaction bundles that
+// have none, for senders that cannot produce one themselves. Its agent is
+// the client the rule set is for (see ForClient), recorded is the time of
+// validation and its targets are every entry of the bundle. As the bundle
+// must be changed, transaction bundles are then validated in memory rather
+// than streamed.
+var InjectProvenance bool
+
+// proxyAgent names the proxy as the Provenance agent when the client is not
+// known.
+const proxyAgent = "fhir-validation-proxy"
+
+// addProvenance appends a Provenance entry to a transaction bundle that has
+// none and returns its position, or -1 if the bundle was left unchanged
+// because it has a Provenance or no entry to target.
+func (rs *RuleSet) addProvenance(bundle map[string]interface{}) int {
+	entries, ok := bundle["entry"].([]interface{})
+	if !ok {
+		return -1
+	}
+	var targets []interface{}
+	for _, e := range entries {
+		entry, ok := e.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		desc := describeEntry(entry)
+		if desc.ResourceType == "Provenance" {
+			return -1
+		}
+		switch {
+		case desc.FullURL != "":
+			targets = append(targets, map[string]interface{}{"reference": desc.FullURL})
+		case desc.ResourceType != "" && desc.ID != "":
+			targets = append(targets, map[string]interface{}{"reference": desc.ResourceType + "/" + desc.ID})
+		}
+	}
+	if len(targets) == 0 {
+		return -1
+	}
+	fullURL, err := newUUID()
+	if err != nil {
+		return -1
+	}
+
+	who := map[string]interface{}{"display": proxyAgent}
+	if rs.plan.client != "" {
+		who = map[string]interface{}{"identifier": map[string]interface{}{"value": rs.plan.client}}
+	}
+	provenance := map[string]interface{}{
+		"resourceType": "Provenance",
+		"target":       targets,
+		"recorded":     time.Now().UTC().Format(time.RFC3339),
+		"agent": []interface{}{map[string]interface{}{
+			"type": map[string]interface{}{"coding": []interface{}{map[string]interface{}{
+				"system": "http://terminology.hl7.org/CodeSystem/provenance-participant-type",
+				"code":   "author",
+			}}},
+			"who": who,
+		}},
+	}
+	bundle["entry"] = append(entries, map[string]interface{}{
+		"fullUrl":  "urn:uuid:" + fullURL,
+		"resource": provenance,
+		"request":  map[string]interface{}{"method": "POST", "url": "Provenance"},
+	})
+	return len(entries)
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -9,16 +9,17 @@ import (
 // Recipe represents a bundle recipe for required resources and references.
 type Recipe struct {
 	RequiredResources []struct {
-		ResourceType string `yaml:"resourceType"`
-	} `yaml:"requiredResources"`
+		ResourceType string `yaml:"resourceType" json:"resourceType"`
+	} `yaml:"requiredResources" json:"requiredResources,omitempty"`
 
 	MustReference []struct {
-		Source string `yaml:"source"`
-		Target string `yaml:"target"`
-	} `yaml:"mustReference"`
+		Source string `yaml:"source" json:"source"`
+		Target string `yaml:"target" json:"target"`
+	} `yaml:"mustReference" json:"mustReference,omitempty"`
 }
 
-// Recipes holds loaded recipes by name.
+// Recipes holds loaded recipes by name. Like ExtraRules, it is replaced
+// rather than modified when recipes are loaded.
 var Recipes = map[string]Recipe{}
 
 type recipeConfig struct {
@@ -27,20 +28,64 @@ type recipeConfig struct {
 
 // LoadRecipes loads bundle recipes from a YAML file.
 func LoadRecipes(path string) error {
+	recipes, err := readRecipes(path)
+	if err != nil {
+		return err
+	}
+
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	merged := make(map[string]Recipe, len(Recipes)+len(recipes))
+	for k, v := range Recipes {
+		merged[k] = v
+	}
+	for k, v := range recipes {
+		merged[k] = v
+	}
+	Recipes = merged
+	return nil
+}
+
+// readRecipes parses the transaction recipes of a recipes YAML file.
+func readRecipes(path string) (map[string]Recipe, error) {
 	// #nosec G304 -- path is controlled by caller and only YAML files are expected
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var config recipeConfig
 	if err := yaml.Unmarshal(data, &config); err != nil {
-		return err
+		return nil, err
 	}
+	return config.Transaction, nil
+}
 
-	for k, v := range config.Transaction {
-		Recipes[k] = v
-	}
+func requiredResourceID(recipe, resourceType string) string {
+	return "transaction." + recipe + ".requiredResources:" + resourceType
+}
 
-	return nil
+func mustReferenceID(recipe, source, target string) string {
+	return "transaction." + recipe + ".mustReference:" + source + "->" + target
+}
+
+// RuleIDs returns the IDs of every configured rule and recipe constraint,
+// as reported in Issue.RuleID.
+func RuleIDs() []string {
+	return active().RuleIDs()
+}
+
+// RuleIDs returns the IDs of every rule and recipe constraint in the rule
+// set, as reported in Issue.RuleID.
+func (rs *RuleSet) RuleIDs() []string {
+	ids := rs.plan.RuleIDs()
+	if recipe, ok := rs.recipes["default"]; ok {
+		for _, req := range recipe.RequiredResources {
+			ids = append(ids, requiredResourceID("default", req.ResourceType))
+		}
+		for _, rule := range recipe.MustReference {
+			ids = append(ids, mustReferenceID("default", rule.Source, rule.Target))
+		}
+	}
+	return ids
 }
@@ -4,76 +4,235 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 
 	"gopkg.in/yaml.v3"
 )
 
 // ExtraRules holds additional validation rules loaded from YAML.
+// LoadRules compiles it into the plan used by ApplyExtraRules. Loading
+// rules replaces it rather than modifying it; while requests are served,
+// read it with ActiveRules.
 var ExtraRules = map[string]map[string]FieldRule{}
 
+// activePlan is the compiled form of ExtraRules.
+var activePlan = &RulePlan{byType: map[string][]compiledRule{}}
+
+// rulesMu guards ExtraRules, activePlan and Recipes, which ReloadConfigDir
+// replaces while resources are being validated.
+var rulesMu sync.RWMutex
+
 // FieldRule represents a validation rule for a FHIR field.
 type FieldRule struct {
-	Min           int           `yaml:"min"`
-	Max           int           `yaml:"max"`
-	FixedValue    interface{}   `yaml:"fixedValue"`
-	AllowedValues []interface{} `yaml:"allowedValues"`
-	Pattern       string        `yaml:"pattern"`
-	MustSupport   bool          `yaml:"mustSupport"`
+	Min           int           `yaml:"min" json:"min,omitempty"`
+	Max           int           `yaml:"max" json:"max,omitempty"`
+	FixedValue    interface{}   `yaml:"fixedValue" json:"fixedValue,omitempty"`
+	AllowedValues []interface{} `yaml:"allowedValues" json:"allowedValues,omitempty"`
+	Pattern       string        `yaml:"pattern" json:"pattern,omitempty"`
+	MustSupport   bool          `yaml:"mustSupport" json:"mustSupport,omitempty"`
+	// Normalize, if set, corrects the field before rules are checked.
+	Normalize *Normalize `yaml:"normalize" json:"normalize,omitempty"`
+	// Clients, if set, limits the rule to requests from these client
+	// identities; see RuleSet.ForClient.
+	Clients []string `yaml:"clients" json:"clients,omitempty"`
+}
+
+// RulePlan is a set of rules compiled for evaluation. Paths are split and
+// patterns compiled once, and rules are indexed by resourceType.
+type RulePlan struct {
+	byType map[string][]compiledRule
+	// client is the client identity the plan is evaluated for; rules
+	// limited to other clients are skipped.
+	client string
+}
+
+type compiledRule struct {
+	path     string
+	segments []string
+	rule     FieldRule
+	pattern  *regexp.Regexp
+}
+
+// CompileRules builds a RulePlan from rules keyed by resourceType and field path.
+// Rules for a resourceType are evaluated in path order so results are stable.
+func CompileRules(rules map[string]map[string]FieldRule) (*RulePlan, error) {
+	plan := &RulePlan{byType: make(map[string][]compiledRule, len(rules))}
+	for resourceType, fields := range rules {
+		compiled := make([]compiledRule, 0, len(fields))
+		for path, rule := range fields {
+			cr := compiledRule{
+				path:     path,
+				segments: strings.Split(path, "."),
+				rule:     rule,
+			}
+			if rule.Pattern != "" {
+				re, err := regexp.Compile(rule.Pattern)
+				if err != nil {
+					return nil, fmt.Errorf("invalid pattern for %s.%s: %w", resourceType, path, err)
+				}
+				cr.pattern = re
+			}
+			compiled = append(compiled, cr)
+		}
+		sort.Slice(compiled, func(i, j int) bool { return compiled[i].path < compiled[j].path })
+		plan.byType[resourceType] = compiled
+	}
+	return plan, nil
 }
 
 // LoadRules loads extra validation rules from a YAML file.
 func LoadRules(filepath string) error {
-	// #nosec G304 -- filepath is controlled by caller and only YAML files are expected
-	data, err := os.ReadFile(filepath)
+	rulesMu.RLock()
+	base := ExtraRules
+	rulesMu.RUnlock()
+	merged, err := readRules(filepath, base)
 	if err != nil {
 		return err
 	}
-	return yaml.Unmarshal(data, &ExtraRules)
+
+	plan, err := CompileRules(merged)
+	if err != nil {
+		return err
+	}
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	ExtraRules = merged
+	activePlan = plan
+	return nil
+}
+
+// readRules parses a rules YAML file over a copy of base.
+func readRules(path string, base map[string]map[string]FieldRule) (map[string]map[string]FieldRule, error) {
+	// #nosec G304 -- path is controlled by caller and only YAML files are expected
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string]map[string]FieldRule, len(base))
+	for k, v := range base {
+		merged[k] = v
+	}
+	if err := yaml.Unmarshal(data, &merged); err != nil {
+		return nil, err
+	}
+	return merged, nil
 }
 
 // ApplyExtraRules applies extra validation rules to a resource.
 func ApplyExtraRules(resourceType string, resource map[string]interface{}) []string {
-	errors := []string{}
+	return active().plan.Apply(resourceType, resource)
+}
 
-	rules, ok := ExtraRules[resourceType]
-	if !ok {
-		return errors
-	}
+// Apply evaluates the plan's rules for resourceType against a resource.
+func (p *RulePlan) Apply(resourceType string, resource map[string]interface{}) []string {
+	return messages(p.issues(resourceType, resource, resourceType))
+}
 
-	for path, rule := range rules {
-		if rule.Min > 0 && !fieldExists(resource, resourceType+"."+path) {
-			errors = append(errors, fmt.Sprintf("Missing required field (min): %s", path))
+// issues evaluates the plan's rules for resourceType against a resource.
+// Issue expressions are rooted at base, such as "Patient" or
+// "Bundle.entry[2].resource".
+func (p *RulePlan) issues(resourceType string, resource map[string]interface{}, base string) []Issue {
+	issues := []Issue{}
+
+	for _, cr := range p.byType[resourceType] {
+		if !p.applies(cr) {
+			continue
+		}
+		rule := cr.rule
+		fail := func(check, message string) {
+			issues = append(issues, Issue{
+				Severity:    SeverityError,
+				Code:        "invalid",
+				Diagnostics: message,
+				Expression:  base + "." + cr.path,
+				RuleID:      ruleID(resourceType, cr.path, check),
+			})
 		}
-		if rule.Max > 0 && countField(resource, resourceType+"."+path) > rule.Max {
-			errors = append(errors, fmt.Sprintf("Too many instances of field (max %d): %s", rule.Max, path))
+		if rule.Min > 0 && !existsAt(resource, cr.segments) {
+			fail(checkMin, fmt.Sprintf("Missing required field (min): %s", cr.path))
 		}
-		if rule.FixedValue != nil && !fieldHasFixedValue(resource, resourceType+"."+path, rule.FixedValue) {
-			errors = append(errors, fmt.Sprintf("Field %s does not have fixed value %v", path, rule.FixedValue))
+		if rule.Max > 0 && countAt(resource, cr.segments) > rule.Max {
+			fail(checkMax, fmt.Sprintf("Too many instances of field (max %d): %s", rule.Max, cr.path))
 		}
-		if len(rule.AllowedValues) > 0 && !fieldHasAllowedValue(resource, resourceType+"."+path, rule.AllowedValues) {
-			errors = append(errors, fmt.Sprintf("Field %s has disallowed value", path))
+		if rule.FixedValue != nil && !hasFixedValueAt(resource, cr.segments, rule.FixedValue) {
+			fail(checkFixedValue, fmt.Sprintf("Field %s does not have fixed value %v", cr.path, rule.FixedValue))
 		}
-		if rule.Pattern != "" && !fieldMatchesPattern(resource, resourceType+"."+path, rule.Pattern) {
-			errors = append(errors, fmt.Sprintf("Field %s does not match pattern %s", path, rule.Pattern))
+		if len(rule.AllowedValues) > 0 && !hasAllowedValueAt(resource, cr.segments, rule.AllowedValues) {
+			fail(checkAllowedValues, fmt.Sprintf("Field %s has disallowed value", cr.path))
+		}
+		if cr.pattern != nil && !matchesPatternAt(resource, cr.segments, cr.pattern) {
+			fail(checkPattern, fmt.Sprintf("Field %s does not match pattern %s", cr.path, rule.Pattern))
 		}
 	}
 
-	return errors
+	return issues
+}
+
+// Checks a FieldRule can make; they name the rule in rule IDs.
+const (
+	checkMin           = "min"
+	checkMax           = "max"
+	checkFixedValue    = "fixedValue"
+	checkAllowedValues = "allowedValues"
+	checkPattern       = "pattern"
+)
+
+func ruleID(resourceType, path, check string) string {
+	return resourceType + "." + path + ":" + check
+}
+
+// RuleIDs returns the IDs of every check the plan makes, in order.
+func (p *RulePlan) RuleIDs() []string {
+	ids := []string{}
+	for resourceType, rules := range p.byType {
+		for _, cr := range rules {
+			rule := cr.rule
+			if rule.Min > 0 {
+				ids = append(ids, ruleID(resourceType, cr.path, checkMin))
+			}
+			if rule.Max > 0 {
+				ids = append(ids, ruleID(resourceType, cr.path, checkMax))
+			}
+			if rule.FixedValue != nil {
+				ids = append(ids, ruleID(resourceType, cr.path, checkFixedValue))
+			}
+			if len(rule.AllowedValues) > 0 {
+				ids = append(ids, ruleID(resourceType, cr.path, checkAllowedValues))
+			}
+			if cr.pattern != nil {
+				ids = append(ids, ruleID(resourceType, cr.path, checkPattern))
+			}
+			if rule.Normalize != nil {
+				ids = append(ids, ruleID(resourceType, cr.path, checkNormalize))
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// splitPath splits a "ResourceType.field.path" into the segments below the resource.
+func splitPath(fullPath string) []string {
+	return strings.Split(fullPath, ".")[1:]
 }
 
 func fieldExists(resource map[string]interface{}, fullPath string) bool {
-	parts := strings.Split(fullPath, ".")
+	return existsAt(resource, splitPath(fullPath))
+}
+
+func existsAt(resource map[string]interface{}, segments []string) bool {
 	current := resource
 
-	for i := 1; i < len(parts); i++ {
-		part := parts[i]
+	for i, part := range segments {
 		val, ok := current[part]
 		if !ok {
 			return false
 		}
 
-		if i == len(parts)-1 {
+		if i == len(segments)-1 {
 			switch v := val.(type) {
 			case map[string]interface{}:
 				return true
@@ -92,10 +251,9 @@ func fieldExists(resource map[string]interface{}, fullPath string) bool {
 				return false
 			}
 			// If there are more parts, check if any element matches the rest of the path
-			remainingPath := strings.Join(parts[i+1:], ".")
 			for _, item := range v {
 				if itemMap, ok := item.(map[string]interface{}); ok {
-					if fieldExists(itemMap, parts[0]+"."+remainingPath) {
+					if existsAt(itemMap, segments[i+1:]) {
 						return true
 					}
 				}
@@ -109,11 +267,13 @@ func fieldExists(resource map[string]interface{}, fullPath string) bool {
 }
 
 func countField(resource map[string]interface{}, fullPath string) int {
-	parts := strings.Split(fullPath, ".")
+	return countAt(resource, splitPath(fullPath))
+}
+
+func countAt(resource map[string]interface{}, segments []string) int {
 	current := resource
 
-	for i := 1; i < len(parts); i++ {
-		part := parts[i]
+	for i, part := range segments {
 		val, ok := current[part]
 		if !ok {
 			return 0
@@ -128,7 +288,7 @@ func countField(resource map[string]interface{}, fullPath string) int {
 		case map[string]interface{}:
 			current = v
 		default:
-			if i == len(parts)-1 {
+			if i == len(segments)-1 {
 				if val == nil {
 					return 0
 				}
@@ -149,16 +309,19 @@ func fieldHasFixedValue(resource map[string]interface{}, fullPath string, expect
 		}
 		return val == expected
 	}
+	return hasFixedValueAt(resource, parts[1:], expected)
+}
+
+func hasFixedValueAt(resource map[string]interface{}, segments []string, expected interface{}) bool {
 	current := resource
 
-	for i := 1; i < len(parts); i++ {
-		part := parts[i]
+	for i, part := range segments {
 		val, ok := current[part]
 		if !ok {
 			return false
 		}
 
-		if i == len(parts)-1 {
+		if i == len(segments)-1 {
 			return val == expected
 		}
 
@@ -173,17 +336,19 @@ func fieldHasFixedValue(resource map[string]interface{}, fullPath string, expect
 }
 
 func fieldHasAllowedValue(resource map[string]interface{}, fullPath string, allowed []interface{}) bool {
-	parts := strings.Split(fullPath, ".")
+	return hasAllowedValueAt(resource, splitPath(fullPath), allowed)
+}
+
+func hasAllowedValueAt(resource map[string]interface{}, segments []string, allowed []interface{}) bool {
 	current := resource
 
-	for i := 1; i < len(parts); i++ {
-		part := parts[i]
+	for i, part := range segments {
 		val, ok := current[part]
 		if !ok {
 			return false
 		}
 
-		if i == len(parts)-1 {
+		if i == len(segments)-1 {
 			for _, a := range allowed {
 				if val == a {
 					return true
@@ -203,31 +368,28 @@ func fieldHasAllowedValue(resource map[string]interface{}, fullPath string, allo
 }
 
 func fieldMatchesPattern(resource map[string]interface{}, fullPath string, pattern string) bool {
-	parts := strings.Split(fullPath, ".")
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false
+	}
+	return matchesPatternAt(resource, splitPath(fullPath), re)
+}
+
+func matchesPatternAt(resource map[string]interface{}, segments []string, re *regexp.Regexp) bool {
 	current := resource
 
-	for i := 1; i < len(parts); i++ {
-		part := parts[i]
+	for i, part := range segments {
 		val, ok := current[part]
 		if !ok {
-			fmt.Printf("Field %s not found at path %s\n", part, strings.Join(parts[:i+1], "."))
 			return false
 		}
 
-		if i == len(parts)-1 {
+		if i == len(segments)-1 {
 			strVal, ok := val.(string)
 			if !ok {
-				fmt.Printf("Field %s is not a string, got %T\n", part, val)
 				return false
 			}
-			re, err := regexp.Compile(pattern)
-			if err != nil {
-				fmt.Printf("Invalid pattern %s: %v\n", pattern, err)
-				return false
-			}
-			matches := re.MatchString(strVal)
-			fmt.Printf("Testing pattern %s against value %q: %v\n", pattern, strVal, matches)
-			return matches
+			return re.MatchString(strVal)
 		}
 
 		switch v := val.(type) {
@@ -238,19 +400,40 @@ func fieldMatchesPattern(resource map[string]interface{}, fullPath string, patte
 				return false
 			}
 			// If there are more parts, check if any element matches the rest of the path
-			remainingPath := strings.Join(parts[i+1:], ".")
 			for _, item := range v {
 				if itemMap, ok := item.(map[string]interface{}); ok {
-					if fieldMatchesPattern(itemMap, parts[0]+"."+remainingPath, pattern) {
+					if matchesPatternAt(itemMap, segments[i+1:], re) {
 						return true
 					}
 				}
 			}
 			return false
 		default:
-			fmt.Printf("Unexpected type %T at path %s\n", v, strings.Join(parts[:i+1], "."))
 			return false
 		}
 	}
 	return false
 }
+
+// applies reports whether a rule applies to the plan's client.
+func (p *RulePlan) applies(cr compiledRule) bool {
+	if len(cr.rule.Clients) == 0 {
+		return true
+	}
+	for _, c := range cr.rule.Clients {
+		if c == p.client && c != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// usesField reports whether any rule for resourceType starts at field.
+func (p *RulePlan) usesField(resourceType, field string) bool {
+	for _, cr := range p.byType[resourceType] {
+		if cr.segments[0] == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package validator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// RuleSet is a compiled set of rules and bundle recipes that resources can
+// be validated against. The package-level Validate functions use the active
+// rule set built by LoadRules and LoadRecipes; a RuleSet loaded with
+// LoadRuleSet can be used beside it, for example to try out candidate rules.
+type RuleSet struct {
+	plan    *RulePlan
+	recipes map[string]Recipe
+}
+
+// active returns the rule set made of the loaded rules and recipes.
+func active() *RuleSet {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	return &RuleSet{plan: activePlan, recipes: Recipes}
+}
+
+// ActiveRules returns the loaded rules and recipes, which must not be
+// modified.
+func ActiveRules() (map[string]map[string]FieldRule, map[string]Recipe) {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	return ExtraRules, Recipes
+}
+
+// ForClient returns the active rule set as it applies to requests from
+// client.
+func ForClient(client string) *RuleSet {
+	return active().ForClient(client)
+}
+
+// ForClient returns the rule set as it applies to requests from client, the
+// verified identity of the sender. Rules limited to other clients with
+// FieldRule.Clients are skipped; without ForClient, or for an empty client,
+// only rules for every client apply.
+func (rs *RuleSet) ForClient(client string) *RuleSet {
+	plan := *rs.plan
+	plan.client = client
+	return &RuleSet{plan: &plan, recipes: rs.recipes}
+}
+
+// LoadRuleSet loads rules.yaml and recipes.yaml from dir as a RuleSet,
+// leaving the active rules and recipes unchanged. A missing file contributes
+// no rules or recipes.
+func LoadRuleSet(dir string) (*RuleSet, error) {
+	rs := &RuleSet{plan: &RulePlan{byType: map[string][]compiledRule{}}, recipes: map[string]Recipe{}}
+
+	rules, err := readRules(filepath.Join(dir, "rules.yaml"), nil)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load rules: %w", err)
+	}
+	if rules != nil {
+		if rs.plan, err = CompileRules(rules); err != nil {
+			return nil, fmt.Errorf("failed to load rules: %w", err)
+		}
+	}
+
+	recipes, err := readRecipes(filepath.Join(dir, "recipes.yaml"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load recipes: %w", err)
+	}
+	if recipes != nil {
+		rs.recipes = recipes
+	}
+	return rs, nil
+}
+
+// VerdictDiff describes how the results of validating one resource against
+// two rule sets differ.
+type VerdictDiff struct {
+	ActiveValid    bool
+	CandidateValid bool
+	// Added holds issues only the candidate raised, Removed issues only the
+	// active rule set raised.
+	Added   []Issue
+	Removed []Issue
+}
+
+// Changed reports whether the two results differ at all.
+func (d VerdictDiff) Changed() bool {
+	return d.ActiveValid != d.CandidateValid || len(d.Added) > 0 || len(d.Removed) > 0
+}
+
+// DiffResults compares the result of the active rule set with that of a
+// candidate for the same resource. Issues are matched on severity, rule ID
+// and diagnostics.
+func DiffResults(active, candidate ValidationResult) VerdictDiff {
+	diff := VerdictDiff{ActiveValid: active.Valid, CandidateValid: candidate.Valid}
+	key := func(i Issue) string { return i.Severity + "|" + i.RuleID + "|" + i.Diagnostics }
+
+	remaining := map[string]int{}
+	for _, issue := range active.Issues {
+		remaining[key(issue)]++
+	}
+	for _, issue := range candidate.Issues {
+		if k := key(issue); remaining[k] > 0 {
+			remaining[k]--
+		} else {
+			diff.Added = append(diff.Added, issue)
+		}
+	}
+	for _, issue := range active.Issues {
+		if k := key(issue); remaining[k] > 0 {
+			remaining[k]--
+			diff.Removed = append(diff.Removed, issue)
+		}
+	}
+	return diff
+}
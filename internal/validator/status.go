@@ -0,0 +1,123 @@
+package validator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConfigFile is a file of the loaded configuration directory.
+type ConfigFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	// Loaded is when the file was loaded.
+	Loaded time.Time `json:"loaded"`
+}
+
+// ConfigStatus describes the active configuration.
+type ConfigStatus struct {
+	// Loaded is when LoadConfigDir last succeeded, or nil if it has not.
+	Loaded *time.Time `json:"loaded,omitempty"`
+	// Error is why the last LoadConfigDir failed, if it did.
+	Error string `json:"error,omitempty"`
+	// ReloadError is why the last ReloadConfigDir failed, if it did. The
+	// configuration loaded before it stays active.
+	ReloadError string `json:"reloadError,omitempty"`
+	// Profiles are the canonical references of the loaded profiles.
+	Profiles []string `json:"profiles"`
+	// Rules is the number of field rules for each resource type.
+	Rules map[string]int `json:"rules"`
+	// Recipes are the names of the loaded bundle recipes.
+	Recipes []string     `json:"recipes"`
+	Files   []ConfigFile `json:"files"`
+}
+
+// The outcome of the last LoadConfigDir and ReloadConfigDir.
+var (
+	configMu        sync.Mutex
+	configLoaded    time.Time
+	configErr       error
+	configReloadErr error
+	configFiles     []ConfigFile
+)
+
+// Status describes the active configuration and how it was loaded.
+func Status() ConfigStatus {
+	rs := active()
+	status := ConfigStatus{
+		Profiles: sortedKeys(Profiles),
+		Rules:    map[string]int{},
+		Recipes:  sortedKeys(rs.recipes),
+	}
+	for resourceType, rules := range rs.plan.byType {
+		status.Rules[resourceType] = len(rules)
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	if !configLoaded.IsZero() {
+		loaded := configLoaded
+		status.Loaded = &loaded
+	}
+	if configErr != nil {
+		status.Error = configErr.Error()
+	}
+	if configReloadErr != nil {
+		status.ReloadError = configReloadErr.Error()
+	}
+	status.Files = append([]ConfigFile{}, configFiles...)
+	return status
+}
+
+// ConfigReady returns nil if the configuration loaded, and otherwise why
+// it did not.
+func ConfigReady() error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	switch {
+	case configErr != nil:
+		return configErr
+	case configLoaded.IsZero():
+		return errors.New("configuration not loaded")
+	}
+	return nil
+}
+
+// hashConfigFiles returns every file under dir with its SHA-256, in path
+// order, as loaded at loaded.
+func hashConfigFiles(dir string, loaded time.Time) ([]ConfigFile, error) {
+	var files []ConfigFile
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		// #nosec G304 -- path is found by walking the configuration directory
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		files = append(files, ConfigFile{Path: path, SHA256: hex.EncodeToString(h.Sum(nil)), Loaded: loaded})
+		return nil
+	})
+	return files, err
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,194 @@
+package validator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ValidateStream decodes a FHIR resource from r and validates it. Bundle
+// entries are decoded and indexed one at a time rather than held in memory,
+// so very large transaction bundles can be checked with bounded memory. This
+// requires resourceType to precede entry in the document, as FHIR JSON
+// recommends; otherwise the bundle is validated in memory.
+//
+// The returned error reports malformed JSON or a failure to read r; validation
+// failures are reported in the ValidationResult.
+func ValidateStream(r io.Reader) (ValidationResult, error) {
+	return active().ValidateStream(r)
+}
+
+// ValidateStream is ValidateStream against the rule set.
+func (rs *RuleSet) ValidateStream(r io.Reader) (ValidationResult, error) {
+	return rs.ValidateStreamContext(context.Background(), r)
+}
+
+// ValidateStreamContext is ValidateStream, tracing each stage as a child of
+// the span in ctx. When entries are streamed, their validation is part of
+// the parse stage.
+func (rs *RuleSet) ValidateStreamContext(ctx context.Context, r io.Reader) (ValidationResult, error) {
+	ctx, span := startStage(ctx, "validate")
+	defer span.End()
+	result, err := rs.validateStream(ctx, r)
+	if err != nil {
+		span.SetError(err)
+		return result, err
+	}
+	traceResult(span, result)
+	return result, nil
+}
+
+func (rs *RuleSet) validateStream(ctx context.Context, r io.Reader) (ValidationResult, error) {
+	_, span := startStage(ctx, "parse")
+	defer span.End()
+	dec := json.NewDecoder(r)
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return ValidationResult{}, err
+	}
+
+	resource := map[string]interface{}{}
+	var index *bundleIndex
+	streamed := false
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return ValidationResult{}, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return ValidationResult{}, fmt.Errorf("unexpected token %v", tok)
+		}
+
+		if key == "entry" && rs.streamsEntries(resource) {
+			index, err = decodeEntries(dec, rs.plan)
+			if err != nil {
+				return ValidationResult{}, err
+			}
+			streamed = true
+			continue
+		}
+
+		var value interface{}
+		if err := dec.Decode(&value); err != nil {
+			return ValidationResult{}, err
+		}
+		resource[key] = value
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return ValidationResult{}, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after top-level value")
+		}
+		return ValidationResult{}, err
+	}
+
+	span.End()
+	if !streamed {
+		return rs.validate(ctx, resource), nil
+	}
+
+	// Only entry was streamed; the rest of the bundle is in resource.
+	_, span = startStage(ctx, "rules")
+	issues := rs.plan.issues("Bundle", resource, "Bundle")
+	span.End()
+	if resource["type"] == "transaction" {
+		if index == nil {
+			issues = append(issues, errorIssue("Invalid or missing bundle entries"))
+		} else {
+			_, span = startStage(ctx, "recipes")
+			issues = append(issues, index.issues(rs.recipes)...)
+			span.End()
+		}
+	}
+	result := NewResult(issues)
+	result.ResourceType = "Bundle"
+	if index != nil && hasEntries(resource["type"]) {
+		result.Entries = index.entries
+	}
+	return result, nil
+}
+
+// streamsEntries reports whether the entry member of a partially decoded
+// resource can be streamed: it must be a Bundle whose own rules do not look
+// at its entries. Normalised resources are returned whole, so nothing is
+// streamed when the bundle may be normalised, nor when a Provenance may be
+// added to it. With EntryRules, normalisation rules for any type count, as a
+// resource of any type can be an entry.
+func (rs *RuleSet) streamsEntries(resource map[string]interface{}) bool {
+	normalizes := rs.plan.normalizesType("Bundle") || EntryRules && rs.plan.normalizes()
+	return resource["resourceType"] == "Bundle" && !rs.plan.usesField("Bundle", "entry") && !normalizes &&
+		(!InjectProvenance || resource["type"] != nil && resource["type"] != "transaction")
+}
+
+// decodeEntries reads a bundle's entry array one entry at a time, validating
+// each entry's resource against plan on the entry pool.
+// A non-array value yields a nil index, as the bundle has no valid entries.
+func decodeEntries(dec *json.Decoder, plan *RulePlan) (*bundleIndex, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok != json.Delim('[') {
+		return nil, skipValue(dec, tok)
+	}
+
+	pool := newEntryPool(plan)
+	var entries []BundleEntry
+	for i := 0; dec.More(); i++ {
+		var entry interface{}
+		if err := dec.Decode(&entry); err != nil {
+			pool.wait()
+			return nil, err
+		}
+		if entryMap, ok := entry.(map[string]interface{}); ok {
+			entry := describeEntry(entryMap)
+			entries = append(entries, entry)
+			if res, ok := entryMap["resource"].(map[string]interface{}); ok {
+				pool.submit(i, entry.FullURL, res)
+			}
+		}
+	}
+	index := pool.wait()
+	index.entries = entries
+	if err := expectDelim(dec, ']'); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// skipValue discards the rest of a value whose first token has been read.
+func skipValue(dec *json.Decoder, first json.Token) error {
+	if first != json.Delim('{') && first != json.Delim('[') {
+		return nil
+	}
+	for depth := 1; depth > 0; {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+	return nil
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != want {
+		return fmt.Errorf("expected %q, got %v", want, tok)
+	}
+	return nil
+}
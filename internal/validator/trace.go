@@ -0,0 +1,22 @@
+package validator
+
+import (
+	"context"
+
+	"fhir-validation-proxy/internal/trace"
+)
+
+// startStage starts the span of a validation stage, such as "rules".
+func startStage(ctx context.Context, name string) (context.Context, *trace.Span) {
+	return trace.Start(ctx, "validator."+name, trace.KindInternal)
+}
+
+// traceResult records the outcome of a validation on its span.
+func traceResult(span *trace.Span, result ValidationResult) {
+	span.SetAttributes(
+		trace.String("fhir.resource_type", result.ResourceType),
+		trace.Bool("fhir.validation.valid", result.Valid),
+		trace.Int("fhir.validation.issues", len(result.Issues)),
+		trace.Int("fhir.validation.errors", len(result.Errors)),
+	)
+}
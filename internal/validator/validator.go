@@ -4,25 +4,180 @@ package validator
 // internal/validator/validator.go
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"strings"
+
+	"fhir-validation-proxy/internal/trace"
 )
 
 // ValidationResult represents the result of validating a FHIR resource.
 type ValidationResult struct {
-	Valid   bool
-	Errors  []string
+	Valid  bool
+	Errors []string
+	// Issues holds every finding, including warnings and information.
+	Issues  []Issue
 	Outcome map[string]interface{}
+	// Resource is the validated resource if normalisation rules corrected
+	// it or a Provenance was added to it, and nil otherwise.
+	Resource map[string]interface{}
+	// ResourceType is the resourceType of the validated resource.
+	ResourceType string
+	// Entries describes each entry of a transaction or batch bundle, in
+	// order, so callers can see what the bundle asks the server to do.
+	Entries []BundleEntry
+}
+
+// BundleEntry describes an entry of a transaction or batch bundle.
+type BundleEntry struct {
+	FullURL      string
+	ResourceType string
+	ID           string
+	// Method and URL are the entry's request.method and request.url.
+	Method string
+	URL    string
 }
 
-// Validate validates a FHIR resource and returns a ValidationResult.
+// describeEntry returns the BundleEntry for a decoded bundle entry.
+func describeEntry(entry map[string]interface{}) BundleEntry {
+	var e BundleEntry
+	e.FullURL, _ = entry["fullUrl"].(string)
+	if res, ok := entry["resource"].(map[string]interface{}); ok {
+		e.ResourceType, _ = res["resourceType"].(string)
+		e.ID, _ = res["id"].(string)
+	}
+	if req, ok := entry["request"].(map[string]interface{}); ok {
+		e.Method, _ = req["method"].(string)
+		e.URL, _ = req["url"].(string)
+	}
+	return e
+}
+
+// hasEntries reports whether the entries of a bundle of bundleType are
+// requests to the server, described in ValidationResult.Entries.
+func hasEntries(bundleType interface{}) bool {
+	return bundleType == "transaction" || bundleType == "batch"
+}
+
+// Issue severities, as used in OperationOutcome.
+const (
+	SeverityFatal       = "fatal"
+	SeverityError       = "error"
+	SeverityWarning     = "warning"
+	SeverityInformation = "information"
+)
+
+// Issue is a single validation finding, reported as an OperationOutcome issue.
+type Issue struct {
+	Severity    string
+	Code        string
+	Diagnostics string
+	// Expression is the FHIRPath of the element concerned, if known.
+	Expression string
+	// RuleID identifies the configured rule that raised the issue, such as
+	// "Patient.address.postalCode:pattern". It is empty for built-in checks.
+	RuleID string
+}
+
+func errorIssue(message string) Issue {
+	return Issue{Severity: SeverityError, Code: "invalid", Diagnostics: message}
+}
+
+// Validate validates a FHIR resource against the active rules and recipes
+// and returns a ValidationResult.
 func Validate(resource map[string]interface{}) ValidationResult {
-	errors := ApplyExtraRules(resource["resourceType"].(string), resource)
+	return active().Validate(resource)
+}
+
+// Validate validates a FHIR resource against the rule set. Normalisation
+// rules correct the resource, and the entries of a transaction bundle, in
+// place before it is checked; so does InjectProvenance.
+func (rs *RuleSet) Validate(resource map[string]interface{}) ValidationResult {
+	return rs.ValidateContext(context.Background(), resource)
+}
+
+// ValidateContext is Validate, tracing each stage as a child of the span
+// in ctx.
+func (rs *RuleSet) ValidateContext(ctx context.Context, resource map[string]interface{}) ValidationResult {
+	ctx, span := startStage(ctx, "validate")
+	defer span.End()
+	result := rs.validate(ctx, resource)
+	traceResult(span, result)
+	return result
+}
+
+func (rs *RuleSet) validate(ctx context.Context, resource map[string]interface{}) ValidationResult {
+	resourceType, ok := resource["resourceType"].(string)
+	if !ok {
+		return NewResult([]Issue{errorIssue("Missing or invalid resourceType")})
+	}
 
-	if resource["resourceType"] == "Bundle" && resource["type"] == "transaction" {
-		errors = append(errors, ValidateTransactionBundle(resource)...) // new logic
+	// Entries describes what the sender asked for, before any Provenance is
+	// added on its behalf.
+	var described []BundleEntry
+	if resourceType == "Bundle" && hasEntries(resource["type"]) {
+		entries, _ := resource["entry"].([]interface{})
+		for _, e := range entries {
+			if entry, ok := e.(map[string]interface{}); ok {
+				described = append(described, describeEntry(entry))
+			}
+		}
+	}
+
+	_, span := startStage(ctx, "normalize")
+	issues := rs.plan.normalize(resourceType, resource, resourceType)
+	span.End()
+	_, span = startStage(ctx, "profiles")
+	issues = append(issues, profileIssues(resource, resourceType)...)
+	span.End()
+	_, span = startStage(ctx, "rules")
+	issues = append(issues, rs.plan.issues(resourceType, resource, resourceType)...)
+	span.End()
+
+	injected := -1
+	if resourceType == "Bundle" && resource["type"] == "transaction" {
+		if InjectProvenance {
+			_, span = startStage(ctx, "provenance")
+			injected = rs.addProvenance(resource)
+			span.End()
+			if injected >= 0 {
+				expr := fmt.Sprintf("Bundle.entry[%d]", injected)
+				issues = append(issues, Issue{
+					Severity:    SeverityInformation,
+					Code:        "informational",
+					Diagnostics: expr + ": Added Provenance for the transaction",
+					Expression:  expr,
+				})
+			}
+		}
+		issues = append(issues, rs.transactionIssues(ctx, resource)...) // new logic
 	}
 
+	result := NewResult(issues)
+	result.ResourceType = resourceType
+	result.Entries = described
+	if injected >= 0 {
+		result.Resource = resource
+	}
+	for _, issue := range issues {
+		if strings.HasSuffix(issue.RuleID, ":"+checkNormalize) {
+			result.Resource = resource
+			break
+		}
+	}
+	return result
+}
+
+// NewResult builds a ValidationResult and its OperationOutcome from issues.
+// The result is valid unless an issue is an error or fatal.
+func NewResult(issues []Issue) ValidationResult {
+	errors := []string{}
+	for _, issue := range issues {
+		if issue.Severity == SeverityError || issue.Severity == SeverityFatal {
+			errors = append(errors, issue.Diagnostics)
+		}
+	}
 	valid := len(errors) == 0
 
 	outcome := map[string]interface{}{
@@ -30,116 +185,72 @@ func Validate(resource map[string]interface{}) ValidationResult {
 		"issue":        []map[string]interface{}{},
 	}
 
+	for _, issue := range issues {
+		entry := map[string]interface{}{
+			"severity":    issue.Severity,
+			"code":        issue.Code,
+			"diagnostics": issue.Diagnostics,
+		}
+		if issue.Expression != "" {
+			entry["expression"] = []string{issue.Expression}
+		}
+		outcome["issue"] = append(outcome["issue"].([]map[string]interface{}), entry)
+	}
 	if valid {
 		outcome["issue"] = append(outcome["issue"].([]map[string]interface{}), map[string]interface{}{
 			"severity":    "information",
 			"code":        "informational",
 			"diagnostics": "Validation successful",
 		})
-	} else {
-		for _, e := range errors {
-			outcome["issue"] = append(outcome["issue"].([]map[string]interface{}), map[string]interface{}{
-				"severity":    "error",
-				"code":        "invalid",
-				"diagnostics": e,
-			})
-		}
 	}
 
 	return ValidationResult{
 		Valid:   valid,
 		Errors:  errors,
+		Issues:  issues,
 		Outcome: outcome,
 	}
 }
 
 // ValidateTransactionBundle validates a transaction bundle and returns errors.
 func ValidateTransactionBundle(bundle map[string]interface{}) []string {
-	errs := []string{}
+	return messages(active().transactionIssues(context.Background(), bundle))
+}
 
+func (rs *RuleSet) transactionIssues(ctx context.Context, bundle map[string]interface{}) []Issue {
+	ctx, span := startStage(ctx, "transaction")
+	defer span.End()
 	entries, ok := bundle["entry"].([]interface{})
 	if !ok {
-		return []string{"Invalid or missing bundle entries"}
-	}
-
-	if !hasProvenance(entries) {
-		errs = append(errs, "Missing required Provenance resource in transaction")
-	}
-
-	recipe, hasRecipe := Recipes["default"]
-	if hasRecipe {
-		found := map[string]bool{}
-		for _, e := range entries {
-			if entry, ok := e.(map[string]interface{}); ok {
-				if res, ok := entry["resource"].(map[string]interface{}); ok {
-					if rt, ok := res["resourceType"].(string); ok {
-						found[rt] = true
-					}
-				}
-			}
-		}
-		for _, req := range recipe.RequiredResources {
-			if !found[req.ResourceType] {
-				errs = append(errs, "Missing required resource in bundle: "+req.ResourceType)
-			}
-		}
-
-		// MustReference
-		resourceMap := map[string][]map[string]interface{}{}
-		for _, e := range entries {
-			if entry, ok := e.(map[string]interface{}); ok {
-				if res, ok := entry["resource"].(map[string]interface{}); ok {
-					if rt, ok := res["resourceType"].(string); ok {
-						resourceMap[rt] = append(resourceMap[rt], res)
-					}
-				}
-			}
-		}
-		for _, rule := range recipe.MustReference {
-			valid := false
-			for _, src := range resourceMap[rule.Source] {
-				refs := collectReferences(src)
-				for _, r := range refs {
-					if strings.HasPrefix(r, rule.Target+"/") {
-						valid = true
-						break
-					}
-				}
-			}
-			if !valid {
-				errs = append(errs, fmt.Sprintf("No %s -> %s reference found", rule.Source, rule.Target))
-			}
-		}
+		return []Issue{errorIssue("Invalid or missing bundle entries")}
 	}
+	span.SetAttributes(trace.Int("fhir.bundle.entries", len(entries)))
 
-	allRefs := []string{}
-	for _, e := range entries {
+	_, entrySpan := startStage(ctx, "entries")
+	pool := newEntryPool(rs.plan)
+	for i, e := range entries {
 		if entry, ok := e.(map[string]interface{}); ok {
 			if res, ok := entry["resource"].(map[string]interface{}); ok {
-				allRefs = append(allRefs, collectReferences(res)...)
+				fullURL, _ := entry["fullUrl"].(string)
+				pool.submit(i, fullURL, res)
 			}
 		}
 	}
+	index := pool.wait()
+	entrySpan.End()
 
-	missing := referencesExist(allRefs, bundle)
-	for _, ref := range missing {
-		errs = append(errs, "Unresolved reference: "+ref)
-	}
-
-	return errs
+	_, recipeSpan := startStage(ctx, "recipes")
+	defer recipeSpan.End()
+	return index.issues(rs.recipes)
 }
 
-func hasProvenance(entries []interface{}) bool {
-	for _, e := range entries {
-		if entry, ok := e.(map[string]interface{}); ok {
-			if res, ok := entry["resource"].(map[string]interface{}); ok {
-				if res["resourceType"] == "Provenance" {
-					return true
-				}
-			}
-		}
+// messages returns the diagnostics of issues.
+func messages(issues []Issue) []string {
+	msgs := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		msgs = append(msgs, issue.Diagnostics)
 	}
-	return false
+	return msgs
 }
 
 func collectReferences(resource map[string]interface{}) []string {
@@ -165,25 +276,7 @@ func collectReferences(resource map[string]interface{}) []string {
 		}
 	}
 	findRefs(resource)
+	// Map iteration order is random; sort so results are repeatable.
+	sort.Strings(refs)
 	return refs
 }
-
-func referencesExist(refs []string, bundle map[string]interface{}) []string {
-	missing := []string{}
-	seen := map[string]bool{}
-	for _, e := range bundle["entry"].([]interface{}) {
-		if entry, ok := e.(map[string]interface{}); ok {
-			if res, ok := entry["resource"].(map[string]interface{}); ok {
-				rt := res["resourceType"].(string)
-				id := res["id"].(string)
-				seen[rt+"/"+id] = true
-			}
-		}
-	}
-	for _, ref := range refs {
-		if !seen[ref] {
-			missing = append(missing, ref)
-		}
-	}
-	return missing
-}
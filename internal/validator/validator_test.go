@@ -1,7 +1,19 @@
 package validator
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 // Rule represents a validation rule for a FHIR resource
@@ -822,3 +834,589 @@ func TestValidate(t *testing.T) {
 		}
 	})
 }
+
+func TestCompileRules(t *testing.T) {
+	t.Run("invalid pattern", func(t *testing.T) {
+		_, err := CompileRules(map[string]map[string]FieldRule{
+			"Patient": {"address.postalCode": {Pattern: "[A-Z"}},
+		})
+		if err == nil {
+			t.Errorf("expected error for invalid pattern, got nil")
+		}
+	})
+
+	t.Run("errors in path order", func(t *testing.T) {
+		plan, err := CompileRules(map[string]map[string]FieldRule{
+			"Patient": {
+				"name.family": {Min: 1},
+				"birthDate":   {Min: 1},
+				"gender":      {AllowedValues: []interface{}{"male", "female"}},
+			},
+		})
+		if err != nil {
+			t.Fatalf("CompileRules() error = %v", err)
+		}
+		got := plan.Apply("Patient", map[string]interface{}{
+			"resourceType": "Patient",
+			"gender":       "Male",
+		})
+		want := []string{
+			"Missing required field (min): birthDate",
+			"Field gender has disallowed value",
+			"Missing required field (min): name.family",
+		}
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("Apply() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("unknown resourceType", func(t *testing.T) {
+		plan, err := CompileRules(map[string]map[string]FieldRule{
+			"Patient": {"birthDate": {Min: 1}},
+		})
+		if err != nil {
+			t.Fatalf("CompileRules() error = %v", err)
+		}
+		if got := plan.Apply("Observation", map[string]interface{}{}); len(got) != 0 {
+			t.Errorf("Apply() = %v, want no errors", got)
+		}
+	})
+}
+
+func TestValidateStream(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{
+			name: "resource",
+			body: `{"resourceType": "Patient", "id": "pat1"}`,
+			want: []string{},
+		},
+		{
+			name: "valid transaction Bundle",
+			body: `{"resourceType": "Bundle", "entry": [
+				{"resource": {"resourceType": "Patient", "id": "pat1"}},
+				{"resource": {"resourceType": "Provenance", "id": "prov1", "target": [{"reference": "Patient/pat1"}]}}
+			], "type": "transaction"}`,
+			want: []string{},
+		},
+		{
+			name: "unresolved reference",
+			body: `{"resourceType": "Bundle", "type": "transaction", "entry": [
+				{"resource": {"resourceType": "Provenance", "id": "prov1", "target": [{"reference": "Patient/pat2"}]}}
+			]}`,
+			want: []string{"Unresolved reference: Patient/pat2"},
+		},
+		{
+			name: "entry is not an array",
+			body: `{"resourceType": "Bundle", "type": "transaction", "entry": {"resource": {}}}`,
+			want: []string{"Invalid or missing bundle entries"},
+		},
+		{
+			name: "entry before resourceType",
+			body: `{"entry": [{"resource": {"resourceType": "Patient", "id": "pat1"}}], "resourceType": "Bundle", "type": "transaction"}`,
+			want: []string{"Missing required Provenance resource in transaction"},
+		},
+		{
+			name: "missing resourceType",
+			body: `{"id": "pat1"}`,
+			want: []string{"Missing or invalid resourceType"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ValidateStream(strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("ValidateStream() error = %v", err)
+			}
+			if strings.Join(got.Errors, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("ValidateStream() errors = %v, want %v", got.Errors, tt.want)
+			}
+			if got.Valid != (len(tt.want) == 0) {
+				t.Errorf("ValidateStream() valid = %v, want %v", got.Valid, len(tt.want) == 0)
+			}
+		})
+	}
+
+	for _, body := range []string{`{invalid json`, `[]`, `{"resourceType": "Patient"} {}`} {
+		if _, err := ValidateStream(strings.NewReader(body)); err == nil {
+			t.Errorf("ValidateStream(%q) expected error, got nil", body)
+		}
+	}
+}
+
+func TestValidateTransactionBundle_EntryOrder(t *testing.T) {
+	plan, err := CompileRules(map[string]map[string]FieldRule{
+		"Patient": {"birthDate": {Min: 1}},
+	})
+	if err != nil {
+		t.Fatalf("CompileRules() error = %v", err)
+	}
+	defer func(p *RulePlan, n int) { activePlan, EntryWorkers, EntryRules = p, n, false }(activePlan, EntryWorkers)
+	activePlan, EntryRules = plan, true
+
+	entries := []interface{}{}
+	for i := 0; i < 50; i++ {
+		patient := map[string]interface{}{
+			"resourceType": "Patient",
+			"id":           "pat" + strings.Repeat("x", i),
+		}
+		if i%2 == 0 {
+			patient["birthDate"] = "1980-01-01"
+		}
+		entries = append(entries, map[string]interface{}{"resource": patient})
+	}
+	entries = append(entries, map[string]interface{}{
+		"resource": map[string]interface{}{
+			"resourceType": "Provenance",
+			"id":           "prov1",
+			"target": []interface{}{
+				map[string]interface{}{"reference": "Patient/missing"},
+				map[string]interface{}{"reference": "Patient/pat"},
+			},
+		},
+	})
+	bundle := map[string]interface{}{"resourceType": "Bundle", "type": "transaction", "entry": entries}
+
+	EntryWorkers = 1
+	want := ValidateTransactionBundle(bundle)
+	if len(want) != 26 {
+		t.Fatalf("expected 25 entry errors and 1 unresolved reference, got %d: %v", len(want), want)
+	}
+	if want[0] != "Bundle.entry[1].resource: Missing required field (min): birthDate" {
+		t.Errorf("unexpected first error %q", want[0])
+	}
+
+	EntryWorkers = 8
+	for run := 0; run < 20; run++ {
+		got := ValidateTransactionBundle(bundle)
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Fatalf("parallel run %d = %v, want %v", run, got, want)
+		}
+	}
+}
+
+func TestLoadRuleSet(t *testing.T) {
+	dir := t.TempDir()
+	rules := "Patient:\n  gender:\n    allowedValues: [male, female]\n"
+	if err := os.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	candidate, err := LoadRuleSet(dir)
+	if err != nil {
+		t.Fatalf("LoadRuleSet() error = %v", err)
+	}
+
+	patient := map[string]interface{}{"resourceType": "Patient", "gender": "other"}
+	got := candidate.Validate(patient)
+	if got.Valid || len(got.Issues) != 1 || got.Issues[0].RuleID != "Patient.gender:allowedValues" {
+		t.Fatalf("Expected candidate to reject gender, got %+v", got.Issues)
+	}
+	if ids := candidate.RuleIDs(); len(ids) != 1 {
+		t.Errorf("Expected only the candidate's rule, got %v", ids)
+	}
+
+	diff := DiffResults(NewResult(nil), got)
+	if !diff.Changed() || !diff.ActiveValid || diff.CandidateValid || len(diff.Added) != 1 || len(diff.Removed) != 0 {
+		t.Errorf("Unexpected diff %+v", diff)
+	}
+	if DiffResults(got, got).Changed() {
+		t.Errorf("Identical results should not differ")
+	}
+
+	if _, err := LoadRuleSet(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("Expected an empty rule set for a missing directory, got %v", err)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	rules := map[string]map[string]FieldRule{}
+	if err := yaml.Unmarshal([]byte(`
+Patient:
+  gender:
+    allowedValues: [male, female]
+    normalize:
+      trim: true
+      map: {Male: male, Female: female}
+  address.postalCode:
+    pattern: "^[A-Z]{1,2}[0-9R][0-9A-Z]? [0-9][A-Z]{2}$"
+    normalize: {trim: true, uppercase: true}
+  name.given:
+    normalize: {trim: true}
+  active:
+    normalize: {default: true}
+`), &rules); err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal([]byte("Patient:\n  gender:\n    normalize:\n      map: {Male: [male]}\n"), &map[string]map[string]FieldRule{}); err == nil {
+		t.Error("Expected a map to a list to be rejected")
+	}
+	plan, err := CompileRules(rules)
+	if err != nil {
+		t.Fatalf("CompileRules() error = %v", err)
+	}
+	rs := &RuleSet{plan: plan}
+
+	patient := func() map[string]interface{} {
+		return map[string]interface{}{
+			"resourceType": "Patient",
+			"id":           "pat1",
+			"gender":       " Male",
+			"name":         []interface{}{map[string]interface{}{"given": []interface{}{" Ann ", "Marie"}}},
+			"address": []interface{}{
+				map[string]interface{}{"postalCode": "cf10 1ep "},
+				map[string]interface{}{"postalCode": "SW1A 1AA"},
+			},
+		}
+	}
+
+	resource := patient()
+	got := rs.Validate(resource)
+	if !got.Valid || got.Resource == nil {
+		t.Fatalf("Expected the normalised resource to be valid, got %+v", got.Issues)
+	}
+	want := []string{
+		`Set missing active to default true`,
+		`Normalised address.postalCode`,
+		`Normalised gender`,
+		`Normalised name.given`,
+	}
+	if msgs := messages(got.Issues); strings.Join(msgs, "|") != strings.Join(want, "|") {
+		t.Errorf("Normalisation issues = %q, want %q", msgs, want)
+	}
+	for _, issue := range got.Issues {
+		if issue.Severity != SeverityInformation || !strings.HasSuffix(issue.RuleID, ":normalize") {
+			t.Errorf("Unexpected issue %+v", issue)
+		}
+	}
+	if resource["gender"] != "male" || resource["active"] != true {
+		t.Errorf("Resource not corrected in place: %v", resource)
+	}
+
+	clean := rs.Validate(resource)
+	if clean.Resource != nil || len(clean.Issues) != 0 {
+		t.Errorf("Expected no changes to a normalised resource, got %+v", clean.Issues)
+	}
+
+	bundle := map[string]interface{}{
+		"resourceType": "Bundle",
+		"type":         "transaction",
+		"entry": []interface{}{
+			map[string]interface{}{"resource": patient()},
+			map[string]interface{}{"resource": map[string]interface{}{"resourceType": "Provenance"}},
+		},
+	}
+	got = rs.Validate(bundle)
+	if got.Resource != nil || len(got.Issues) != 0 {
+		t.Fatalf("Expected bundle entries to be left alone without EntryRules, got %+v", got.Issues)
+	}
+
+	EntryRules = true
+	defer func() { EntryRules = false }()
+	got = rs.Validate(bundle)
+	if got.Resource == nil || !got.Valid {
+		t.Fatalf("Expected bundle entries to be normalised, got %+v", got.Issues)
+	}
+	if got.Issues[0].Expression != "Bundle.entry[0].resource.active" {
+		t.Errorf("Unexpected entry expression %q", got.Issues[0].Expression)
+	}
+	entry := bundle["entry"].([]interface{})[0].(map[string]interface{})["resource"].(map[string]interface{})
+	if entry["gender"] != "male" {
+		t.Errorf("Bundle entry not corrected: %v", entry)
+	}
+}
+
+func TestLoadPackages(t *testing.T) {
+	defer func(p map[string]StructureDefinition, vs map[string]Conformance, cache string) {
+		Profiles, ValueSets, PackageCacheDir = p, vs, cache
+	}(Profiles, ValueSets, PackageCacheDir)
+	Profiles, ValueSets = map[string]StructureDefinition{}, map[string]Conformance{}
+
+	write := func(path, content string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Dependencies in the cache, extracted, one read through .index.json
+	PackageCacheDir = t.TempDir()
+	for _, version := range []string{"2.0.0", "2.0.1"} {
+		dir := filepath.Join(PackageCacheDir, "uk.core#"+version, "package")
+		write(filepath.Join(dir, "package.json"), `{"name": "uk.core", "version": "`+version+`"}`)
+		write(filepath.Join(dir, "ValueSet-gender.json"),
+			`{"resourceType": "ValueSet", "id": "gender", "url": "https://uk/ValueSet/gender", "version": "`+version+`"}`)
+		write(filepath.Join(dir, "Patient-example.json"), `{"resourceType": "Patient", "id": "example"}`)
+		write(filepath.Join(dir, ".index.json"),
+			`{"index-version": 1, "files": [{"filename": "ValueSet-gender.json", "resourceType": "ValueSet"}, {"filename": "Patient-example.json", "resourceType": "Patient"}]}`)
+	}
+
+	// The implementation guide as a package.tgz
+	packages := t.TempDir()
+	var tgz strings.Builder
+	gz := gzip.NewWriter(&tgz)
+	tw := tar.NewWriter(gz)
+	for name, content := range map[string]string{
+		"package/package.json":                   `{"name": "wales.core", "version": "1.0.0", "dependencies": {"uk.core": "2.0.x"}}`,
+		"package/StructureDefinition-Wales.json": `{"resourceType": "StructureDefinition", "id": "Wales", "url": "https://wales/Patient", "type": "Patient"}`,
+		"package/other/ignored.json":             `{"resourceType": "StructureDefinition", "url": "https://wales/ignored"}`,
+		"package/examples/Patient-broken.json":   `{"resourceType": "Patient",`,
+		"package/broken.json":                    `{"resourceType": "StructureDefinition",`,
+		"package/openapi.json":                   `{"openapi": "3.0.0"}`,
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join(packages, "wales.core.tgz"), tgz.String())
+
+	if err := LoadPackages(packages); err != nil {
+		t.Fatalf("LoadPackages: %v", err)
+	}
+	sd, ok := ResolveProfile("https://wales/Patient|1.0.0")
+	if !ok || sd.Version != "1.0.0" || !sd.VersionInferred || sd.Type != "Patient" || len(sd.Raw) == 0 {
+		t.Errorf("Expected the package profile with the package version, marked inferred, got %+v", sd)
+	}
+	if _, ok := ResolveProfile("https://wales/ignored"); ok {
+		t.Errorf("Expected files outside package/ to be ignored")
+	}
+	if vs, _ := ResolveValueSet("https://uk/ValueSet/gender"); vs.Version != "2.0.1" || vs.VersionInferred {
+		t.Errorf("Expected the dependency resolved to its own version 2.0.1, got %+v", vs)
+	}
+
+	PackageCacheDir = t.TempDir()
+	if err := LoadPackages(packages); err == nil || !strings.Contains(err.Error(), "uk.core#2.0.x") {
+		t.Errorf("Expected a missing dependency error, got %v", err)
+	}
+}
+
+func TestResolveProfileVersions(t *testing.T) {
+	defer func(p map[string]StructureDefinition) { Profiles = p }(Profiles)
+	Profiles = map[string]StructureDefinition{}
+	for _, version := range []string{"1.9.0", "1.10.0"} {
+		data := `{"resourceType": "StructureDefinition", "url": "https://wales/Patient", "version": "` + version + `", "type": "Patient"}`
+		if err := addConformance([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if sd, ok := ResolveProfile("https://wales/Patient"); !ok || sd.Version != "1.10.0" {
+		t.Errorf("Expected an unversioned reference to resolve to 1.10.0, got %q", sd.Version)
+	}
+	if sd, ok := ResolveProfile("https://wales/Patient|1.9.0"); !ok || sd.Version != "1.9.0" {
+		t.Errorf("Expected a versioned reference to resolve to 1.9.0, got %q", sd.Version)
+	}
+	if _, ok := ResolveProfile("https://wales/Patient|2.0.0"); ok {
+		t.Errorf("Expected an unloaded version not to resolve")
+	}
+
+	result := Validate(map[string]interface{}{
+		"resourceType": "Patient",
+		"meta": map[string]interface{}{"profile": []interface{}{
+			"https://wales/Patient|1.9.0",
+			"https://wales/Patient|2.0.0",
+		}},
+	})
+	var warnings []Issue
+	for _, issue := range result.Issues {
+		if issue.Severity == SeverityWarning {
+			warnings = append(warnings, issue)
+		}
+	}
+	if len(warnings) != 1 || warnings[0].Expression != "Patient.meta.profile[1]" ||
+		!strings.Contains(warnings[0].Diagnostics, "loaded versions: 1.9.0, 1.10.0") {
+		t.Errorf("Expected one warning for the unloaded version, got %+v", warnings)
+	}
+}
+
+func TestRuleSet_ForClient(t *testing.T) {
+	plan, err := CompileRules(map[string]map[string]FieldRule{
+		"Observation": {
+			"status":      {Min: 1},
+			"performer":   {Min: 1, Clients: []string{"partner-a"}},
+			"meta.source": {Min: 1, Clients: []string{"partner-b"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := &RuleSet{plan: plan, recipes: map[string]Recipe{}}
+	resource := func() map[string]interface{} { return map[string]interface{}{"resourceType": "Observation"} }
+
+	for client, want := range map[string][]string{
+		"":          {"Observation.status:min"},
+		"partner-a": {"Observation.performer:min", "Observation.status:min"},
+		"partner-b": {"Observation.meta.source:min", "Observation.status:min"},
+	} {
+		var got []string
+		for _, issue := range rs.ForClient(client).Validate(resource()).Issues {
+			got = append(got, issue.RuleID)
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("Client %q: expected rules %v, got %v", client, want, got)
+		}
+	}
+}
+
+func TestInjectProvenance(t *testing.T) {
+	dir := t.TempDir()
+	recipes := "transaction:\n  default:\n    requiredResources:\n      - resourceType: Patient\n    mustReference:\n      - source: Provenance\n        target: Patient\n"
+	if err := os.WriteFile(filepath.Join(dir, "recipes.yaml"), []byte(recipes), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := LoadRuleSet(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := func() map[string]interface{} {
+		return map[string]interface{}{
+			"resourceType": "Bundle",
+			"type":         "transaction",
+			"entry": []interface{}{
+				map[string]interface{}{
+					"fullUrl":  "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a",
+					"resource": map[string]interface{}{"resourceType": "Patient"},
+					"request":  map[string]interface{}{"method": "POST", "url": "Patient"},
+				},
+				map[string]interface{}{
+					"fullUrl": "urn:uuid:88f151c0-a954-468a-88bd-5ae15c08e059",
+					"resource": map[string]interface{}{
+						"resourceType": "Encounter",
+						"subject":      map[string]interface{}{"reference": "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a"},
+					},
+					"request": map[string]interface{}{"method": "POST", "url": "Encounter"},
+				},
+			},
+		}
+	}
+
+	// fullUrl references resolve; only the Provenance is missing
+	got := rs.Validate(bundle())
+	if got.Valid || len(got.Errors) != 2 {
+		t.Fatalf("Expected missing Provenance errors only, got %v", got.Errors)
+	}
+
+	InjectProvenance = true
+	defer func() { InjectProvenance = false }()
+	got = rs.ForClient("partner-a").Validate(bundle())
+	if !got.Valid || got.Resource == nil {
+		t.Fatalf("Expected the bundle to be valid with a Provenance added, got %v", got.Errors)
+	}
+	if len(got.Entries) != 2 {
+		t.Errorf("Expected Entries to describe the sender's 2 entries, got %d", len(got.Entries))
+	}
+	entries := got.Resource["entry"].([]interface{})
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	provenance := entries[2].(map[string]interface{})["resource"].(map[string]interface{})
+	if targets := provenance["target"].([]interface{}); len(targets) != 2 ||
+		targets[0].(map[string]interface{})["reference"] != "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a" {
+		t.Errorf("Expected every entry as a target, got %v", targets)
+	}
+	agent := provenance["agent"].([]interface{})[0].(map[string]interface{})
+	if agent["who"].(map[string]interface{})["identifier"].(map[string]interface{})["value"] != "partner-a" {
+		t.Errorf("Expected the client as agent, got %v", agent)
+	}
+	if _, err := time.Parse(time.RFC3339, provenance["recorded"].(string)); err != nil {
+		t.Errorf("Expected recorded to be a dateTime: %v", err)
+	}
+
+	// Bundles streamed with a Provenance are left alone
+	withProvenance := bundle()
+	withProvenance["entry"] = append(withProvenance["entry"].([]interface{}), map[string]interface{}{
+		"resource": map[string]interface{}{
+			"resourceType": "Provenance",
+			"target":       []interface{}{map[string]interface{}{"reference": "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a"}},
+		},
+	})
+	data, _ := json.Marshal(withProvenance)
+	streamed, err := rs.ValidateStream(bytes.NewReader(data))
+	if err != nil || !streamed.Valid || streamed.Resource != nil {
+		t.Errorf("Expected a bundle with Provenance to pass unchanged, got %v %v", err, streamed.Errors)
+	}
+}
+
+func TestLoadConfigDir_Status(t *testing.T) {
+	if err := LoadConfigDir(filepath.Join(t.TempDir(), "missing")); err == nil || ConfigReady() == nil {
+		t.Fatalf("Expected a missing configuration directory to fail and not be ready")
+	}
+	if status := Status(); status.Error == "" {
+		t.Errorf("Expected the load error in the status")
+	}
+
+	if err := LoadConfigDir("../../configs"); err != nil {
+		t.Fatalf("LoadConfigDir() error = %v", err)
+	}
+	if err := ConfigReady(); err != nil {
+		t.Errorf("Expected the configuration to be ready, got %v", err)
+	}
+	status := Status()
+	if status.Loaded == nil || status.Error != "" || len(status.Profiles) == 0 || status.Rules["Patient"] == 0 || len(status.Recipes) == 0 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	data, err := os.ReadFile("../../configs/rules.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	found := false
+	for _, f := range status.Files {
+		if filepath.Base(f.Path) == "rules.yaml" && filepath.Dir(f.Path) == "../../configs" {
+			found = f.SHA256 == hex.EncodeToString(sum[:]) && f.Loaded.Equal(*status.Loaded)
+		}
+	}
+	if !found {
+		t.Errorf("Expected rules.yaml with its hash in the status files, got %+v", status.Files)
+	}
+}
+
+func TestReloadConfigDir(t *testing.T) {
+	rules, recipes := ActiveRules()
+	plan := active().plan
+	t.Cleanup(func() {
+		rulesMu.Lock()
+		defer rulesMu.Unlock()
+		ExtraRules, activePlan, Recipes = rules, plan, recipes
+	})
+
+	dir := t.TempDir()
+	write := func(name, data string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("rules.yaml", "Observation:\n  status:\n    min: 1\n")
+	write("recipes.yaml", "transaction: {}\n")
+	if err := ReloadConfigDir(dir); err != nil {
+		t.Fatalf("ReloadConfigDir() error = %v", err)
+	}
+	status := Status()
+	if len(status.Rules) != 1 || status.Rules["Observation"] != 1 || len(status.Recipes) != 0 || status.ReloadError != "" {
+		t.Errorf("Expected the reloaded rules to replace the active ones, got %+v", status)
+	}
+
+	// A broken file keeps the rules that were active
+	write("rules.yaml", "Observation: [")
+	if err := ReloadConfigDir(dir); err == nil {
+		t.Fatal("Expected a broken rules.yaml to fail to reload")
+	}
+	status = Status()
+	if status.Rules["Observation"] != 1 || status.ReloadError == "" {
+		t.Errorf("Expected the previous rules and the reload error, got %+v", status)
+	}
+}